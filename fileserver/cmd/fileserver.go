@@ -21,12 +21,17 @@ func Start(args []string) (err error) {
 	dir := flags.String("dir", "", "absolute directory path to be served")
 	port := flags.String("port", "0", "set server port, default 0 means alloced by net Listener")
 	title := flags.String("title", "file server", "title of file server")
+	fsOptions := fileserver.AddFlags(flags)
 	if err = flags.Parse(args); err != nil {
 		if err == flag.ErrHelp {
 			err = nil
 		}
 		return err
 	}
+	options, err := fsOptions()
+	if err != nil {
+		return err
+	}
 
 	if len(*dir) == 0 {
 		return fmt.Errorf("no dir specified")
@@ -36,7 +41,7 @@ func Start(args []string) (err error) {
 	stream.SetOutputter(os.Stdout)
 	lg := stream.NewLogger("fileserver", log.StringToLoglevel(*logLevel))
 
-	fs = fileserver.NewFileServer(lg, *port, *dir, *title)
+	fs = fileserver.NewFileServer(lg, *port, *dir, *title, options...)
 	if fs == nil {
 		return errors.New("create file server failed")
 	}
@@ -2,25 +2,33 @@ package fileserver
 
 import (
 	"context"
+	"flag"
+	"fmt"
+	"html/template"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"text/template"
+	"sync"
+	"time"
 
 	"github.com/godevsig/glib/sys/log"
 	"github.com/gorilla/mux"
 )
 
 type attributes struct {
-	Flist []os.FileInfo
-	Ftype []string
-	Ftag  string
-	Title string
+	Flist  []os.FileInfo
+	Ftype  []string
+	Flink  []string // the escaped URL paths of the files
+	Action string   // the escaped URL path of the directory
+	Title  string
+	Upload bool
 }
 
 // FileServer represents data server
@@ -31,6 +39,72 @@ type FileServer struct {
 	lg       *log.Logger
 	srv      *http.Server
 	listener net.Listener
+
+	upload         bool
+	maxUpload      int64
+	overwrite      OverwritePolicy
+	delete         bool
+	rename         bool
+	mkdir          bool
+	protectedPaths []string
+	reservedPaths  []string
+	protectFunc    func(urlPath string) bool
+	partialExpiry  time.Duration
+	mu             sync.Mutex      // serializes the mutations
+	busy           map[string]bool // partial files of the chunked uploads in progress
+	done           chan struct{}
+}
+
+// Option is the option of the file server.
+type Option func(*FileServer)
+
+// AddFlags adds the flags of the options to the flag set of the commands serving
+// files, the returned function returns the options set by the parsed flags.
+func AddFlags(flags *flag.FlagSet) func() ([]Option, error) {
+	upload := flags.Bool("upload", false, "allow uploading files to the served directory")
+	maxUpload := flags.Int64("maxUpload", DefaultMaxUploadSize>>20, "set the max size of an uploaded file in MB")
+	overwrite := flags.String("overwrite", "deny", "set what an upload does when the file exists: deny, replace or rename")
+	del := flags.Bool("delete", false, "allow deleting files and directories in the served directory")
+	rename := flags.Bool("rename", false, "allow renaming and moving files and directories in the served directory")
+	mkdir := flags.Bool("mkdir", false, "allow creating directories in the served directory")
+	protect := flags.String("protect", "", "protect the paths matching the patterns from being deleted, renamed or replaced, separated by comma, e.g. /*/process-*.data")
+	partialExpiry := flags.Duration("partialExpiry", DefaultPartialExpiry, "remove the partial files of the chunked uploads not resumed within the duration")
+
+	return func() ([]Option, error) {
+		policy, err := ParseOverwritePolicy(*overwrite)
+		if err != nil {
+			return nil, err
+		}
+		if *maxUpload <= 0 {
+			return nil, fmt.Errorf("invalid max upload size %d", *maxUpload)
+		}
+		if *partialExpiry <= 0 {
+			return nil, fmt.Errorf("invalid partial upload expiry %v", *partialExpiry)
+		}
+		options := []Option{WithMaxUploadSize(*maxUpload << 20), WithOverwritePolicy(policy), WithPartialExpiry(*partialExpiry)}
+		if *upload {
+			options = append(options, WithUpload())
+		}
+		if *del {
+			options = append(options, WithDelete())
+		}
+		if *rename {
+			options = append(options, WithRename())
+		}
+		if *mkdir {
+			options = append(options, WithMkdir())
+		}
+		if *protect != "" {
+			patterns := strings.Split(*protect, ",")
+			for _, p := range patterns {
+				if _, err := path.Match(p, ""); err != nil {
+					return nil, fmt.Errorf("invalid protected path %q: %v", p, err)
+				}
+			}
+			options = append(options, WithProtectedPaths(patterns...))
+		}
+		return options, nil
+	}
 }
 
 const pageTpl = `
@@ -43,6 +117,10 @@ const pageTpl = `
 		<body>
 			<div id="container">
 				<h1>{{$.Title}}</h1>
+				{{- if $.Upload}}
+				<form method="post" enctype="multipart/form-data" action="{{$.Action}}" style="padding: 0 10px 12px 10px;">
+					<input type="file" name="file" multiple required> <input type="submit" value="Upload"></form>
+				{{- end}}
 				<table class="sortable">
 					<thead>
 						<tr>
@@ -55,7 +133,7 @@ const pageTpl = `
 					<tbody>{{range $i, $file := .Flist}} {{$type := index $.Ftype $i}}
 						<tr>
 							<td>
-								<a href="{{$.Ftag}}/{{$file.Name}}">{{$file.Name}}</a></td>
+								<a href="{{index $.Flink $i}}">{{$file.Name}}</a></td>
 							<td>{{$file.Size}}</td>
 							<td>{{$type}}</td>
 							<td>{{$file.ModTime}}</td></tr>{{end}}</tbody>
@@ -64,10 +142,27 @@ const pageTpl = `
 		</body>
 	</html>`
 
+var pageTmpl = template.Must(template.New("").Parse(pageTpl))
+
+// escapedPath returns the URL path of the elements with each escaped.
+func escapedPath(elems ...string) string {
+	var b strings.Builder
+	for _, e := range elems {
+		if e != "" {
+			b.WriteString("/" + url.PathEscape(e))
+		}
+	}
+	if b.Len() == 0 {
+		return "/"
+	}
+	return b.String()
+}
+
 // NewFileServer creates a new file server instance.
 // If port = "0", alloc available port by Listen.
 // If port != "0", use customized ip port.
-func NewFileServer(lg *log.Logger, port, dir, title string) *FileServer {
+// The file server is read only unless the options enable the uploads or the file management.
+func NewFileServer(lg *log.Logger, port, dir, title string, options ...Option) *FileServer {
 	listener, err := net.Listen("tcp", ":"+port)
 	if err != nil {
 		lg.Errorf("file server listen failed: %v", err)
@@ -79,14 +174,23 @@ func NewFileServer(lg *log.Logger, port, dir, title string) *FileServer {
 	}
 
 	fs := &FileServer{
-		Port:     port,
-		dir:      dir,
-		lg:       lg,
-		title:    title,
-		listener: listener,
+		Port:          port,
+		dir:           dir,
+		lg:            lg,
+		title:         title,
+		listener:      listener,
+		maxUpload:     DefaultMaxUploadSize,
+		partialExpiry: DefaultPartialExpiry,
+		busy:          make(map[string]bool),
+		done:          make(chan struct{}),
+	}
+	for _, o := range options {
+		o(fs)
 	}
 
 	router := mux.NewRouter().StrictSlash(false)
+	router.PathPrefix("/").Methods("POST", "PUT").HandlerFunc(fs.fileUpload)
+	router.PathPrefix("/").Methods("DELETE", "MOVE", "MKCOL").HandlerFunc(fs.fileManage)
 	handler := http.FileServer(http.Dir(fs.dir))
 	router.HandleFunc("/", fs.fileIndex)
 	router.HandleFunc("/{tag}", fs.fileIndex)
@@ -114,15 +218,20 @@ func (fs *FileServer) fileIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tmpl := template.Must(template.New("").Parse(pageTpl))
 	files, err := ioutil.ReadDir(fs.dir + "/" + tag)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	var fileType []string
+	var fileType, links []string
+	shown := files[:0]
 	for _, file := range files {
+		if hiddenFile(file.Name()) {
+			continue
+		}
+		shown = append(shown, file)
+		links = append(links, escapedPath(tag, file.Name()))
 		ext := filepath.Ext(file.Name())
 		if ext == "" {
 			fileType = append(fileType, "dir")
@@ -130,19 +239,18 @@ func (fs *FileServer) fileIndex(w http.ResponseWriter, r *http.Request) {
 			fileType = append(fileType, ext)
 		}
 	}
-	fa := attributes{Flist: files, Ftype: fileType, Ftag: tag, Title: fs.title}
-	tmpl.Execute(w, fa)
-}
-
-func (fs *FileServer) fileUpload(w http.ResponseWriter, r *http.Request) {
-}
-
-func (fs *FileServer) fileDelete(w http.ResponseWriter, r *http.Request) {
+	fa := attributes{Flist: shown, Ftype: fileType, Flink: links, Action: escapedPath(tag), Title: fs.title, Upload: fs.upload}
+	if err := pageTmpl.Execute(w, fa); err != nil {
+		fs.lg.Errorln(err)
+	}
 }
 
 // Start start the file server
 func (fs *FileServer) Start() error {
 	fs.lg.Infof("start file http server addr %s", fs.srv.Addr)
+	if fs.upload {
+		go fs.sweepPartials()
+	}
 
 	err := fs.srv.Serve(fs.listener)
 	if err == http.ErrServerClosed {
@@ -156,6 +264,7 @@ func (fs *FileServer) Start() error {
 
 // Stop stop the file server
 func (fs *FileServer) Stop() {
+	close(fs.done)
 	if err := fs.srv.Shutdown(context.Background()); err != nil {
 		fs.lg.Errorf("file http server shutdown failed: %v", err)
 	}
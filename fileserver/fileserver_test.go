@@ -0,0 +1,51 @@
+package fileserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestFileIndexEscaped(t *testing.T) {
+	fs := newTestServer(t, WithUpload())
+	fs.title = "<b>files</b>"
+	for _, name := range []string{`"><img src=x onerror=alert(1)>.txt`, "a#b?c.txt", "sub dir/x y.txt"} {
+		writeFile(t, filepath.Join(fs.dir, name), "x")
+	}
+
+	index := func(tag string) string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = mux.SetURLVars(r, map[string]string{"tag": tag})
+		w := httptest.NewRecorder()
+		fs.fileIndex(w, r)
+		return w.Body.String()
+	}
+
+	page := index("")
+	for _, want := range []string{
+		`href="/%22%3E%3Cimg%20src=x%20onerror=alert%281%29%3E.txt"`,
+		`&#34;&gt;&lt;img src=x onerror=alert(1)&gt;.txt</a>`,
+		`href="/a%23b%3Fc.txt"`,
+		`href="/sub%20dir"`,
+		`action="/"`,
+		`<h1>&lt;b&gt;files&lt;/b&gt;</h1>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("%s not in the page:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, "<img") {
+		t.Errorf("file name not escaped:\n%s", page)
+	}
+
+	page = index("sub dir")
+	for _, want := range []string{`href="/sub%20dir/x%20y.txt"`, `action="/sub%20dir"`} {
+		if !strings.Contains(page, want) {
+			t.Errorf("%s not in the page:\n%s", want, page)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errNotFound       = errors.New("file not found")
+	errProtected      = errors.New("protected path")
+	errNotEmpty       = errors.New("directory not empty")
+	errBadDestination = errors.New("invalid Destination header")
+	errMoveIntoSelf   = errors.New("destination inside the source")
+	errNoParent       = errors.New("parent of the destination not found")
+)
+
+// WithDelete enables deleting files and empty directories by DELETE.
+func WithDelete() Option {
+	return func(fs *FileServer) {
+		fs.delete = true
+	}
+}
+
+// WithRename enables renaming or moving files and directories by MOVE.
+func WithRename() Option {
+	return func(fs *FileServer) {
+		fs.rename = true
+	}
+}
+
+// WithMkdir enables creating directories by MKCOL.
+func WithMkdir() Option {
+	return func(fs *FileServer) {
+		fs.mkdir = true
+	}
+}
+
+// WithProtectedPaths protects the paths matching the patterns and all under them
+// from being deleted, renamed, or created or replaced by uploads. The patterns are matched
+// against the URL paths by path.Match, e.g. /*/process-*.data.
+func WithProtectedPaths(patterns ...string) Option {
+	return func(fs *FileServer) {
+		fs.protectedPaths = append(fs.protectedPaths, patterns...)
+	}
+}
+
+// WithReservedPaths reserves the paths matching the patterns and all under them
+// for the application serving its files: they can not be created or replaced by
+// uploads, MKCOL or MOVE, but can be deleted unless protected too.
+func WithReservedPaths(patterns ...string) Option {
+	return func(fs *FileServer) {
+		fs.reservedPaths = append(fs.reservedPaths, patterns...)
+	}
+}
+
+// WithProtectFunc protects the URL paths f returns true for, in addition to the
+// protected paths. f should also return true for the directories containing them.
+func WithProtectFunc(f func(urlPath string) bool) Option {
+	return func(fs *FileServer) {
+		fs.protectFunc = f
+	}
+}
+
+// matchPath returns true if the clean URL path or any of its parents matches any of the patterns.
+func matchPath(patterns []string, p string) bool {
+	for q := p; q != "/"; q = path.Dir(q) {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, q); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// protected returns true if the URL path is the served directory itself,
+// or it or any of its parents is protected.
+func (fs *FileServer) protected(urlPath string) bool {
+	p := path.Clean("/" + urlPath)
+	if p == "/" {
+		return true
+	}
+	if matchPath(fs.protectedPaths, p) {
+		return true
+	}
+	return fs.protectFunc != nil && fs.protectFunc(p)
+}
+
+// createProtected returns true if the URL path can not be created or replaced:
+// it is protected or reserved, or its directory is protected other than the
+// served directory itself.
+func (fs *FileServer) createProtected(urlPath string) bool {
+	p := path.Clean("/" + urlPath)
+	if fs.protected(p) || matchPath(fs.reservedPaths, p) {
+		return true
+	}
+	dir := path.Dir(p)
+	return dir != "/" && fs.protected(dir)
+}
+
+// protectedTree returns true if the local path or anything under it is protected.
+func (fs *FileServer) protectedTree(local string) bool {
+	found := false
+	filepath.Walk(local, func(p string, info os.FileInfo, err error) error {
+		if err == nil && fs.protected(fs.urlPath(p)) {
+			found = true
+			return errProtected
+		}
+		return nil
+	})
+	return found
+}
+
+// reservedTree returns true if anything under the local path would be at a
+// reserved path once the local path is moved to dst.
+func (fs *FileServer) reservedTree(local, dst string) bool {
+	found := false
+	filepath.Walk(local, func(p string, info os.FileInfo, err error) error {
+		if err == nil && matchPath(fs.reservedPaths, fs.urlPath(dst+strings.TrimPrefix(p, local))) {
+			found = true
+			return errProtected
+		}
+		return nil
+	})
+	return found
+}
+
+func (fs *FileServer) manageError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case err == errProtected:
+		code = http.StatusForbidden
+	case err == errFileExists, err == errNotEmpty, err == errNoParent:
+		code = http.StatusConflict
+	case err == errInvalidName, err == errBadDestination, err == errMoveIntoSelf:
+		code = http.StatusBadRequest
+	case os.IsNotExist(err):
+		code = http.StatusNotFound
+		err = errNotFound
+	}
+	if code == http.StatusInternalServerError {
+		fs.lg.Errorf("%s %s from %s failed: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+	} else {
+		fs.lg.Warnf("%s %s from %s rejected: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+	}
+	http.Error(w, fmt.Sprintf("%s %s failed: %v", r.Method, r.URL.Path, err), code)
+}
+
+// fileManage handles the file management, each operation should be enabled by its option:
+//   - DELETE deletes the file or the empty directory, or the directory with all
+//     in it with ?recursive=true
+//   - MOVE renames or moves the file or directory to the path, or the URL, in the
+//     Destination header, the parent of the destination should exist
+//   - MKCOL creates the directory and its missing parents
+//
+// The protected paths can not be deleted, renamed or moved, and nothing can be
+// created at the protected or reserved paths or in the protected directories.
+func (fs *FileServer) fileManage(w http.ResponseWriter, r *http.Request) {
+	var enabled bool
+	switch r.Method {
+	case "DELETE":
+		enabled = fs.delete
+	case "MOVE":
+		enabled = fs.rename
+	case "MKCOL":
+		enabled = fs.mkdir
+	}
+	if !enabled {
+		http.Error(w, r.Method+" is not allowed on this server", http.StatusMethodNotAllowed)
+		return
+	}
+
+	local := fs.localPath(r.URL.Path)
+	var err error
+	switch r.Method {
+	case "DELETE":
+		err = fs.remove(local, r.URL.Query().Get("recursive") == "true")
+		if err == nil {
+			fs.lg.Infof("deleted %s from %s", fs.urlPath(local), r.RemoteAddr)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case "MOVE":
+		var dst string
+		dst, err = fs.move(local, r.Header.Get("Destination"))
+		if err == nil {
+			fs.lg.Infof("moved %s to %s from %s", fs.urlPath(local), fs.urlPath(dst), r.RemoteAddr)
+			w.Header().Set("Location", fs.urlPath(dst))
+			w.WriteHeader(http.StatusCreated)
+		}
+	case "MKCOL":
+		err = fs.makeDir(local)
+		if err == nil {
+			fs.lg.Infof("created directory %s from %s", fs.urlPath(local), r.RemoteAddr)
+			w.WriteHeader(http.StatusCreated)
+		}
+	}
+	if err != nil {
+		fs.manageError(w, r, err)
+	}
+}
+
+func (fs *FileServer) remove(local string, recursive bool) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fi, err := os.Lstat(local)
+	if err != nil {
+		return err
+	}
+	if fs.protectedTree(local) {
+		return errProtected
+	}
+	if !fi.IsDir() {
+		return os.Remove(local)
+	}
+	if recursive {
+		return os.RemoveAll(local)
+	}
+	if err := os.Remove(local); err != nil {
+		if entries, _ := os.ReadDir(local); len(entries) != 0 {
+			return errNotEmpty
+		}
+		return err
+	}
+	return nil
+}
+
+// move renames local to the destination, which is never overwritten.
+func (fs *FileServer) move(local, destination string) (string, error) {
+	u, err := url.Parse(destination)
+	if destination == "" || err != nil {
+		return "", errBadDestination
+	}
+	dst := fs.localPath(u.Path)
+	if hiddenFile(filepath.Base(dst)) {
+		return "", errInvalidName
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, err := os.Lstat(local); err != nil {
+		return "", err
+	}
+	if fs.protectedTree(local) || fs.createProtected(fs.urlPath(dst)) || fs.reservedTree(local, dst) {
+		return "", errProtected
+	}
+	if dst == local || strings.HasPrefix(dst, local+string(filepath.Separator)) {
+		return "", errMoveIntoSelf
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return "", errFileExists
+	}
+	if fi, err := os.Stat(filepath.Dir(dst)); err != nil || !fi.IsDir() {
+		return "", errNoParent
+	}
+	return dst, os.Rename(local, dst)
+}
+
+func (fs *FileServer) makeDir(local string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, err := os.Lstat(local); err == nil {
+		return errFileExists
+	}
+	if hiddenFile(filepath.Base(local)) {
+		return errInvalidName
+	}
+	if fs.createProtected(fs.urlPath(local)) {
+		return errProtected
+	}
+	return os.MkdirAll(local, 0755)
+}
@@ -0,0 +1,168 @@
+package fileserver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProtected(t *testing.T) {
+	fs := newTestServer(t, WithProtectedPaths("/*/process-*.data", "/dumps"),
+		WithProtectFunc(func(urlPath string) bool { return urlPath == "/live" }))
+
+	cases := []struct {
+		urlPath   string
+		protected bool
+	}{
+		{"/", true},
+		{"", true},
+		{"/t/process-1.data", true},
+		{"/t/../t/process-1.data", true},
+		{"/dumps", true},
+		{"/dumps/board1/core.1", true},
+		{"/live", true},
+		{"/t", false},
+		{"/t/system-1.data", false},
+		{"/t/sub/process-1.data", false},
+		{"/dumps2", false},
+		{"/live/x", false},
+	}
+	for _, c := range cases {
+		if got := fs.protected(c.urlPath); got != c.protected {
+			t.Errorf("%q: got %v, want %v", c.urlPath, got, c.protected)
+		}
+	}
+}
+
+func TestProtectedTree(t *testing.T) {
+	fs := newTestServer(t, WithProtectedPaths("/*/process-*.data"))
+	writeFile(t, filepath.Join(fs.dir, "t", "process-1.data"), "")
+	writeFile(t, filepath.Join(fs.dir, "t", "sub", "a.txt"), "")
+
+	for name, want := range map[string]bool{
+		"t":                true,
+		"t/process-1.data": true,
+		"t/sub":            false,
+		"t/sub/a.txt":      false,
+	} {
+		if got := fs.protectedTree(filepath.Join(fs.dir, name)); got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+	if !fs.protectedTree(fs.dir) {
+		t.Error("served directory not protected")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	fs := newTestServer(t, WithProtectedPaths("/*/process-*.data"))
+	writeFile(t, filepath.Join(fs.dir, "t", "process-1.data"), "")
+	writeFile(t, filepath.Join(fs.dir, "t", "a.txt"), "")
+	writeFile(t, filepath.Join(fs.dir, "u", "sub", "a.txt"), "")
+
+	cases := []struct {
+		name      string
+		recursive bool
+		err       error
+	}{
+		{"t/process-1.data", false, errProtected},
+		{"t", true, errProtected},
+		{"u", false, errNotEmpty},
+		{"t/a.txt", false, nil},
+		{"u", true, nil},
+	}
+	for _, c := range cases {
+		if err := fs.remove(filepath.Join(fs.dir, c.name), c.recursive); err != c.err {
+			t.Errorf("%s recursive %v: got %v, want %v", c.name, c.recursive, err, c.err)
+		}
+	}
+	if err := fs.remove(filepath.Join(fs.dir, "none"), false); !os.IsNotExist(err) {
+		t.Errorf("missing file: got %v", err)
+	}
+	if err := fs.remove(fs.dir, true); err != errProtected {
+		t.Errorf("served directory: got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(fs.dir, "t", "process-1.data")); err != nil {
+		t.Errorf("protected file removed: %v", err)
+	}
+}
+
+func TestMove(t *testing.T) {
+	fs := newTestServer(t, WithProtectedPaths("/*/process-*.data", "/locked"))
+	writeFile(t, filepath.Join(fs.dir, "t", "process-1.data"), "")
+	writeFile(t, filepath.Join(fs.dir, "t", "a.txt"), "")
+	writeFile(t, filepath.Join(fs.dir, "u", "b.txt"), "")
+	os.Mkdir(filepath.Join(fs.dir, "locked"), 0755)
+
+	cases := []struct {
+		name        string
+		destination string
+		err         error
+	}{
+		{"t/process-1.data", "/t/x.data", errProtected},
+		{"t", "/t2", errProtected},
+		{"t/a.txt", "/t/process-2.data", errProtected},
+		{"t/a.txt", "/locked/a.txt", errProtected},
+		{"u", "/u/sub", errMoveIntoSelf},
+		{"t/a.txt", "/u/b.txt", errFileExists},
+		{"t/a.txt", "/none/a.txt", errNoParent},
+		{"t/a.txt", "", errBadDestination},
+		{"t/a.txt", "/u/.upload-1", errInvalidName},
+		{"t/a.txt", "http://host/u/c.txt", nil},
+		{"u", "/v", nil},
+	}
+	for _, c := range cases {
+		if _, err := fs.move(filepath.Join(fs.dir, c.name), c.destination); err != c.err {
+			t.Errorf("%s to %q: got %v, want %v", c.name, c.destination, err, c.err)
+		}
+	}
+	for _, name := range []string{"v/c.txt", "v/b.txt", "t/process-1.data"} {
+		if _, err := os.Lstat(filepath.Join(fs.dir, name)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestMakeDir(t *testing.T) {
+	fs := newTestServer(t, WithProtectedPaths("/locked"))
+	writeFile(t, filepath.Join(fs.dir, "t", "a.txt"), "")
+	os.Mkdir(filepath.Join(fs.dir, "locked"), 0755)
+
+	cases := []struct {
+		urlPath string
+		err     error
+	}{
+		{"/t", errFileExists},
+		{"/t/a.txt", errFileExists},
+		{"/t/.upload-1", errInvalidName},
+		{"/locked/sub", errProtected},
+		{"/new/sub", nil},
+	}
+	for _, c := range cases {
+		if err := fs.makeDir(fs.localPath(c.urlPath)); err != c.err {
+			t.Errorf("%s: got %v, want %v", c.urlPath, err, c.err)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(fs.dir, "new", "sub")); err != nil || !fi.IsDir() {
+		t.Errorf("directory not created: %v", err)
+	}
+}
+
+func TestMakeDirSerialized(t *testing.T) {
+	fs := newTestServer(t)
+	dir := filepath.Join(fs.dir, "new")
+
+	// an upload is placing its file
+	fs.mu.Lock()
+	done := make(chan error)
+	go func() { done <- fs.makeDir(dir) }()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := os.Stat(dir); err == nil {
+		t.Error("directory created during another mutation")
+	}
+	fs.mu.Unlock()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,487 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OverwritePolicy is what an upload does when the file already exists.
+type OverwritePolicy int
+
+// Overwrite policies.
+const (
+	OverwriteDeny    OverwritePolicy = iota // reject the upload
+	OverwriteReplace                        // replace the existing file
+	OverwriteRename                         // keep the existing file, save the upload as name-N.ext
+)
+
+// ParseOverwritePolicy returns the policy of the name: deny, replace or rename.
+func ParseOverwritePolicy(name string) (OverwritePolicy, error) {
+	switch name {
+	case "deny":
+		return OverwriteDeny, nil
+	case "replace":
+		return OverwriteReplace, nil
+	case "rename":
+		return OverwriteRename, nil
+	}
+	return OverwriteDeny, fmt.Errorf("unknown overwrite policy %q", name)
+}
+
+const (
+	// DefaultMaxUploadSize is the default max size of an uploaded file.
+	DefaultMaxUploadSize = 1 << 30
+	// DefaultPartialExpiry is the default time the partial files of the chunked
+	// uploads are kept since the last chunk.
+	DefaultPartialExpiry = 24 * time.Hour
+	// maxSweepInterval is the max interval the expired partial files are removed.
+	maxSweepInterval = time.Hour
+)
+
+const (
+	// uploadPrefix is the prefix of the temp files of the uploads.
+	uploadPrefix = ".upload-"
+	// partialSuffix is the suffix of the partial files of the chunked uploads,
+	// saved as .<name>.upload next to the target until the last chunk.
+	partialSuffix = ".upload"
+)
+
+var (
+	errFileExists  = errors.New("file already exists")
+	errTooLarge    = errors.New("file too large")
+	errUploadBusy  = errors.New("another upload of the file in progress")
+	errInvalidName = errors.New("invalid file name")
+)
+
+// WithUpload enables the uploads by multipart form POST to a directory,
+// or by PUT to a file path, see fileUpload.
+func WithUpload() Option {
+	return func(fs *FileServer) {
+		fs.upload = true
+	}
+}
+
+// WithMaxUploadSize sets the max size of an uploaded file, DefaultMaxUploadSize by default.
+func WithMaxUploadSize(size int64) Option {
+	return func(fs *FileServer) {
+		fs.maxUpload = size
+	}
+}
+
+// WithOverwritePolicy sets what an upload does when the file exists, OverwriteDeny by default.
+func WithOverwritePolicy(policy OverwritePolicy) Option {
+	return func(fs *FileServer) {
+		fs.overwrite = policy
+	}
+}
+
+// WithPartialExpiry sets the time the partial files of the chunked uploads are kept
+// since the last chunk, DefaultPartialExpiry by default.
+func WithPartialExpiry(expiry time.Duration) Option {
+	return func(fs *FileServer) {
+		fs.partialExpiry = expiry
+	}
+}
+
+// hiddenFile returns true if the name is a temp or partial file of the uploads.
+func hiddenFile(name string) bool {
+	return strings.HasPrefix(name, uploadPrefix) ||
+		(strings.HasPrefix(name, ".") && strings.HasSuffix(name, partialSuffix))
+}
+
+// localPath returns the path under the served directory of the URL path.
+func (fs *FileServer) localPath(urlPath string) string {
+	return filepath.Join(fs.dir, filepath.FromSlash(path.Clean("/"+urlPath)))
+}
+
+// freeName returns name-N.ext for the first N the file does not exist.
+func freeName(filename string) string {
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("%s-%d%s", base, i, ext)
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name
+		}
+	}
+}
+
+// place renames the uploaded file tmp to target by the overwrite policy,
+// and returns the final path.
+func (fs *FileServer) place(tmp, target string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fi, err := os.Lstat(target); err == nil {
+		switch {
+		case fi.IsDir():
+			return "", errFileExists
+		case fs.overwrite == OverwriteDeny:
+			return "", errFileExists
+		case fs.overwrite == OverwriteRename:
+			target = freeName(target)
+		}
+	}
+	if fs.createProtected(fs.urlPath(target)) {
+		return "", errProtected
+	}
+	if err := os.Chmod(tmp, 0644); err != nil {
+		return "", err
+	}
+	return target, os.Rename(tmp, target)
+}
+
+// checkTarget returns the error early if the upload would be rejected anyway,
+// the existing target renamed by OverwriteRename is checked by place.
+func (fs *FileServer) checkTarget(target string) error {
+	if hiddenFile(filepath.Base(target)) {
+		return errInvalidName
+	}
+	fi, err := os.Lstat(target)
+	if err == nil && (fi.IsDir() || fs.overwrite == OverwriteDeny) {
+		return errFileExists
+	}
+	if (err != nil || fs.overwrite == OverwriteReplace) && fs.createProtected(fs.urlPath(target)) {
+		return errProtected
+	}
+	return nil
+}
+
+// save writes the content of r to a temp file then renames it to target,
+// so readers never see a partially uploaded file.
+func (fs *FileServer) save(target string, r io.Reader) (string, int64, error) {
+	if err := fs.checkTarget(target); err != nil {
+		return "", 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", 0, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(target), uploadPrefix+"*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, io.LimitReader(r, fs.maxUpload+1))
+	if err == nil && n > fs.maxUpload {
+		err = errTooLarge
+	}
+	if err != nil {
+		tmp.Close()
+		return "", n, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", n, err
+	}
+	target, err = fs.place(tmp.Name(), target)
+	return target, n, err
+}
+
+// urlPath returns the URL path of the local path under the served directory.
+func (fs *FileServer) urlPath(local string) string {
+	rel, err := filepath.Rel(fs.dir, local)
+	if err != nil {
+		return ""
+	}
+	return "/" + filepath.ToSlash(rel)
+}
+
+func (fs *FileServer) uploadError(w http.ResponseWriter, name string, err error) {
+	code := http.StatusInternalServerError
+	switch err {
+	case errFileExists, errUploadBusy:
+		code = http.StatusConflict
+	case errTooLarge:
+		code = http.StatusRequestEntityTooLarge
+	case errProtected:
+		code = http.StatusForbidden
+	case errInvalidName:
+		code = http.StatusBadRequest
+	}
+	if code == http.StatusInternalServerError {
+		fs.lg.Errorf("upload %s failed: %v", name, err)
+	} else {
+		fs.lg.Warnf("upload %s rejected: %v", name, err)
+	}
+	http.Error(w, fmt.Sprintf("upload %s failed: %v", name, err), code)
+}
+
+// fileUpload handles the uploads:
+//   - POST of multipart form to a directory saves the files of the form in it
+//   - PUT to a file path saves the body as the file
+//   - PUT with Content-Range: bytes <first>-<last>/<total> appends the chunk to the
+//     partial file, the chunks should be in order and the one starting at 0 restarts
+//     the upload. The reply is 308 with Range: bytes=0-<last received> until the file
+//     is complete, then 201. Content-Range: bytes */<total> queries the bytes received.
+//
+// The directories of the path are created if missing.
+func (fs *FileServer) fileUpload(w http.ResponseWriter, r *http.Request) {
+	if !fs.upload {
+		http.Error(w, r.Method+" is not allowed on this server", http.StatusMethodNotAllowed)
+		return
+	}
+	target := fs.localPath(r.URL.Path)
+	if r.Method == http.MethodPost {
+		fs.uploadForm(w, r, target)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/") || target == fs.dir {
+		http.Error(w, "no file name in the path", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Content-Range") != "" {
+		fs.uploadChunk(w, r, target)
+		return
+	}
+	if r.ContentLength > fs.maxUpload {
+		fs.uploadError(w, r.URL.Path, errTooLarge)
+		return
+	}
+
+	target, n, err := fs.save(target, r.Body)
+	if err != nil {
+		fs.uploadError(w, r.URL.Path, err)
+		return
+	}
+	fs.created(w, r, target, n)
+}
+
+func (fs *FileServer) created(w http.ResponseWriter, r *http.Request, target string, n int64) {
+	url := fs.urlPath(target)
+	fs.lg.Infof("uploaded %s, %d bytes from %s", url, n, r.RemoteAddr)
+	w.Header().Set("Location", url)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, url)
+}
+
+// uploadForm saves the files of the multipart form into the directory.
+func (fs *FileServer) uploadForm(w http.ResponseWriter, r *http.Request, dir string) {
+	if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
+		http.Error(w, "not a directory", http.StatusBadRequest)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var uploaded []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// browsers may send the full client path on Windows
+		name := path.Base(strings.ReplaceAll(part.FileName(), `\`, "/"))
+		if part.FileName() == "" || name == "." || name == "/" || name == ".." {
+			part.Close()
+			continue
+		}
+		target, n, err := fs.save(filepath.Join(dir, name), part)
+		part.Close()
+		if err != nil {
+			fs.uploadError(w, name, err)
+			return
+		}
+		fs.lg.Infof("uploaded %s, %d bytes from %s", fs.urlPath(target), n, r.RemoteAddr)
+		uploaded = append(uploaded, fs.urlPath(target))
+	}
+	if len(uploaded) == 0 {
+		http.Error(w, "no file in the form", http.StatusBadRequest)
+		return
+	}
+
+	// back to the index for the browsers
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, strings.Join(uploaded, "\n"))
+}
+
+// parseContentRange parses bytes <first>-<last>/<total> or bytes */<total>,
+// first is -1 for the latter.
+func parseContentRange(s string) (first, last, total int64, err error) {
+	invalid := fmt.Errorf("invalid Content-Range %q", s)
+	s = strings.TrimPrefix(s, "bytes ")
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		return 0, 0, 0, invalid
+	}
+	if total, err = strconv.ParseInt(s[i+1:], 10, 64); err != nil || total <= 0 {
+		return 0, 0, 0, invalid
+	}
+	if s[:i] == "*" {
+		return -1, -1, total, nil
+	}
+	r := strings.SplitN(s[:i], "-", 2)
+	if len(r) != 2 {
+		return 0, 0, 0, invalid
+	}
+	first, err1 := strconv.ParseInt(r[0], 10, 64)
+	last, err2 := strconv.ParseInt(r[1], 10, 64)
+	if err1 != nil || err2 != nil || first < 0 || last < first || last >= total {
+		return 0, 0, 0, invalid
+	}
+	return first, last, total, nil
+}
+
+// lockUpload marks the upload of the partial file in progress.
+func (fs *FileServer) lockUpload(partial string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.busy[partial] {
+		return false
+	}
+	fs.busy[partial] = true
+	return true
+}
+
+func (fs *FileServer) unlockUpload(partial string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.busy, partial)
+}
+
+// incomplete replies the bytes received of the chunked upload.
+func incomplete(w http.ResponseWriter, code int, received int64) {
+	if received > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+	}
+	w.WriteHeader(code)
+}
+
+// uploadChunk appends the chunk of the chunked upload to the partial file,
+// which is renamed to the target when complete.
+func (fs *FileServer) uploadChunk(w http.ResponseWriter, r *http.Request, target string) {
+	first, last, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if total > fs.maxUpload {
+		fs.uploadError(w, r.URL.Path, errTooLarge)
+		return
+	}
+	partial := filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+partialSuffix)
+	if !fs.lockUpload(partial) {
+		fs.uploadError(w, r.URL.Path, errUploadBusy)
+		return
+	}
+	defer fs.unlockUpload(partial)
+
+	var received int64
+	if fi, err := os.Stat(partial); err == nil {
+		received = fi.Size()
+	}
+	if first < 0 {
+		incomplete(w, http.StatusPermanentRedirect, received)
+		return
+	}
+	if first != 0 && first != received {
+		incomplete(w, http.StatusRequestedRangeNotSatisfiable, received)
+		return
+	}
+	if first == 0 {
+		if err := fs.checkTarget(target); err != nil {
+			fs.uploadError(w, r.URL.Path, err)
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			fs.uploadError(w, r.URL.Path, err)
+			return
+		}
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if first == 0 {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(partial, flag, 0600)
+	if err != nil {
+		fs.uploadError(w, r.URL.Path, err)
+		return
+	}
+	size := last - first + 1
+	n, err := io.Copy(f, io.LimitReader(r.Body, size))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	received = first + n
+	if err != nil {
+		fs.uploadError(w, r.URL.Path, err)
+		return
+	}
+	if n != size {
+		if received > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+		}
+		http.Error(w, fmt.Sprintf("chunk incomplete, %d of %d bytes received", n, size), http.StatusBadRequest)
+		return
+	}
+	if received < total {
+		incomplete(w, http.StatusPermanentRedirect, received)
+		return
+	}
+
+	target, err = fs.place(partial, target)
+	if err != nil {
+		fs.uploadError(w, r.URL.Path, err)
+		return
+	}
+	fs.created(w, r, target, total)
+}
+
+// removeExpired removes the partial files of the chunked uploads not appended since
+// the expiry, and the temp files left by the uploads interrupted by a restart.
+func (fs *FileServer) removeExpired(now time.Time) {
+	filepath.Walk(fs.dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !hiddenFile(info.Name()) || now.Sub(info.ModTime()) < fs.partialExpiry {
+			return nil
+		}
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		if fs.busy[name] {
+			return nil
+		}
+		if err := os.Remove(name); err != nil {
+			fs.lg.Warnf("remove expired upload %s failed: %v", fs.urlPath(name), err)
+		} else {
+			fs.lg.Infof("removed expired upload %s", fs.urlPath(name))
+		}
+		return nil
+	})
+}
+
+// sweepPartials removes the expired partial files periodically until the server stops.
+func (fs *FileServer) sweepPartials() {
+	interval := fs.partialExpiry
+	if interval > maxSweepInterval {
+		interval = maxSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		fs.removeExpired(time.Now())
+		select {
+		case <-ticker.C:
+		case <-fs.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package fileserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godevsig/glib/sys/log"
+)
+
+var testLogger = func() *log.Logger {
+	stream := log.NewStream("")
+	stream.SetOutputter(ioutil.Discard)
+	return stream.NewLogger("test", log.Linfo)
+}()
+
+func newTestServer(t *testing.T, options ...Option) *FileServer {
+	fs := &FileServer{
+		dir:           t.TempDir(),
+		lg:            testLogger,
+		maxUpload:     DefaultMaxUploadSize,
+		partialExpiry: DefaultPartialExpiry,
+		busy:          make(map[string]bool),
+	}
+	for _, o := range options {
+		o(fs)
+	}
+	return fs
+}
+
+func writeFile(t *testing.T, name, content string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestParseContentRange(t *testing.T) {
+	cases := []struct {
+		s                  string
+		first, last, total int64
+		valid              bool
+	}{
+		{"bytes 0-99/1000", 0, 99, 1000, true},
+		{"bytes 900-999/1000", 900, 999, 1000, true},
+		{"bytes 0-0/1", 0, 0, 1, true},
+		{"bytes */1000", -1, -1, 1000, true},
+		{"bytes 0-99", 0, 0, 0, false},
+		{"bytes 0-99/0", 0, 0, 0, false},
+		{"bytes 0-1000/1000", 0, 0, 0, false},
+		{"bytes 100-99/1000", 0, 0, 0, false},
+		{"bytes -1-99/1000", 0, 0, 0, false},
+		{"bytes 0/1000", 0, 0, 0, false},
+		{"bytes a-b/1000", 0, 0, 0, false},
+		{"bytes */x", 0, 0, 0, false},
+	}
+	for _, c := range cases {
+		first, last, total, err := parseContentRange(c.s)
+		if (err == nil) != c.valid {
+			t.Errorf("%q: got %v, want valid %v", c.s, err, c.valid)
+			continue
+		}
+		if c.valid && (first != c.first || last != c.last || total != c.total) {
+			t.Errorf("%q: got %d-%d/%d, want %d-%d/%d", c.s, first, last, total, c.first, c.last, c.total)
+		}
+	}
+}
+
+func TestParseOverwritePolicy(t *testing.T) {
+	for name, want := range map[string]OverwritePolicy{
+		"deny":    OverwriteDeny,
+		"replace": OverwriteReplace,
+		"rename":  OverwriteRename,
+	} {
+		if got, err := ParseOverwritePolicy(name); err != nil || got != want {
+			t.Errorf("%s: got %v %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseOverwritePolicy("bogus"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestSaveOverwrite(t *testing.T) {
+	cases := []struct {
+		policy  OverwritePolicy
+		err     error
+		name    string
+		content string
+	}{
+		{OverwriteDeny, errFileExists, "a.txt", "old"},
+		{OverwriteReplace, nil, "a.txt", "new"},
+		{OverwriteRename, nil, "a-1.txt", "new"},
+	}
+	for _, c := range cases {
+		fs := newTestServer(t, WithOverwritePolicy(c.policy))
+		target := filepath.Join(fs.dir, "d", "a.txt")
+		writeFile(t, target, "old")
+
+		saved, _, err := fs.save(target, strings.NewReader("new"))
+		if err != c.err {
+			t.Errorf("policy %v: got %v, want %v", c.policy, err, c.err)
+			continue
+		}
+		if err == nil && saved != filepath.Join(fs.dir, "d", c.name) {
+			t.Errorf("policy %v: saved as %s, want %s", c.policy, saved, c.name)
+		}
+		if got := readFile(t, filepath.Join(fs.dir, "d", c.name)); got != c.content {
+			t.Errorf("policy %v: %s is %q, want %q", c.policy, c.name, got, c.content)
+		}
+		if c.policy == OverwriteRename && readFile(t, target) != "old" {
+			t.Errorf("policy %v: existing file changed", c.policy)
+		}
+	}
+}
+
+func TestSaveNew(t *testing.T) {
+	fs := newTestServer(t, WithMaxUploadSize(4))
+	target := filepath.Join(fs.dir, "new", "dir", "a.txt")
+	saved, n, err := fs.save(target, strings.NewReader("abcd"))
+	if err != nil || saved != target || n != 4 {
+		t.Fatalf("got %s %d %v", saved, n, err)
+	}
+	if got := readFile(t, target); got != "abcd" {
+		t.Errorf("got %q", got)
+	}
+
+	if _, _, err := fs.save(filepath.Join(fs.dir, "b.txt"), strings.NewReader("abcde")); err != errTooLarge {
+		t.Errorf("too large: got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(fs.dir, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("too large upload saved: %v", err)
+	}
+	entries, _ := os.ReadDir(fs.dir)
+	for _, e := range entries {
+		if hiddenFile(e.Name()) {
+			t.Errorf("temp file %s left", e.Name())
+		}
+	}
+}
+
+func TestCheckTarget(t *testing.T) {
+	fs := newTestServer(t, WithOverwritePolicy(OverwriteReplace),
+		WithProtectedPaths("/locked", "/*/keep.txt"),
+		WithReservedPaths("/*/*.data"))
+	writeFile(t, filepath.Join(fs.dir, "t", "keep.txt"), "")
+	writeFile(t, filepath.Join(fs.dir, "t", "other.txt"), "")
+	writeFile(t, filepath.Join(fs.dir, "t", "x.data"), "")
+	os.Mkdir(filepath.Join(fs.dir, "locked"), 0755)
+
+	cases := []struct {
+		urlPath string
+		err     error
+	}{
+		{"/t/other.txt", nil},
+		{"/t/new.txt", nil},
+		{"/new.data", nil},
+		{"/t/sub/new.data", nil},
+		{"/t", errFileExists},
+		{"/t/.upload-123", errInvalidName},
+		{"/t/.a.txt.upload", errInvalidName},
+		{"/t/keep.txt", errProtected},
+		{"/t/x.data", errProtected},
+		{"/t/new.data", errProtected},
+		{"/u/new.data", errProtected},
+		{"/locked", errFileExists},
+		{"/locked/new.txt", errProtected},
+		{"/locked/sub/new.txt", errProtected},
+	}
+	for _, c := range cases {
+		if err := fs.checkTarget(fs.localPath(c.urlPath)); err != c.err {
+			t.Errorf("%s: got %v, want %v", c.urlPath, err, c.err)
+		}
+	}
+}
+
+func TestPlaceRenamedReserved(t *testing.T) {
+	fs := newTestServer(t, WithOverwritePolicy(OverwriteRename), WithReservedPaths("/*/*-1.data"))
+	target := filepath.Join(fs.dir, "t", "a.data")
+	writeFile(t, target, "old")
+
+	if err := fs.checkTarget(target); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fs.save(target, strings.NewReader("new")); err != errProtected {
+		t.Errorf("got %v, want %v", err, errProtected)
+	}
+	if _, err := os.Lstat(filepath.Join(fs.dir, "t", "a-1.data")); !os.IsNotExist(err) {
+		t.Errorf("reserved file created: %v", err)
+	}
+}
+
+func TestReservedManage(t *testing.T) {
+	fs := newTestServer(t, WithReservedPaths("/*/*.data", "/*/dashboard.json"))
+	writeFile(t, filepath.Join(fs.dir, "up", "x.data"), "")
+	writeFile(t, filepath.Join(fs.dir, "up", "sub", "dashboard.json"), "")
+	writeFile(t, filepath.Join(fs.dir, "t", "x.data"), "")
+
+	if err := fs.makeDir(fs.localPath("/t/y.data")); err != errProtected {
+		t.Errorf("mkdir reserved: got %v", err)
+	}
+	if _, err := fs.move(fs.localPath("/up/x.data"), "/t/y.data"); err != errProtected {
+		t.Errorf("move to reserved: got %v", err)
+	}
+	if _, err := fs.move(fs.localPath("/up/sub"), "/t2"); err != errProtected {
+		t.Errorf("move tree with reserved: got %v", err)
+	}
+	if _, err := fs.move(fs.localPath("/up/x.data"), "/up/sub/x.txt"); err != nil {
+		t.Errorf("move to unreserved: got %v", err)
+	}
+	if err := fs.remove(fs.localPath("/t/x.data"), false); err != nil {
+		t.Errorf("remove reserved: got %v", err)
+	}
+}
+
+func TestRemoveExpired(t *testing.T) {
+	fs := newTestServer(t, WithPartialExpiry(time.Hour))
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	files := map[string]bool{ // file: removed
+		"a/.big.bin.upload":  true,
+		"a/.busy.bin.upload": false,
+		"a/.new.bin.upload":  false,
+		"a/.upload-123":      true,
+		"a/old.bin":          false,
+		".root.bin.upload":   true,
+	}
+	for name := range files {
+		file := filepath.Join(fs.dir, name)
+		writeFile(t, file, "x")
+		if name != "a/.new.bin.upload" {
+			if err := os.Chtimes(file, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	fs.busy[filepath.Join(fs.dir, "a/.busy.bin.upload")] = true
+
+	fs.removeExpired(now)
+	for name, removed := range files {
+		if _, err := os.Stat(filepath.Join(fs.dir, name)); os.IsNotExist(err) != removed {
+			t.Errorf("%s: removed %v, want %v", name, os.IsNotExist(err), removed)
+		}
+	}
+}
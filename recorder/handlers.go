@@ -24,15 +24,37 @@ func (msg *SessionRequest) Handle(stream as.ContextStream) (reply interface{}) {
 	if err != nil {
 		return err
 	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	index, err := os.OpenFile(path.Join(filepath, id+".idx"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		file.Close()
+		return err
+	}
 
 	go func() {
+		defer file.Close()
+		defer index.Close()
 		buffer := as.NewStreamIO(stream)
-		io.Copy(file, buffer)
+		io.Copy(newLineStamper(file, index, fi.Size()), buffer)
 	}()
 
 	return &SessionResponse{fmt.Sprintf("http://%v/%v/%v", hostAddr, msg.Tag, log)}
 }
 
+// Handle handles LogQuery.
+func (msg *LogQuery) Handle(stream as.ContextStream) (reply interface{}) {
+	lines, err := queryLines(dataDir, msg)
+	if err != nil {
+		return err
+	}
+	return &LogLines{lines}
+}
+
 var knownMsgs = []as.KnownMessage{
 	(*SessionRequest)(nil),
+	(*LogQuery)(nil),
 }
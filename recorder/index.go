@@ -0,0 +1,173 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxLogLines is the max number of lines replied to LogQuery.
+const maxLogLines = 1000
+
+// indexEntry is an entry of the index of the log: the lines from Offset in
+// the log till the offset of the next entry were received at Time, in unix
+// time in milliseconds. The index is a sequence of the entries in little
+// endian, in order of both Time and Offset.
+type indexEntry struct {
+	Time   int64
+	Offset int64
+}
+
+// indexEntrySize is the size of the indexEntry in the index.
+const indexEntrySize = 16
+
+// lineStamper writes the log as is, and an entry to the index for each write
+// containing the start of a line.
+type lineStamper struct {
+	log       io.Writer
+	index     io.Writer
+	offset    int64 // offset of the end of the log
+	lineStart bool
+}
+
+// newLineStamper returns the lineStamper appending to the log of size offset.
+func newLineStamper(log, index io.Writer, offset int64) *lineStamper {
+	return &lineStamper{log: log, index: index, offset: offset, lineStart: true}
+}
+
+func (ls *lineStamper) Write(p []byte) (int, error) {
+	n, err := ls.log.Write(p)
+	if err != nil || n == 0 {
+		return n, err
+	}
+
+	// the lines split across writes take the time of their first part
+	start := int64(-1)
+	if ls.lineStart {
+		start = ls.offset
+	} else if i := bytes.IndexByte(p, '\n'); i >= 0 && i+1 < len(p) {
+		start = ls.offset + int64(i) + 1
+	}
+	ls.offset += int64(n)
+	ls.lineStart = p[len(p)-1] == '\n'
+	if start < 0 {
+		return n, nil
+	}
+	entry := indexEntry{time.Now().UnixNano() / int64(time.Millisecond), start}
+	return n, binary.Write(ls.index, binary.LittleEndian, &entry)
+}
+
+// readEntry reads the ith entry of the index.
+func readEntry(index io.ReaderAt, i int) (indexEntry, error) {
+	var entry indexEntry
+	err := binary.Read(io.NewSectionReader(index, int64(i)*indexEntrySize, indexEntrySize), binary.LittleEndian, &entry)
+	return entry, err
+}
+
+// readLines returns at most max lines of the session received between from and to,
+// in unix time in milliseconds. The first line is found by binary search in the index.
+func readLines(logFile, indexFile, session string, from, to int64, max int) ([]LogLine, error) {
+	index, err := os.Open(indexFile)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+	fi, err := index.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	n := int(fi.Size() / indexEntrySize)
+	var searchErr error
+	first := sort.Search(n, func(i int) bool {
+		entry, err := readEntry(index, i)
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return entry.Time >= from
+	})
+	if searchErr != nil {
+		return nil, searchErr
+	}
+	if first == n {
+		return nil, nil
+	}
+
+	log, err := os.Open(logFile)
+	if err != nil {
+		return nil, err
+	}
+	defer log.Close()
+
+	entries := bufio.NewReader(io.NewSectionReader(index, int64(first)*indexEntrySize, int64(n-first)*indexEntrySize))
+	var cur, next indexEntry
+	if err := binary.Read(entries, binary.LittleEndian, &cur); err != nil {
+		return nil, err
+	}
+	hasNext := binary.Read(entries, binary.LittleEndian, &next) == nil
+	if _, err := log.Seek(cur.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var lines []LogLine
+	r := bufio.NewReader(log)
+	for offset := cur.Offset; len(lines) < max; {
+		for hasNext && next.Offset <= offset {
+			cur = next
+			hasNext = binary.Read(entries, binary.LittleEndian, &next) == nil
+		}
+		if cur.Time > to {
+			break
+		}
+		line, err := r.ReadString('\n')
+		if line != "" {
+			offset += int64(len(line))
+			lines = append(lines, LogLine{Time: cur.Time, Session: session, Text: strings.TrimSuffix(line, "\n")})
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lines, nil
+}
+
+// queryLines returns the lines of all the sessions of the tag in the time
+// range of the query, in time order.
+func queryLines(dir string, q *LogQuery) ([]LogLine, error) {
+	if q.Tag == "" || strings.ContainsAny(q.Tag, `/\`) || q.Tag == "." || q.Tag == ".." {
+		return nil, os.ErrNotExist
+	}
+	files, err := filepath.Glob(filepath.Join(dir, q.Tag, "*.idx"))
+	if err != nil {
+		return nil, err
+	}
+
+	max := q.Max
+	if max <= 0 || max > maxLogLines {
+		max = maxLogLines
+	}
+	var lines []LogLine
+	for _, file := range files {
+		session := strings.TrimSuffix(filepath.Base(file), ".idx")
+		l, err := readLines(strings.TrimSuffix(file, ".idx")+".log", file, session, q.From, q.To, max)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, l...)
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Time < lines[j].Time })
+	if len(lines) > max {
+		lines = lines[:max]
+	}
+	return lines, nil
+}
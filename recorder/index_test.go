@@ -0,0 +1,85 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLineStamper(t *testing.T) {
+	var log, index bytes.Buffer
+	ls := newLineStamper(&log, &index, 10)
+	for _, w := range []string{"a\nb", "c\n", "d\ne\n", "f"} {
+		ls.Write([]byte(w))
+	}
+	if log.String() != "a\nbc\nd\ne\nf" {
+		t.Errorf("log written as %q", log.String())
+	}
+	// "c\n" continues the line of b
+	var offsets []int64
+	for index.Len() != 0 {
+		var entry indexEntry
+		binary.Read(&index, binary.LittleEndian, &entry)
+		offsets = append(offsets, entry.Offset)
+	}
+	if want := []int64{10, 15, 19}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("got offsets %v, want %v", offsets, want)
+	}
+}
+
+func writeLog(t *testing.T, dir, session, log string, entries ...indexEntry) {
+	if err := ioutil.WriteFile(filepath.Join(dir, session+".log"), []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var index bytes.Buffer
+	for _, entry := range entries {
+		binary.Write(&index, binary.LittleEndian, &entry)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, session+".idx"), index.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryLines(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "board1"), 0777)
+	writeLog(t, filepath.Join(dir, "board1"), "s1", "a1\na2\na3\na4\na5",
+		indexEntry{1000, 0}, indexEntry{2000, 6}, indexEntry{3000, 12})
+	writeLog(t, filepath.Join(dir, "board1"), "s2", "b1\nb2\n",
+		indexEntry{1500, 0}, indexEntry{2500, 3})
+
+	texts := func(q *LogQuery) []string {
+		lines, err := queryLines(dir, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var texts []string
+		for _, l := range lines {
+			texts = append(texts, l.Session+":"+l.Text)
+		}
+		return texts
+	}
+	cases := []struct {
+		q    LogQuery
+		want []string
+	}{
+		{LogQuery{Tag: "board1", From: 0, To: 5000}, []string{"s1:a1", "s1:a2", "s2:b1", "s1:a3", "s1:a4", "s2:b2", "s1:a5"}},
+		{LogQuery{Tag: "board1", From: 1001, To: 2500}, []string{"s2:b1", "s1:a3", "s1:a4", "s2:b2"}},
+		{LogQuery{Tag: "board1", From: 2000, To: 2000}, []string{"s1:a3", "s1:a4"}},
+		{LogQuery{Tag: "board1", From: 0, To: 5000, Max: 3}, []string{"s1:a1", "s1:a2", "s2:b1"}},
+		{LogQuery{Tag: "board1", From: 3001, To: 5000}, nil},
+		{LogQuery{Tag: "board2", From: 0, To: 5000}, nil},
+	}
+	for _, c := range cases {
+		if got := texts(&c.q); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%+v: got %v, want %v", c.q, got, c.want)
+		}
+	}
+	if _, err := queryLines(dir, &LogQuery{Tag: ".."}); err == nil {
+		t.Error("invalid tag accepted")
+	}
+}
@@ -8,7 +8,9 @@ import (
 
 // SessionRequest is the message sent by client.
 // Return SessionResponse.
-// Client should send one or more Record after SessionResponse is received.
+// Client should send the log after SessionResponse is received, the server
+// saves it as is in <session>.log and the times the lines were received with
+// their offsets in <session>.log in <session>.idx.
 type SessionRequest struct {
 	Tag string
 }
@@ -18,7 +20,32 @@ type SessionResponse struct {
 	RecorderURL string
 }
 
+// LogQuery is the message to get the lines recorded by the sessions of Tag
+// between From and To, in unix time in milliseconds the server received them.
+// Return LogLines with at most Max lines in time order, 1000 if Max is 0.
+// Sessions recorded before the lines were timestamped are not included.
+type LogQuery struct {
+	Tag  string
+	From int64
+	To   int64
+	Max  int
+}
+
+// LogLine is a recorded line.
+type LogLine struct {
+	Time    int64 // unix time in milliseconds the line was received
+	Session string
+	Text    string
+}
+
+// LogLines is the message replied to LogQuery.
+type LogLines struct {
+	Lines []LogLine
+}
+
 func init() {
 	as.RegisterType((*SessionRequest)(nil))
 	as.RegisterType((*SessionResponse)(nil))
+	as.RegisterType((*LogQuery)(nil))
+	as.RegisterType((*LogLines)(nil))
 }
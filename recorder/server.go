@@ -22,8 +22,8 @@ var (
 	dataDir  string
 )
 
-// NewServer creates a new server instance.
-func NewServer(lg *log.Logger, port, dir, title string) *Server {
+// NewServer creates a new server instance, the options are of the file server of dir.
+func NewServer(lg *log.Logger, port, dir, title string, options ...fileserver.Option) *Server {
 	ip := "0.0.0.0"
 	c := as.NewClient(as.WithScope(as.ScopeWAN)).SetDiscoverTimeout(0)
 	conn := <-c.Discover("builtin", "IPObserver")
@@ -36,7 +36,7 @@ func NewServer(lg *log.Logger, port, dir, title string) *Server {
 		conn.Close()
 	}
 
-	fs := fileserver.NewFileServer(lg, port, dir, title)
+	fs := fileserver.NewFileServer(lg, port, dir, title, options...)
 	if fs == nil {
 		lg.Errorln("create file server failed")
 		return nil
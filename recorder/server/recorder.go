@@ -8,6 +8,7 @@ import (
 
 	as "github.com/godevsig/adaptiveservice"
 	"github.com/godevsig/glib/sys/log"
+	"github.com/godevsig/grepo/fileserver"
 	"github.com/godevsig/grepo/recorder"
 )
 
@@ -22,6 +23,7 @@ func Start(args []string) (err error) {
 	port := flags.String("port", "0", "set server port, default 0 means alloced by net Listener")
 	dir := flags.String("dir", "log", "set directory for saving recorder log data")
 	title := flags.String("title", "RECORDER DATA", "set HTML title of file server")
+	fsOptions := fileserver.AddFlags(flags)
 
 	if err := flags.Parse(args); err != nil {
 		if err == flag.ErrHelp {
@@ -29,6 +31,10 @@ func Start(args []string) (err error) {
 		}
 		return err
 	}
+	options, err := fsOptions()
+	if err != nil {
+		return err
+	}
 
 	stream := log.NewStream("")
 	stream.SetOutputter(os.Stdout)
@@ -43,7 +49,7 @@ func Start(args []string) (err error) {
 	}
 
 	fmt.Println("recorder server starting...")
-	server = recorder.NewServer(lg, *port, *dir, *title)
+	server = recorder.NewServer(lg, *port, *dir, *title, options...)
 	if server == nil {
 		return errors.New("create recorder server failed")
 	}
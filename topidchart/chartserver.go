@@ -5,10 +5,10 @@ import (
 	"encoding/gob"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
 	"strconv"
@@ -37,12 +37,21 @@ type list []pair
 
 type processRecords struct {
 	time   []string
+	stamps []int64
+	focus  int // index of the time to focus on, -1 if none
 	cpu    map[string]([]float32)
 	mem    map[string]([]float32)
 	cpuavg map[string]float32
 	memavg map[string]float32
 	cpumax map[string]float32
 	memmax map[string]float32
+	panels map[string]map[string][]float32 // extended metric panel name to series
+	// processes with per thread statistics
+	threaded map[string]bool
+	// short IDs of the containers of the processes
+	containers map[string]bool
+	cpuUnit    string
+	memUnit    string
 }
 
 var (
@@ -66,6 +75,10 @@ type filter struct {
 	cpumax float32
 	memavg float32
 	memmax float32
+	top    int // show only the top N series, 0 means no limit
+	// show only the processes in the container, see matchContainer
+	container string
+	group     string // see groupName
 }
 
 type chartServer struct {
@@ -77,16 +90,23 @@ type chartServer struct {
 	filter    *filter
 	lg        *log.Logger
 	srv       *http.Server
+	logs      logQuerier
 }
 
 func newRecords() *processRecords {
 	return &processRecords{
-		cpu:    make(map[string]([]float32)),
-		mem:    make(map[string]([]float32)),
-		cpuavg: make(map[string]float32),
-		memavg: make(map[string]float32),
-		cpumax: make(map[string]float32),
-		memmax: make(map[string]float32),
+		focus:      -1,
+		cpu:        make(map[string]([]float32)),
+		mem:        make(map[string]([]float32)),
+		cpuavg:     make(map[string]float32),
+		memavg:     make(map[string]float32),
+		cpumax:     make(map[string]float32),
+		memmax:     make(map[string]float32),
+		panels:     make(map[string]map[string][]float32),
+		threaded:   make(map[string]bool),
+		containers: make(map[string]bool),
+		cpuUnit:    "Percent",
+		memUnit:    "MB",
 	}
 }
 
@@ -128,33 +148,58 @@ func rank(avg map[string]float32) list {
 	return l
 }
 
-//ParseFile parse encode record file
-func ParseFile(filename string) error {
-	in, err := os.Open(filename)
-	if err != nil {
-		return err
+// seriesName returns the chart series name of the process,
+// kernel threads are shown by name only.
+func seriesName(p ProcessInfoV2) string {
+	if strings.Contains(p.Name, "[") {
+		return p.Name
 	}
-	defer in.Close()
+	return fmt.Sprintf("%v-%v", p.Name, p.Pid)
+}
+
+// The groupings of the processes in the charts.
+const (
+	groupByName      = "name"
+	groupByContainer = "container"
+)
+
+// groupName returns the series name of the process in the grouping,
+// the processes in the same series are summed. The empty grouping is per process.
+func groupName(p ProcessInfoV2, group string) string {
+	switch group {
+	case groupByName:
+		return p.Name
+	case groupByContainer:
+		if name := containerName(&p); name != "" {
+			return name
+		}
+		return hostContainer
+	}
+	return seriesName(p)
+}
 
-	out, err := os.Create(filename + ".parsed")
+// walkRecords decodes the process records in filename one by one,
+// stops when f returns false.
+func walkRecords(filename string, f func(r *pRecord) bool) error {
+	in, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
+	defer in.Close()
 
 	decoder := gob.NewDecoder(in)
-	for err != io.EOF {
+	for {
 		var buf = pRecord{}
-		err = decoder.Decode(&buf)
-		if err != nil {
-			continue
+		if err := decoder.Decode(&buf); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
 		}
-		if len(buf.Processes) != 0 {
-			line := fmt.Sprintf("======%v, processinfo %v\n", time.Unix(buf.Timestamp, 0).Format("15:04:05"), buf.Processes)
-			out.WriteString(line)
+		if !f(&buf) {
+			return nil
 		}
 	}
-	return nil
 }
 
 func (prs *processRecords) sortMap(mode string, m map[string]([]float32), f func(k string, v []float32)) {
@@ -179,33 +224,84 @@ func (prs *processRecords) analysis(filename string, filter *filter) error {
 	defer f.Close()
 
 	decoder := gob.NewDecoder(f)
-	for err != io.EOF {
+	for {
 		var buf = pRecord{}
-		err = decoder.Decode(&buf)
-		if err != nil {
-			continue
+		// the records after a corrupt or truncated one can not be decoded
+		// by the same decoder, see Parse
+		if err := decoder.Decode(&buf); err != nil {
+			break
 		}
+		prs.add(&buf, filter.container, filter.group)
+	}
 
-		if len(buf.Processes) != 0 {
-			prs.time = append(prs.time, time.Unix(buf.Timestamp, 0).Format("15:04:05"))
-			for _, b := range buf.Processes {
-				var name string
-				if strings.Contains(b.Name, "[") {
-					name = b.Name
-				} else {
-					name = fmt.Sprintf("%v-%v", b.Name, b.Pid)
-				}
-				if _, ok := prs.cpu[name]; !ok {
-					reserved := make([]float32, len(prs.time)-1)
-					prs.cpu[name] = append(prs.cpu[name], reserved...)
-					prs.mem[name] = append(prs.mem[name], reserved...)
-				}
-				prs.cpu[name] = append(prs.cpu[name], floatConv(b.Ucpu+b.Scpu))
-				prs.mem[name] = append(prs.mem[name], float32(b.Mem/1024))
-			}
+	prs.applyFilter(filter)
+	prs.trimMetrics()
+
+	return nil
+}
+
+// add appends the processes in the container of the record to the series of the grouping.
+func (prs *processRecords) add(buf *pRecord, container, group string) {
+	for i := range buf.Processes {
+		if name := containerName(&buf.Processes[i]); name != "" {
+			prs.containers[name] = true
+		}
+	}
+	filterContainer(buf, container)
+
+	if len(buf.Processes) == 0 && buf.Sys == nil {
+		return
+	}
+	var dt float32
+	if n := len(prs.stamps); n != 0 {
+		dt = float32(buf.Timestamp - prs.stamps[n-1])
+	}
+	prs.time = append(prs.time, time.Unix(buf.Timestamp, 0).Format("15:04:05"))
+	prs.stamps = append(prs.stamps, buf.Timestamp)
+	prs.addMetrics(buf, len(prs.time), dt)
+	if group != "" {
+		prs.addGroups(buf, group)
+		return
+	}
+	for _, b := range buf.Processes {
+		name := seriesName(b)
+		if len(b.Threads) != 0 {
+			prs.threaded[name] = true
+		}
+		if _, ok := prs.cpu[name]; !ok {
+			reserved := make([]float32, len(prs.time)-1)
+			prs.cpu[name] = append(prs.cpu[name], reserved...)
+			prs.mem[name] = append(prs.mem[name], reserved...)
+		}
+		prs.cpu[name] = append(prs.cpu[name], floatConv(b.Ucpu+b.Scpu))
+		prs.mem[name] = append(prs.mem[name], float32(b.Mem/1024))
+	}
+}
+
+// addGroups appends the sums of the processes in each group of the record,
+// the thread drill-down is per process so it is not available in groups.
+func (prs *processRecords) addGroups(buf *pRecord, group string) {
+	cpu := make(map[string]float32)
+	mem := make(map[string]float32)
+	for _, b := range buf.Processes {
+		name := groupName(b, group)
+		cpu[name] += b.Ucpu + b.Scpu
+		mem[name] += float32(b.Mem / 1024)
+	}
+	for name := range cpu {
+		if _, ok := prs.cpu[name]; !ok {
+			reserved := make([]float32, len(prs.time)-1)
+			prs.cpu[name] = append(prs.cpu[name], reserved...)
+			prs.mem[name] = append(prs.mem[name], reserved...)
 		}
+		prs.cpu[name] = append(prs.cpu[name], floatConv(cpu[name]))
+		prs.mem[name] = append(prs.mem[name], mem[name])
 	}
+}
 
+// applyFilter pads the cpu and mem series to full length, then removes the
+// series below the thresholds or out of the top N of the filter.
+func (prs *processRecords) applyFilter(filter *filter) {
 	for k, v := range prs.cpu {
 		if len(v) < len(prs.time) {
 			prs.cpu[k] = append(prs.cpu[k], make([]float32, len(prs.time)-len(v))...)
@@ -230,7 +326,49 @@ func (prs *processRecords) analysis(filename string, filter *filter) error {
 		}
 	}
 
-	return nil
+	if filter.top > 0 {
+		for i, p := range rank(prs.cpuavg) {
+			if i >= filter.top {
+				delete(prs.cpu, p.key)
+				delete(prs.cpuavg, p.key)
+				delete(prs.cpumax, p.key)
+			}
+		}
+		for i, p := range rank(prs.memavg) {
+			if i >= filter.top {
+				delete(prs.mem, p.key)
+				delete(prs.memavg, p.key)
+				delete(prs.memmax, p.key)
+			}
+		}
+	}
+}
+
+// focusOn sets the focus to the last record at or before ts.
+func (prs *processRecords) focusOn(ts int64) {
+	for i, stamp := range prs.stamps {
+		if stamp > ts {
+			break
+		}
+		prs.focus = i
+	}
+}
+
+// focusJS returns the js to zoom the line chart into the focused time and mark it.
+func (prs *processRecords) focusJS(chartID string) string {
+	if prs.focus < 0 {
+		return ""
+	}
+	start := prs.focus - 30
+	if start < 0 {
+		start = 0
+	}
+	return fmt.Sprintf(`if(option_%[1]s.series.length > 0){
+						option_%[1]s.series[0].markLine = {symbol:"none", data:[{xAxis:%[2]d}]};
+						goecharts_%[1]s.setOption(option_%[1]s);
+					}
+					goecharts_%[1]s.dispatchAction({type:"dataZoom", startValue:%[3]d, endValue:%[4]d});`,
+		chartID, prs.focus, start, prs.focus+30)
 }
 
 func (prs *processRecords) lineCPU() *charts.Line {
@@ -241,7 +379,7 @@ func (prs *processRecords) lineCPU() *charts.Line {
 			Left:  "560",
 		}),
 		charts.WithYAxisOpts(opts.YAxis{
-			Name: "Percent",
+			Name: prs.cpuUnit,
 		}),
 		charts.WithTooltipOpts(opts.Tooltip{
 			Show:    true,
@@ -293,6 +431,20 @@ func (prs *processRecords) lineCPU() *charts.Line {
 						}
 						location.href=url+"/pie";
 					};
+					document.getElementById("treeview").onclick=function(){
+						var url = location.href;
+						if (url.indexOf("?") != -1) {
+							url = url.replace(/(\?|#)[^'"]*/, '');
+						}
+						location.href=url+"/tree";
+					};
+					document.getElementById("logs").onclick=function(){
+						var url = location.href;
+						if (url.indexOf("?") != -1) {
+							url = url.replace(/(\?|#)[^'"]*/, '');
+						}
+						location.href=url+"/logs";
+					};
 					document.getElementById("cpuselectall").onclick=function(){
 						var flag=this.getAttribute("flag");
 						var val=false;
@@ -335,7 +487,7 @@ func (prs *processRecords) lineCPU() *charts.Line {
 						option_%s.legend.selected = obj;
 						goecharts_%s.setOption(option_%s);
 					};`, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID)
-	line.AddJSFuncs(fn)
+	line.AddJSFuncs(fn, prs.focusJS(line.ChartID))
 
 	line = line.SetXAxis(prs.time)
 	prs.sortMap("cpu", prs.cpu, func(k string, v []float32) {
@@ -369,7 +521,7 @@ func (prs *processRecords) lineMEM() *charts.Line {
 			Left:  "560",
 		}),
 		charts.WithYAxisOpts(opts.YAxis{
-			Name: "MB",
+			Name: prs.memUnit,
 		}),
 		charts.WithTooltipOpts(opts.Tooltip{
 			Show:    true,
@@ -441,7 +593,7 @@ func (prs *processRecords) lineMEM() *charts.Line {
 						option_%s.legend.selected = obj;
 						goecharts_%s.setOption(option_%s);
 					};`, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID, line.ChartID)
-	line.AddJSFuncs(fn)
+	line.AddJSFuncs(fn, prs.focusJS(line.ChartID))
 
 	line = line.SetXAxis(prs.time)
 	prs.sortMap("mem", prs.mem, func(k string, v []float32) {
@@ -467,6 +619,31 @@ func (prs *processRecords) lineMEM() *charts.Line {
 	return line
 }
 
+// parseFilter returns the filter set by the filter, top, container and group parameters,
+// the defaults of the dashboard of the tag are used if not set.
+func (cs *chartServer) parseFilter(tag string, vars url.Values) *filter {
+	f := cs.loadDashboard(tag).filter(cs.filter)
+	if filterVar, ok := vars["filter"]; ok {
+		filterVar = strings.Split(filterVar[0], ",")
+		if len(filterVar) == 4 {
+			f.cpuavg = string2float32(filterVar[0])
+			f.cpumax = string2float32(filterVar[1])
+			f.memavg = string2float32(filterVar[2])
+			f.memmax = string2float32(filterVar[3])
+		}
+	}
+	if top, err := strconv.Atoi(vars.Get("top")); err == nil && top > 0 {
+		f.top = top
+	}
+	if v, ok := vars["container"]; ok {
+		f.container = v[0]
+	}
+	if v, ok := vars["group"]; ok {
+		f.group = v[0]
+	}
+	return &f
+}
+
 func (cs *chartServer) lineHandler(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	tag := params["tag"]
@@ -478,20 +655,7 @@ func (cs *chartServer) lineHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	vars := r.URL.Query()
-	if filterVar, ok := vars["filter"]; ok {
-		filterVar = strings.Split(filterVar[0], ",")
-		if len(filterVar) == 4 {
-			cs.filter.cpuavg = string2float32(filterVar[0])
-			cs.filter.cpumax = string2float32(filterVar[1])
-			cs.filter.memavg = string2float32(filterVar[2])
-			cs.filter.memmax = string2float32(filterVar[3])
-		}
-	} else {
-		cs.filter.cpuavg = cpuavgThreshold
-		cs.filter.cpumax = cpumaxThreshold
-		cs.filter.memavg = memavgThreshold
-		cs.filter.memmax = memmaxThreshold
-	}
+	filter := cs.parseFilter(tag, vars)
 
 	if tag != "" && (strings.Index(session, ".") != -1) {
 		file, err := os.Open(cs.dir + tag + "/" + session)
@@ -507,18 +671,68 @@ func (cs *chartServer) lineHandler(w http.ResponseWriter, r *http.Request) {
 	in := fmt.Sprintf("%v/%v/%v.data", cs.dir, tag, session)
 
 	records := newRecords()
-	if err := records.analysis(in, cs.filter); err != nil {
+	if err := records.analysis(in, filter); err != nil {
 		cs.lg.Errorln(err)
 		return
 	}
+	if at := vars.Get("at"); at != "" {
+		ts, _ := strconv.ParseInt(at, 10, 64)
+		records.focusOn(ts)
+	}
+
+	dash := cs.loadDashboard(tag)
+	meta, _ := loadMeta(cs.dir, tag, params["session"])
+	if _, ok := vars["norm"]; !ok {
+		vars.Set("norm", dash.Norm)
+	}
+	norm := parseNorm(vars)
+	records.normalize(meta, norm)
+
+	selected := records.parsePanels(vars)
+	var cpu *charts.Line
+	var lines []*charts.Line
+	var htmls []htmlPanel
+	for _, p := range dash.Panels {
+		switch p.Panel {
+		case panelCPU:
+			cpu = resize(records.lineCPU(), p)
+			lines = append(lines, cpu)
+		case panelMEM:
+			lines = append(lines, resize(records.lineMEM(), p))
+		case panelMetrics:
+			for _, line := range records.panelCharts(selected) {
+				lines = append(lines, resize(line, p))
+			}
+		case panelSummary:
+			htmls = append(htmls, htmlPanel{records.summaryHTML(), p, len(lines)})
+		case panelAnnotations:
+			htmls = append(htmls, htmlPanel{cs.annotationsHTML(tag, params["session"], meta), p, len(lines)})
+		default:
+			if mp := findMetricPanel(p.Panel); len(records.panels[mp.name]) != 0 {
+				lines = append(lines, resize(records.linePanel(mp), p))
+			}
+		}
+	}
+	// the controls and the panels not charts are added by the js of the charts
+	if len(lines) == 0 {
+		cpu = records.lineCPU()
+		lines = append(lines, cpu)
+	}
+	jsFuncs := []string{records.panelsJS(selected), records.containersJS(filter.container), groupJS(filter.group), normJS(meta, norm)}
+	if cpu != nil && filter.group == "" {
+		jsFuncs = append(jsFuncs, records.threadsJS(cpu.ChartID))
+	}
+	lines[0].AddJSFuncs(jsFuncs...)
+	if len(htmls) != 0 {
+		lines[len(lines)-1].AddJSFuncs(htmlPanelsJS(htmls, lines))
+	}
 
 	cs.updatePageTpl()
 	page := components.NewPage()
 	page.PageTitle = "Performance Analysis Tool"
-	page.AddCharts(
-		records.lineCPU(),
-		records.lineMEM(),
-	)
+	for _, line := range lines {
+		page.AddCharts(line)
+	}
 
 	page.SetLayout(components.PageFlexLayout)
 	page.Render(w)
@@ -554,6 +768,12 @@ func (prs *processRecords) pieCPU() *charts.Pie {
 						btn.onclick=function(){
 							location.href=location.href.replace("/pie","");
 						};
+						document.getElementById("treeview").onclick=function(){
+							location.href=location.href.replace("/pie","/tree");
+						};
+						document.getElementById("logs").onclick=function(){
+							location.href=location.href.replace("/pie","/logs");
+						};
 						document.getElementById("cpuselectall").onclick=function(){
 							var flag=this.getAttribute("flag");
 							var val=false;
@@ -642,20 +862,7 @@ func (cs *chartServer) pieHandler(w http.ResponseWriter, r *http.Request) {
 	session := "process-" + params["session"]
 
 	vars := r.URL.Query()
-	if filterVar, ok := vars["filter"]; ok {
-		filterVar = strings.Split(filterVar[0], ",")
-		if len(filterVar) == 4 {
-			cs.filter.cpuavg = string2float32(filterVar[0])
-			cs.filter.cpumax = string2float32(filterVar[1])
-			cs.filter.memavg = string2float32(filterVar[2])
-			cs.filter.memmax = string2float32(filterVar[3])
-		}
-	} else {
-		cs.filter.cpuavg = cpuavgThreshold
-		cs.filter.cpumax = cpumaxThreshold
-		cs.filter.memavg = memavgThreshold
-		cs.filter.memmax = memmaxThreshold
-	}
+	filter := cs.parseFilter(tag, vars)
 
 	if tag != "" && (strings.Index(session, ".") != -1) {
 		file, err := os.Open(cs.dir + tag + "/" + session)
@@ -671,7 +878,7 @@ func (cs *chartServer) pieHandler(w http.ResponseWriter, r *http.Request) {
 	in := fmt.Sprintf("%v/%v/%v.data", cs.dir, tag, session)
 
 	records := newRecords()
-	if err := records.analysis(in, cs.filter); err != nil {
+	if err := records.analysis(in, filter); err != nil {
 		cs.lg.Errorln(err)
 		return
 	}
@@ -691,53 +898,6 @@ func (cs *chartServer) readmeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(cs.readme))
 }
 
-func (cs *chartServer) infoHandler(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	tag := params["tag"]
-	session := "info-" + params["session"]
-
-	in := fmt.Sprintf("%v/%v/%v.data", cs.dir, tag, session)
-	f, err := os.Open(in)
-	if err != nil {
-		http.Error(w, "File not found.", 404)
-		return
-	}
-	defer f.Close()
-
-	info, _ := ioutil.ReadAll(f)
-	w.Write([]byte(info))
-}
-
-func (cs *chartServer) snapshotHandler(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	tag := params["tag"]
-	session := "snapshot-" + params["session"]
-
-	in := fmt.Sprintf("%v/%v/%v.data", cs.dir, tag, session)
-	f, err := os.Open(in)
-	if err != nil {
-		http.Error(w, "File not found.", 404)
-		return
-	}
-	defer f.Close()
-
-	decoder := gob.NewDecoder(f)
-	var data string
-	for err != io.EOF {
-		var buf = sRecord{}
-		err = decoder.Decode(&buf)
-		if err != nil {
-			continue
-		}
-		if len(buf.Snapshot) != 0 {
-			line := fmt.Sprintf("======%v, snapshot======\n%v\n", time.Unix(buf.Timestamp, 0).Format("15:04:05"), buf.Snapshot)
-			data = data + line
-		}
-	}
-
-	w.Write([]byte(data))
-}
-
 func (cs *chartServer) updatePageTpl() {
 	templates.BaseTpl = `
 				{{- define "base" }}
@@ -769,10 +929,14 @@ func (cs *chartServer) updatePageTpl() {
 				<style> .btn { justify-content:space-around; padding-left:50px; float:left; width:150px } </style>
 				<div class="btn">
 					<a href="http://%s:%s/readme"><input type="button" style="width:100px;height:30px;border:5px #E67E22 double;margin-top:10px" value="README"/></a>
-					<a href="http://%s:%s"><input type="button" style="width:100px;height:30px;border:5px #E67E22 double;margin-top:10px" value="HISTORY"/></a>
+					<a href="http://%s:%s/history"><input type="button" style="width:100px;height:30px;border:5px #E67E22 double;margin-top:10px" value="HISTORY"/></a>
 					<input id="info" type="button" style="width:100px;height:30px;border:5px #2980B9 double;margin-top:10px"value="INFO"/>
 					<input id="snapshot" type="button" style="width:100px;height:30px;border:5px #2980B9 double;margin-top:10px"value="SNAPSHOT"/>
 					<input id="pieview" type="button" style="width:100px;height:30px;border:5px #2980B9 double;margin-top:10px"value="PIEVIEW"/>
+					<input id="treeview" type="button" style="width:100px;height:30px;border:5px #2980B9 double;margin-top:10px"value="TREE"/>
+					<input id="logs" type="button" style="width:100px;height:30px;border:5px #2980B9 double;margin-top:10px"value="LOGS"/>
+					<input id="cpunorm" type="button" style="width:100px;height:30px;border:5px #27AE60 double;margin-top:10px"value="CPU%%MACH"/>
+					<input id="memnorm" type="button" style="width:100px;height:30px;border:5px #8E44AD double;margin-top:10px"value="MEM%%RAM"/>
 					<input id="cpuselectall" type="button" style="width:100px;height:30px;border:5px #27AE60 double;margin-top:10px"value="CPUOFF" flag="1"/>
 					<input id="syscpu" type="button" style="width:100px;height:30px;border:5px #27AE60 double;margin-top:10px"value="CPUSYS" flag="1"/>
 					<input id="memselectall" type="button" style="width:100px;height:30px;border:5px #8E44AD double;margin-top:10px"value="MEMOFF" flag="1"/>
@@ -783,7 +947,7 @@ func (cs *chartServer) updatePageTpl() {
 				</body>
 				</html>
 				{{ end }}
-				`, echarts, themes, cs.ip, cs.chartport, cs.ip, cs.fileport)
+				`, echarts, themes, cs.ip, cs.chartport, cs.ip, cs.chartport)
 }
 
 func newChartServer(lg *log.Logger, ip, chartport, fileport, dir string) *chartServer {
@@ -808,19 +972,39 @@ func newChartServer(lg *log.Logger, ip, chartport, fileport, dir string) *chartS
 		conn.Close()
 	}
 
+	cs.srv = &http.Server{
+		Addr:    ":" + cs.chartport,
+		Handler: cs.router(),
+	}
+
+	return cs
+}
+
+func (cs *chartServer) router() *mux.Router {
 	router := mux.NewRouter().StrictSlash(false)
 	router.HandleFunc("/readme", cs.readmeHandler)
+	router.HandleFunc("/history", cs.historyHandler)
+	router.HandleFunc("/metrics", cs.metricsHandler)
+	router.HandleFunc("/ingest", cs.ingestSessionHandler).Methods("POST")
+	router.HandleFunc("/ingest/{token}", cs.ingestRecordsHandler).Methods("POST")
+	router.HandleFunc("/ingest/{token}", cs.ingestCloseHandler).Methods("DELETE")
+	router.HandleFunc("/run/{run}", cs.runHandler)
+	grafana := router.PathPrefix("/grafana/{tag}/{session}").Subrouter()
+	grafana.Use(grafanaCORS)
+	grafana.HandleFunc("/", cs.grafanaTestHandler)
+	grafana.HandleFunc("/search", cs.grafanaSearchHandler).Methods("POST", "OPTIONS")
+	grafana.HandleFunc("/query", cs.grafanaQueryHandler).Methods("POST", "OPTIONS")
+	grafana.HandleFunc("/annotations", cs.grafanaAnnotationsHandler).Methods("POST", "OPTIONS")
 	router.HandleFunc("/{tag}/{session}", cs.lineHandler)
 	router.HandleFunc("/{tag}/{session}/info", cs.infoHandler)
 	router.HandleFunc("/{tag}/{session}/pie", cs.pieHandler)
 	router.HandleFunc("/{tag}/{session}/snapshot", cs.snapshotHandler)
-
-	cs.srv = &http.Server{
-		Addr:    ":" + cs.chartport,
-		Handler: router,
-	}
-
-	return cs
+	router.HandleFunc("/{tag}/{session}/snapshot/diff", cs.snapshotDiffHandler)
+	router.HandleFunc("/{tag}/{session}/tree", cs.treeHandler)
+	router.HandleFunc("/{tag}/{session}/threads", cs.threadsHandler)
+	router.HandleFunc("/{tag}/{session}/logs", cs.logsHandler)
+	router.HandleFunc("/{tag}/{session}/logs/lines", cs.logLinesHandler)
+	return router
 }
 
 func (cs *chartServer) start() {
@@ -836,5 +1020,6 @@ func (cs *chartServer) stop() {
 	if err := cs.srv.Shutdown(context.Background()); err != nil {
 		cs.lg.Errorf("chart http server shutdown: %v", err)
 	}
+	cs.logs.close()
 	cs.lg.Infoln("chart http server shutdown successfully")
 }
@@ -5,9 +5,11 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	as "github.com/godevsig/adaptiveservice"
 	"github.com/godevsig/glib/sys/log"
+	"github.com/godevsig/grepo/fileserver"
 	topid "github.com/godevsig/grepo/topidchart"
 )
 
@@ -21,7 +23,26 @@ func Start(args []string) (err error) {
 	logLevel := flags.String("logLevel", "info", "debug/info/warn/error")
 	dir := flags.String("dir", "topidata", "set directory for saving topid raw data")
 	port := flags.String("port", "9998", "set port for visiting chart http server")
-	parsefile := flags.String("parse", "", "parse file")
+	parsefile := flags.String("parse", "", "parse the data files or the data files in the directories, separated by comma, more can follow the flags")
+	output := flags.String("output", topid.OutputText, "set the output format of -parse: text, jsonl or csv")
+	outfile := flags.String("outfile", "", "write the output of -parse to the file instead of stdout")
+	importfile := flags.String("import", "", "import top/pidstat/csv output file as a session into the data directory")
+	format := flags.String("format", "", "format of the import file: top, pidstat or csv, detected from the content if not set")
+	tag := flags.String("tag", "imported", "tag of the imported session")
+	resume := flags.Duration("resume", topid.DefaultResumeWindow, "set the time a session can be resumed after its stream breaks, 0 to disable")
+	flush := flags.Duration("flush", topid.DefaultFlushInterval, "set the interval the received records are written into the data files")
+	fsync := flags.String("fsync", "interval", "set when the data files are synced to disk: none, interval or always")
+	digest := flags.String("digest", "none", "generate digests of the tags into the data directory: none, daily or weekly")
+	digestTop := flags.Int("digestTop", topid.DefaultDigestTop, "set the number of the top consumers in the digests")
+	alertCPU := flags.Float64("alertCPU", 0, "alert in the digests when a process uses more CPU in percent of one core, 0 to disable")
+	alertMEM := flags.Float64("alertMEM", 0, "alert in the digests when a process uses more MEM in MB, 0 to disable")
+	webhook := flags.String("webhook", "", "post the JSON digests to the URL")
+	smtpAddr := flags.String("smtp", "", "send the digests by mail through the SMTP server host:port")
+	smtpFrom := flags.String("smtpFrom", "topidchart@localhost", "set the sender of the digest mails")
+	smtpTo := flags.String("smtpTo", "", "set the recipients of the digest mails, separated by comma")
+	smtpUser := flags.String("smtpUser", "", "set the user of the SMTP PLAIN auth")
+	smtpPass := flags.String("smtpPass", "", "set the password of the SMTP PLAIN auth")
+	fsOptions := fileserver.AddFlags(flags)
 
 	if err := flags.Parse(args); err != nil {
 		if err == flag.ErrHelp {
@@ -31,7 +52,45 @@ func Start(args []string) (err error) {
 	}
 
 	if len(*parsefile) != 0 {
-		return topid.ParseFile(*parsefile)
+		return parse(append(strings.Split(*parsefile, ","), flags.Args()...), *output, *outfile)
+	}
+
+	if len(*importfile) != 0 {
+		id, err := topid.ImportFile(*dir, *importfile, *format, *tag)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s imported as session %s/%s\n", *importfile, *tag, id)
+		return nil
+	}
+
+	policy, err := topid.ParseSyncPolicy(*fsync)
+	if err != nil {
+		return err
+	}
+	period, err := topid.ParseDigestPeriod(*digest)
+	if err != nil {
+		return err
+	}
+	digestCfg := topid.DigestConfig{
+		Period:   period,
+		Top:      *digestTop,
+		AlertCPU: float32(*alertCPU),
+		AlertMEM: float32(*alertMEM),
+		Webhook:  *webhook,
+		SMTP: topid.SMTPConfig{
+			Addr:     *smtpAddr,
+			From:     *smtpFrom,
+			Username: *smtpUser,
+			Password: *smtpPass,
+		},
+	}
+	if *smtpTo != "" {
+		digestCfg.SMTP.To = strings.Split(*smtpTo, ",")
+	}
+	options, err := fsOptions()
+	if err != nil {
+		return err
 	}
 
 	stream := log.NewStream("")
@@ -47,7 +106,9 @@ func Start(args []string) (err error) {
 	}
 
 	fmt.Println("topid chart server starting...")
-	server = topid.NewServer(lg, *port, *dir)
+	server = topid.NewServer(lg, *port, *dir, topid.WithResumeWindow(*resume),
+		topid.WithFlushInterval(*flush), topid.WithSyncPolicy(policy), topid.WithDigest(digestCfg),
+		topid.WithFileServer(options...))
 	if server == nil {
 		return errors.New("create topid chart server failed")
 	}
@@ -55,6 +116,32 @@ func Start(args []string) (err error) {
 	return server.Run()
 }
 
+// parse parses the data files, the corrupt regions are reported to stderr
+// and fail the parsing after all the files are parsed.
+func parse(paths []string, format, outfile string) error {
+	out := os.Stdout
+	if outfile != "" {
+		f, err := os.Create(outfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	corrupt, err := topid.Parse(out, paths, format)
+	for _, c := range corrupt {
+		fmt.Fprintln(os.Stderr, c)
+	}
+	if err != nil {
+		return err
+	}
+	if len(corrupt) != 0 {
+		return fmt.Errorf("%d corrupt region(s) found", len(corrupt))
+	}
+	return nil
+}
+
 // Stop stops the app
 func Stop() {
 	fmt.Println("topid chart server stopping...")
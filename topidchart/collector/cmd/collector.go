@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+	topid "github.com/godevsig/grepo/topidchart"
+	"github.com/godevsig/grepo/topidchart/collector"
+)
+
+var stopped int32
+
+// sender sends the records to the topidchart server, resuming the session
+// when the stream breaks.
+type sender struct {
+	c     *as.Client
+	msg   *topid.SessionRequestV2
+	conn  as.Connection
+	rep   topid.SessionResponseV2
+	delta *topid.DeltaEncoder
+}
+
+func (s *sender) connect() error {
+	conn := <-s.c.Discover("platform", "topidchart")
+	if conn == nil {
+		return errors.New("connect to topidchart failed")
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *sender) start() error {
+	if err := s.connect(); err != nil {
+		return err
+	}
+	s.rep = topid.SessionResponseV2{}
+	s.delta = nil
+	if err := s.conn.SendRecv(s.msg, &s.rep); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	if s.rep.Delta {
+		s.delta = topid.NewDeltaEncoder(s.rep.KeyframeInterval)
+	}
+	go watch(s.conn)
+	fmt.Println("Visit below URL to get the chart:")
+	fmt.Println(s.rep.ChartURL)
+	return nil
+}
+
+// watch prints the errors the server sends on the stream of conn, e.g. the
+// records failed to be stored on disk full, until the stream is closed.
+func watch(conn as.Connection) {
+	for {
+		err := conn.Recv(nil)
+		if errors.Is(err, io.EOF) || err == as.ErrConnReset {
+			return
+		}
+		if err != nil {
+			fmt.Println("server error:", err)
+		}
+	}
+}
+
+// resume continues the session on a new connection, or starts a new
+// session if the session can not be resumed, e.g. the server restarted.
+func (s *sender) resume() error {
+	if err := s.connect(); err != nil {
+		return err
+	}
+	if s.rep.ResumeToken != "" {
+		var rep topid.SessionResponseV2
+		err := s.conn.SendRecv(&topid.ResumeSession{
+			Token:        s.rep.ResumeToken,
+			Version:      s.msg.Version,
+			Capabilities: s.msg.Capabilities,
+		}, &rep)
+		if err == nil {
+			if s.delta != nil {
+				s.delta.Reset()
+			}
+			go watch(s.conn)
+			fmt.Println("session resumed")
+			return nil
+		}
+		fmt.Println("resume session failed:", err)
+	}
+	s.conn.Close()
+	s.conn = nil
+	return s.start()
+}
+
+// send sends the record, the record is dropped if the stream is broken
+// and can not be resumed for now.
+func (s *sender) send(r *topid.RecordV2) error {
+	if s.conn == nil {
+		if err := s.resume(); err != nil {
+			return err
+		}
+	}
+	if s.delta != nil {
+		r = s.delta.Encode(r)
+	}
+	if err := s.conn.Send(r); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// close ends the session with an empty record so the server closes it right away.
+func (s *sender) close() {
+	if s.conn != nil {
+		s.conn.Send(&topid.RecordV2{})
+		s.conn.Close()
+	}
+}
+
+// runInfo runs the commands and returns their output.
+func runInfo(cmds []string) string {
+	var b strings.Builder
+	for _, cmd := range cmds {
+		out, _ := exec.Command("sh", "-c", cmd).CombinedOutput()
+		fmt.Fprintf(&b, "$ %s\n%s\n", cmd, out)
+	}
+	return b.String()
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Start starts the app
+func Start(args []string) (err error) {
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(os.Stdout)
+
+	procRoot := flags.String("proc", "/proc", "root of the proc filesystem")
+	hz := flags.Int("hz", collector.DefaultClockTicks, "clock ticks per second of the cpu times in proc")
+	pidList := flags.String("p", "", "comma separated pids to collect, all processes if neither -p nor -name is set")
+	child := flags.Bool("child", false, "also collect the descendants of the processes selected by -p or -name")
+	names := flags.String("name", "", "comma separated process names to collect")
+	threads := flags.Bool("threads", false, "collect per thread statistics")
+	sys := flags.Bool("sys", false, "also collect system CPU and mem data")
+	interval := flags.Duration("i", 5*time.Second, "collect data every interval")
+	count := flags.Int("n", 0, "number of records to collect, 0 for no limit")
+	snapshot := flags.String("snapshot", "", "command whose output is sent as snapshot, e.g. \"ps -ef\"")
+	snapshotEvery := flags.Int("snapshotEvery", 12, "take the snapshot every n records")
+	tag := flags.String("tag", "temp", "tag is part of the URL, used to mark this run")
+	info := flags.String("info", "", "comma separated commands whose output is extra info of the system")
+	runID := flags.String("run", "", "run ID to join a multi-host run")
+	labels := flags.String("label", "", "labels of the session in the form of key=value,key=value")
+	delta := flags.Bool("delta", false, "send only the changed processes if the server accepts")
+	dryRun := flags.Bool("dry", false, "print the records in JSON lines instead of sending them")
+
+	if err = flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			err = nil
+		}
+		return err
+	}
+
+	options := []collector.Option{collector.WithProcRoot(*procRoot), collector.WithClockTicks(*hz)}
+	if *pidList != "" {
+		var pids []int
+		for _, v := range splitList(*pidList) {
+			pid, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid pid %q", v)
+			}
+			pids = append(pids, pid)
+		}
+		options = append(options, collector.WithPids(pids))
+	}
+	if *names != "" {
+		options = append(options, collector.WithNames(splitList(*names)))
+	}
+	if *child {
+		options = append(options, collector.WithChildren())
+	}
+	if *threads {
+		options = append(options, collector.WithThreads())
+	}
+	if *sys {
+		options = append(options, collector.WithSys())
+	}
+	col := collector.New(options...)
+
+	var s *sender
+	var encoder *json.Encoder
+	if *dryRun {
+		encoder = json.NewEncoder(os.Stdout)
+	} else {
+		msg := &topid.SessionRequestV2{
+			Version:      topid.ProtocolVersion,
+			Capabilities: []string{topid.CapExtMetrics, topid.CapContainers},
+			Tag:          *tag,
+			SysInfo:      col.SysInfo(),
+			ExtraInfo:    runInfo(splitList(*info)),
+			Delta:        *delta,
+			RunID:        *runID,
+		}
+		if *threads {
+			msg.Capabilities = append(msg.Capabilities, topid.CapThreads)
+		}
+		if *sys {
+			msg.Capabilities = append(msg.Capabilities, topid.CapSys)
+		}
+		if *snapshot != "" {
+			msg.Capabilities = append(msg.Capabilities, topid.CapSnapshot)
+		}
+		for _, kv := range splitList(*labels) {
+			if msg.Labels == nil {
+				msg.Labels = make(map[string]string)
+			}
+			i := strings.Index(kv, "=")
+			if i < 0 {
+				msg.Labels[kv] = ""
+			} else {
+				msg.Labels[kv[:i]] = kv[i+1:]
+			}
+		}
+		s = &sender{c: as.NewClient().SetDiscoverTimeout(3), msg: msg}
+		if err := s.start(); err != nil {
+			return err
+		}
+		defer s.close()
+	}
+
+	// the first sample has no usage, it only primes the counters
+	if _, err := col.Sample(time.Now()); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for i := 0; (*count == 0 || i < *count) && atomic.LoadInt32(&stopped) == 0; i++ {
+		now := <-ticker.C
+		record, err := col.Sample(now)
+		if err != nil {
+			return err
+		}
+		if *snapshot != "" && *snapshotEvery > 0 && i%*snapshotEvery == 0 {
+			out, _ := exec.Command("sh", "-c", *snapshot).CombinedOutput()
+			record.Snapshot = string(out)
+		}
+
+		if encoder != nil {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.send(record); err != nil {
+			fmt.Println("record dropped:", err)
+		}
+	}
+	return nil
+}
+
+// Stop stops the app
+func Stop() {
+	fmt.Println("topid collector stopping...")
+	atomic.StoreInt32(&stopped, 1)
+}
+
+func main() {
+	if err := Start(os.Args[1:]); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,361 @@
+// Package collector samples process and system statistics from /proc into
+// topidchart records.
+package collector
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	topid "github.com/godevsig/grepo/topidchart"
+)
+
+// DefaultClockTicks is the USER_HZ of the most of the Linux systems,
+// the unit of the cpu times in /proc.
+const DefaultClockTicks = 100
+
+// Collector samples the statistics of the selected processes.
+// It keeps the cumulative counters of the previous sample, so the usage
+// in a record is the one in the interval since the previous record.
+type Collector struct {
+	root    string
+	hz      float64
+	pids    map[int]bool
+	child   bool
+	names   map[string]bool
+	threads bool
+	sys     bool
+
+	last     time.Time
+	prev     map[int]*sample
+	prevCPUs []cpuTimes
+}
+
+// sample is the cumulative counters of a process.
+type sample struct {
+	utime, stime   uint64
+	read, write    uint64
+	vctxsw, ictxsw uint64
+	tasks          map[int]*procStat
+}
+
+// Option is the option of the collector.
+type Option func(*Collector)
+
+// WithProcRoot sets the root of the proc filesystem, /proc by default.
+func WithProcRoot(root string) Option {
+	return func(c *Collector) {
+		c.root = root
+	}
+}
+
+// WithClockTicks sets the clock ticks per second of the cpu times.
+func WithClockTicks(hz int) Option {
+	return func(c *Collector) {
+		if hz > 0 {
+			c.hz = float64(hz)
+		}
+	}
+}
+
+// WithPids selects the processes by pid.
+func WithPids(pids []int) Option {
+	return func(c *Collector) {
+		if c.pids == nil {
+			c.pids = make(map[int]bool)
+		}
+		for _, pid := range pids {
+			c.pids[pid] = true
+		}
+	}
+}
+
+// WithNames selects the processes by name, either the comm or the base
+// name of the executable in the command line.
+func WithNames(names []string) Option {
+	return func(c *Collector) {
+		if c.names == nil {
+			c.names = make(map[string]bool)
+		}
+		for _, name := range names {
+			c.names[name] = true
+		}
+	}
+}
+
+// WithChildren also selects the descendants of the processes selected by pid or name.
+func WithChildren() Option {
+	return func(c *Collector) {
+		c.child = true
+	}
+}
+
+// WithThreads enables the per thread statistics.
+func WithThreads() Option {
+	return func(c *Collector) {
+		c.threads = true
+	}
+}
+
+// WithSys enables the system wide statistics.
+func WithSys() Option {
+	return func(c *Collector) {
+		c.sys = true
+	}
+}
+
+// New creates a collector, all the processes are selected if neither
+// WithPids nor WithNames is set.
+func New(options ...Option) *Collector {
+	c := &Collector{
+		root: "/proc",
+		hz:   DefaultClockTicks,
+		prev: make(map[int]*sample),
+	}
+	for _, o := range options {
+		o(c)
+	}
+	return c
+}
+
+func (c *Collector) path(elem ...string) string {
+	return filepath.Join(append([]string{c.root}, elem...)...)
+}
+
+// SysInfo returns the info of the system for SessionRequestV2.
+func (c *Collector) SysInfo() topid.SysInfoV2 {
+	var info topid.SysInfoV2
+	if data, err := ioutil.ReadFile(c.path("cpuinfo")); err == nil {
+		cpuinfo := string(data)
+		// the first processor is enough for the free-form text
+		if i := strings.Index(cpuinfo, "\n\n"); i >= 0 {
+			info.CPUInfo = cpuinfo[:i]
+		} else {
+			info.CPUInfo = strings.TrimSpace(cpuinfo)
+		}
+		for _, line := range strings.Split(cpuinfo, "\n") {
+			kv := strings.SplitN(line, ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch strings.TrimSpace(kv[0]) {
+			case "processor":
+				info.NumCPU++
+			case "model name", "Model":
+				if info.CPUModel == "" {
+					info.CPUModel = strings.TrimSpace(kv[1])
+				}
+			}
+		}
+	}
+	info.KernelInfo = readFirstLine(c.path("version"))
+	if fields := strings.Fields(info.KernelInfo); len(fields) > 2 {
+		info.KernelVersion = fields[2]
+	}
+	if mem, err := readKeyValues(c.path("meminfo"), "MemTotal"); err == nil {
+		info.MemTotal = mem["MemTotal"]
+	}
+	info.Hostname = readFirstLine(c.path("sys", "kernel", "hostname"))
+	info.Arch = runtime.GOARCH
+	return info
+}
+
+// selected returns the pids of the selected processes.
+func (c *Collector) selected(stats map[int]*procStat) []int {
+	var pids []int
+	if c.pids == nil && c.names == nil {
+		for pid := range stats {
+			pids = append(pids, pid)
+		}
+		sort.Ints(pids)
+		return pids
+	}
+
+	in := make(map[int]bool)
+	for pid, st := range stats {
+		if c.pids[pid] {
+			in[pid] = true
+		} else if c.names != nil && (c.names[st.comm] || c.names[readCmdName(c.path(fmt.Sprint(pid), "cmdline"))]) {
+			in[pid] = true
+		}
+	}
+	if c.child {
+		var children []int
+		for pid := range stats {
+			if !in[pid] && isDescendant(pid, in, stats) {
+				children = append(children, pid)
+			}
+		}
+		for _, pid := range children {
+			in[pid] = true
+		}
+	}
+	for pid := range in {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// isDescendant reports whether pid is a descendant of the ancestors.
+func isDescendant(pid int, ancestors map[int]bool, stats map[int]*procStat) bool {
+	// bounded in case of a loop of the racy reads
+	for i := 0; i < len(stats) && pid > 0; i++ {
+		st, ok := stats[pid]
+		if !ok {
+			return false
+		}
+		pid = st.ppid
+		if ancestors[pid] {
+			return true
+		}
+	}
+	return false
+}
+
+// Sample returns the record of the selected processes at now.
+// The cpu usage and the counters in the first record are 0 as there
+// is no previous sample.
+func (c *Collector) Sample(now time.Time) (*topid.RecordV2, error) {
+	pids, err := listPids(c.root)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[int]*procStat, len(pids))
+	for _, pid := range pids {
+		// the process may have exited
+		if st, err := readStat(c.path(fmt.Sprint(pid), "stat")); err == nil {
+			stats[pid] = st
+		}
+	}
+
+	var dt float64
+	if !c.last.IsZero() {
+		dt = now.Sub(c.last).Seconds()
+	}
+	percent := func(ticks uint64) float32 {
+		if dt <= 0 {
+			return 0
+		}
+		return float32(float64(ticks) / c.hz / dt * 100)
+	}
+
+	record := &topid.RecordV2{Timestamp: now.Unix()}
+	cur := make(map[int]*sample)
+	for _, pid := range c.selected(stats) {
+		st := stats[pid]
+		dir := c.path(fmt.Sprint(pid))
+		s := &sample{utime: st.utime, stime: st.stime}
+		p := topid.ProcessInfoV2{
+			Pid:        pid,
+			Name:       st.comm,
+			Ppid:       st.ppid,
+			NumThreads: st.numThreads,
+			NumFDs:     countDir(filepath.Join(dir, "fd")),
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(dir, "cgroup")); err == nil {
+			p.Cgroup, p.ContainerID = parseCgroup(string(data))
+		}
+		if status, err := readKeyValues(filepath.Join(dir, "status"), "VmRSS", "voluntary_ctxt_switches", "nonvoluntary_ctxt_switches"); err == nil {
+			p.Mem = status["VmRSS"]
+			s.vctxsw = status["voluntary_ctxt_switches"]
+			s.ictxsw = status["nonvoluntary_ctxt_switches"]
+		}
+		// io is readable only by the owner
+		if io, err := readKeyValues(filepath.Join(dir, "io"), "read_bytes", "write_bytes"); err == nil {
+			s.read = io["read_bytes"]
+			s.write = io["write_bytes"]
+		}
+
+		prev := c.prev[pid]
+		if prev != nil {
+			p.Ucpu = percent(delta(s.utime, prev.utime))
+			p.Scpu = percent(delta(s.stime, prev.stime))
+			p.ReadBytes = delta(s.read, prev.read)
+			p.WriteBytes = delta(s.write, prev.write)
+			p.VolCtxsw = delta(s.vctxsw, prev.vctxsw)
+			p.InvolCtxsw = delta(s.ictxsw, prev.ictxsw)
+		}
+		if c.threads {
+			s.tasks = c.sampleThreads(dir, &p, prev, percent)
+		}
+		cur[pid] = s
+		record.Processes = append(record.Processes, p)
+	}
+	c.prev = cur
+
+	if c.sys {
+		record.Sys = c.sampleSys()
+	}
+	c.last = now
+	return record, nil
+}
+
+func (c *Collector) sampleThreads(dir string, p *topid.ProcessInfoV2, prev *sample, percent func(uint64) float32) map[int]*procStat {
+	tids, err := listPids(filepath.Join(dir, "task"))
+	if err != nil {
+		return nil
+	}
+	sort.Ints(tids)
+	tasks := make(map[int]*procStat, len(tids))
+	for _, tid := range tids {
+		st, err := readStat(filepath.Join(dir, "task", fmt.Sprint(tid), "stat"))
+		if err != nil {
+			continue
+		}
+		tasks[tid] = st
+		t := topid.ThreadInfo{Tid: tid, Name: st.comm}
+		if prev != nil {
+			if pt, ok := prev.tasks[tid]; ok {
+				t.Ucpu = percent(delta(st.utime, pt.utime))
+				t.Scpu = percent(delta(st.stime, pt.stime))
+			}
+		}
+		p.Threads = append(p.Threads, t)
+	}
+	return tasks
+}
+
+func (c *Collector) sampleSys() *topid.SysStats {
+	sys := &topid.SysStats{}
+	if times, err := readCPUTimes(c.path("stat")); err == nil {
+		if len(c.prevCPUs) == len(times) {
+			usage := func(cur, prev cpuTimes) float32 {
+				total := delta(cur.total, prev.total)
+				if total == 0 {
+					return 0
+				}
+				return float32(float64(delta(cur.busy, prev.busy)) / float64(total) * 100)
+			}
+			sys.CPU = usage(times[0], c.prevCPUs[0])
+			for i := 1; i < len(times); i++ {
+				sys.PerCore = append(sys.PerCore, usage(times[i], c.prevCPUs[i]))
+			}
+		}
+		c.prevCPUs = times
+	}
+	if fields := strings.Fields(readFirstLine(c.path("loadavg"))); len(fields) >= 3 {
+		fmt.Sscan(fields[0], &sys.Load1)
+		fmt.Sscan(fields[1], &sys.Load5)
+		fmt.Sscan(fields[2], &sys.Load15)
+	}
+	if mem, err := readKeyValues(c.path("meminfo"), "MemFree", "MemAvailable", "SwapTotal", "SwapFree"); err == nil {
+		sys.MemFree = mem["MemFree"]
+		sys.MemAvailable = mem["MemAvailable"]
+		sys.SwapTotal = mem["SwapTotal"]
+		sys.SwapFree = mem["SwapFree"]
+	}
+	return sys
+}
+
+// delta returns the increment of a counter, 0 if the counter was reset.
+func delta(cur, prev uint64) uint64 {
+	if cur < prev {
+		return 0
+	}
+	return cur - prev
+}
@@ -0,0 +1,229 @@
+package collector
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	topid "github.com/godevsig/grepo/topidchart"
+)
+
+const fixtureRoot = "testdata/proc"
+
+const fixtureContainerID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// copyTree copies the fixture tree into a temp dir so the test can modify it.
+func copyTree(t *testing.T) string {
+	t.Helper()
+	dst := t.TempDir()
+	err := filepath.Walk(fixtureRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(fixtureRoot, p)
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, data, 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dst
+}
+
+func writeStat(t *testing.T, root, file string, pid int, comm string, ppid int, utime, stime uint64) {
+	t.Helper()
+	data := fmt.Sprintf("%d (%s) S %d %d %d 0 -1 4194560 1000 0 0 0 %d %d 0 0 20 0 2 0 12345 100000000 2500\n",
+		pid, comm, ppid, pid, pid, utime, stime)
+	if err := ioutil.WriteFile(filepath.Join(root, file), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func findProcess(r *topid.RecordV2, pid int) *topid.ProcessInfoV2 {
+	for i := range r.Processes {
+		if r.Processes[i].Pid == pid {
+			return &r.Processes[i]
+		}
+	}
+	return nil
+}
+
+func pidsOf(r *topid.RecordV2) []int {
+	var pids []int
+	for _, p := range r.Processes {
+		pids = append(pids, p.Pid)
+	}
+	return pids
+}
+
+func TestParseStat(t *testing.T) {
+	cases := []struct {
+		data  string
+		comm  string
+		ppid  int
+		utime uint64
+	}{
+		{"1 (systemd) S 0 1 1 0 -1 4194560 1000 0 0 0 500 300 0 0 20 0 1 0 12\n", "systemd", 0, 500},
+		{"100 (my (app) x) R 1 100 100 0 -1 4194560 1000 0 0 0 1000 200 0 0 20 0 2 0 12\n", "my (app) x", 1, 1000},
+		{"7 (a) b) c) S 3 7 7 0 -1 0 0 0 0 0 9 8 0 0 20 0 4 0 12\n", "a) b) c", 3, 9},
+		{"8 () S 2 8 8 0 -1 0 0 0 0 0 1 2 0 0 20 0 1 0 12\n", "", 2, 1},
+	}
+	for _, c := range cases {
+		st, err := parseStat(c.data)
+		if err != nil {
+			t.Errorf("%q: %v", c.data, err)
+			continue
+		}
+		if st.comm != c.comm || st.ppid != c.ppid || st.utime != c.utime {
+			t.Errorf("%q: got %+v", c.data, st)
+		}
+	}
+
+	for _, data := range []string{"", "1 systemd S 0", "1 (systemd) S 0 1 1"} {
+		if _, err := parseStat(data); err != errBadStat {
+			t.Errorf("%q: got %v, want errBadStat", data, err)
+		}
+	}
+}
+
+func TestParseCgroup(t *testing.T) {
+	cases := []struct {
+		data string
+		path string
+		id   string
+	}{
+		{"0::/init.scope\n", "/init.scope", ""},
+		{"0::/system.slice/docker-" + fixtureContainerID + ".scope\n", "/system.slice/docker-" + fixtureContainerID + ".scope", fixtureContainerID},
+		{"12:cpu,cpuacct:/docker/" + fixtureContainerID + "\n0::/\n", "/docker/" + fixtureContainerID, fixtureContainerID},
+		{"0::/kubepods/burstable/pod1/crio-" + fixtureContainerID + "\n", "/kubepods/burstable/pod1/crio-" + fixtureContainerID, fixtureContainerID},
+		{"0::/user.slice/" + strings.ToUpper(fixtureContainerID) + "\n", "/user.slice/" + strings.ToUpper(fixtureContainerID), ""},
+	}
+	for _, c := range cases {
+		path, id := parseCgroup(c.data)
+		if path != c.path || id != c.id {
+			t.Errorf("%q: got %q %q, want %q %q", c.data, path, id, c.path, c.id)
+		}
+	}
+}
+
+func TestSampleFixture(t *testing.T) {
+	c := New(WithProcRoot(fixtureRoot), WithThreads())
+	r, err := c.Sample(time.Unix(1000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pids := pidsOf(r); !reflect.DeepEqual(pids, []int{1, 100, 200, 300, 400}) {
+		t.Fatalf("got pids %v", pids)
+	}
+
+	p := findProcess(r, 100)
+	if p.Name != "my (app) x" || p.Ppid != 1 || p.NumThreads != 2 || p.NumFDs != 3 || p.Mem != 2048 {
+		t.Errorf("got %+v", p)
+	}
+	if p.ContainerID != fixtureContainerID || p.Cgroup != "/docker/"+fixtureContainerID {
+		t.Errorf("got cgroup %q container %q", p.Cgroup, p.ContainerID)
+	}
+	if p.Ucpu != 0 || p.Scpu != 0 || p.ReadBytes != 0 {
+		t.Errorf("got usage in the first sample %+v", p)
+	}
+	if len(p.Threads) != 2 || p.Threads[1].Tid != 101 || p.Threads[1].Name != "worker 1" {
+		t.Errorf("got threads %+v", p.Threads)
+	}
+	if p := findProcess(r, 1); p.ContainerID != "" || p.Cgroup != "/init.scope" {
+		t.Errorf("got cgroup %q container %q", p.Cgroup, p.ContainerID)
+	}
+}
+
+func TestSampleDeltas(t *testing.T) {
+	root := copyTree(t)
+	c := New(WithProcRoot(root), WithPids([]int{100}), WithThreads(), WithSys())
+	if _, err := c.Sample(time.Unix(1000, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// in 2 seconds at 100 ticks per second: 100 user and 50 system ticks
+	writeStat(t, root, "100/stat", 100, "my (app) x", 1, 1100, 250)
+	writeStat(t, root, "100/task/101/stat", 101, "worker 1", 1, 440, 100)
+	io := "read_bytes: 5120\nwrite_bytes: 8192\n"
+	if err := ioutil.WriteFile(filepath.Join(root, "100/io"), []byte(io), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stat := "cpu  1300 0 600 8100 500 0 0 0 0 0\ncpu0 700 0 300 4000 250 0 0 0 0 0\ncpu1 600 0 300 4100 250 0 0 0 0 0\n"
+	if err := ioutil.WriteFile(filepath.Join(root, "stat"), []byte(stat), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.Sample(time.Unix(1002, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := findProcess(r, 100)
+	if p == nil || p.Ucpu != 50 || p.Scpu != 25 || p.ReadBytes != 1024 || p.WriteBytes != 0 {
+		t.Fatalf("got %+v", p)
+	}
+	if th := p.Threads[1]; th.Ucpu != 20 || th.Scpu != 0 {
+		t.Errorf("got thread %+v", th)
+	}
+	if r.Sys == nil || r.Sys.CPU != 80 || len(r.Sys.PerCore) != 2 || r.Sys.PerCore[0] != 100 || r.Sys.PerCore[1] != 60 {
+		t.Errorf("got sys %+v", r.Sys)
+	}
+	if r.Sys.Load1 != 0.5 || r.Sys.MemAvailable != 4000000 {
+		t.Errorf("got sys %+v", r.Sys)
+	}
+
+	// counters going backwards, e.g. pid reuse, give no usage
+	writeStat(t, root, "100/stat", 100, "my (app) x", 1, 10, 10)
+	r, err = c.Sample(time.Unix(1004, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := findProcess(r, 100); p.Ucpu != 0 || p.Scpu != 0 {
+		t.Errorf("got %+v after the counters reset", p)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	cases := []struct {
+		name    string
+		options []Option
+		pids    []int
+	}{
+		{"all", nil, []int{1, 100, 200, 300, 400}},
+		{"pid", []Option{WithPids([]int{100})}, []int{100}},
+		{"pid with children", []Option{WithPids([]int{100}), WithChildren()}, []int{100, 200}},
+		{"comm", []Option{WithNames([]string{"child"})}, []int{200}},
+		{"cmdline", []Option{WithNames([]string{"myapp"})}, []int{100, 300}},
+		{"name with children", []Option{WithNames([]string{"systemd"}), WithChildren()}, []int{1, 100, 200, 300}},
+		{"pid and name", []Option{WithPids([]int{400}), WithNames([]string{"other"})}, []int{300, 400}},
+		{"not found", []Option{WithPids([]int{999})}, nil},
+	}
+	for _, c := range cases {
+		r, err := New(append(c.options, WithProcRoot(fixtureRoot))...).Sample(time.Unix(1000, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pids := pidsOf(r); !reflect.DeepEqual(pids, c.pids) {
+			t.Errorf("%s: got %v, want %v", c.name, pids, c.pids)
+		}
+	}
+}
+
+func TestSysInfo(t *testing.T) {
+	info := New(WithProcRoot(fixtureRoot)).SysInfo()
+	if info.NumCPU != 2 || info.CPUModel != "Test CPU @ 2.00GHz" || info.KernelVersion != "5.15.0-test" ||
+		info.MemTotal != 8000000 || info.Hostname != "fixture" {
+		t.Errorf("got %+v", info)
+	}
+}
@@ -0,0 +1,215 @@
+package collector
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var errBadStat = errors.New("malformed stat")
+
+// procStat is the part of /proc/<pid>/stat or /proc/<pid>/task/<tid>/stat in use.
+type procStat struct {
+	comm       string
+	ppid       int
+	utime      uint64 // in clock ticks
+	stime      uint64 // in clock ticks
+	numThreads int
+}
+
+// parseStat parses the content of a stat file, the comm field is in
+// parentheses and may contain spaces and parentheses itself.
+func parseStat(data string) (*procStat, error) {
+	open := strings.IndexByte(data, '(')
+	closing := strings.LastIndexByte(data, ')')
+	if open < 0 || closing < open {
+		return nil, errBadStat
+	}
+	fields := strings.Fields(data[closing+1:])
+	// fields[0] is the state, the third field of the file
+	if len(fields) < 18 {
+		return nil, errBadStat
+	}
+	st := &procStat{comm: data[open+1 : closing]}
+	st.ppid, _ = strconv.Atoi(fields[1])
+	st.utime, _ = strconv.ParseUint(fields[11], 10, 64)
+	st.stime, _ = strconv.ParseUint(fields[12], 10, 64)
+	st.numThreads, _ = strconv.Atoi(fields[17])
+	return st, nil
+}
+
+func readStat(filename string) (*procStat, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseStat(string(data))
+}
+
+// readKeyValues reads the files in the form of "key: value unit", such as
+// /proc/<pid>/status, /proc/<pid>/io and /proc/meminfo, the values are the
+// first number after the key.
+func readKeyValues(filename string, keys ...string) (map[string]uint64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64, len(keys))
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		key := line[:i]
+		for _, k := range keys {
+			if k != key {
+				continue
+			}
+			fields := strings.Fields(line[i+1:])
+			if len(fields) != 0 {
+				values[key], _ = strconv.ParseUint(fields[0], 10, 64)
+			}
+			break
+		}
+	}
+	return values, scanner.Err()
+}
+
+// cpuTimes is a cpu line of /proc/stat.
+type cpuTimes struct {
+	busy  uint64
+	total uint64
+}
+
+// readCPUTimes returns the total times of all cpus followed by the times of each cpu.
+func readCPUTimes(filename string) ([]cpuTimes, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var times []cpuTimes
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "cpu") {
+			continue
+		}
+		fields := strings.Fields(line)
+		var ct cpuTimes
+		for i, f := range fields[1:] {
+			v, _ := strconv.ParseUint(f, 10, 64)
+			// guest times are already accounted in user and nice
+			if i >= 8 {
+				break
+			}
+			ct.total += v
+			// idle and iowait
+			if i != 3 && i != 4 {
+				ct.busy += v
+			}
+		}
+		times = append(times, ct)
+	}
+	if len(times) == 0 {
+		return nil, errBadStat
+	}
+	return times, nil
+}
+
+// countDir returns the number of entries in the directory.
+func countDir(dir string) int {
+	f, err := os.Open(dir)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	names, _ := f.Readdirnames(-1)
+	return len(names)
+}
+
+// listPids returns the numeric entries in the directory.
+func listPids(dir string) ([]int, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, name := range names {
+		if pid, err := strconv.Atoi(name); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// readCmdName returns the base name of the executable in /proc/<pid>/cmdline,
+// empty for kernel threads.
+func readCmdName(filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	if i := strings.IndexByte(string(data), 0); i >= 0 {
+		data = data[:i]
+	}
+	if len(data) == 0 {
+		return ""
+	}
+	return filepath.Base(string(data))
+}
+
+// readFirstLine returns the first line of the file, trimmed.
+func readFirstLine(filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+}
+
+// containerIDPattern matches the container IDs of docker, containerd, cri-o
+// and podman in the cgroup path, e.g. /docker/<id> or /system.slice/crio-<id>.scope.
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// parseCgroup returns the cgroup path of the process in the content of
+// /proc/<pid>/cgroup and the container ID found in the path.
+// The unified hierarchy of cgroup v2 is preferred, then the cpu controller of v1
+// for the hybrid systems where the processes are only in the root of v2.
+func parseCgroup(data string) (path, containerID string) {
+	var unified, cpu string
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[1] == "" {
+			unified = fields[2]
+			continue
+		}
+		for _, c := range strings.Split(fields[1], ",") {
+			if c == "cpu" {
+				cpu = fields[2]
+			}
+		}
+	}
+	path = unified
+	if path == "" || (path == "/" && cpu != "") {
+		path = cpu
+	}
+	if ids := containerIDPattern.FindAllString(path, -1); len(ids) != 0 {
+		containerID = ids[len(ids)-1]
+	}
+	return
+}
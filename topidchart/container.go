@@ -0,0 +1,115 @@
+package topidchart
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// hostContainer is the container filter that matches the processes not in container.
+const hostContainer = "host"
+
+var errContainerID = errors.New("invalid container ID, only lower case hex digits allowed")
+
+// validContainerID reports whether the container ID is empty or hex digits in lower case,
+// as the container runtimes name the containers.
+func validContainerID(id string) bool {
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// containerName returns the short container ID of the process as docker shows,
+// empty if the process is not in container.
+func containerName(p *ProcessInfoV2) string {
+	if len(p.ContainerID) > 12 {
+		return p.ContainerID[:12]
+	}
+	return p.ContainerID
+}
+
+// matchContainer reports whether the process is in the container, which is
+// a prefix of the container ID, or host for the processes not in container.
+// The empty container matches all.
+func matchContainer(p *ProcessInfoV2, container string) bool {
+	switch container {
+	case "":
+		return true
+	case hostContainer:
+		return p.ContainerID == ""
+	}
+	return p.ContainerID != "" && strings.HasPrefix(p.ContainerID, container)
+}
+
+// filterContainer removes the processes not in the container from the record.
+func filterContainer(rec *pRecord, container string) {
+	if container == "" {
+		return
+	}
+	processes := rec.Processes[:0]
+	for _, p := range rec.Processes {
+		if matchContainer(&p, container) {
+			processes = append(processes, p)
+		}
+	}
+	rec.Processes = processes
+}
+
+// containerOption is an option of the container selector.
+type containerOption struct {
+	Value    string
+	Label    string
+	Selected bool
+}
+
+// containersJS returns the js to add the container selector if any process is in container.
+// The options are passed as JSON and set as text, so the container IDs never become markup.
+func (prs *processRecords) containersJS(selected string) string {
+	if len(prs.containers) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(prs.containers))
+	for name := range prs.containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var options []containerOption
+	for _, name := range append([]string{"", hostContainer}, names...) {
+		label := name
+		if name == "" {
+			label = "all containers"
+		}
+		// the filter may be a prefix of the short ID or the full ID
+		sel := name == selected || (name != "" && name != hostContainer && selected != "" &&
+			(strings.HasPrefix(name, selected) || strings.HasPrefix(selected, name)))
+		options = append(options, containerOption{name, label, sel})
+	}
+	data, err := json.Marshal(options)
+	if err != nil {
+		return ""
+	}
+
+	// the empty value is kept in the URL to override the default container of the dashboard
+	return fmt.Sprintf(`var containers = document.createElement("select");
+					containers.id = "containers";
+					containers.style = "margin-top:10px;width:100px";
+					%s.forEach(function(c){
+						var opt = document.createElement("option");
+						opt.value = c.Value;
+						opt.text = c.Label;
+						opt.selected = c.Selected;
+						containers.appendChild(opt);
+					});
+					containers.onchange=function(){
+						var params = new URLSearchParams(location.search);
+						params.set("container", this.value);
+						location.search = params.toString();
+					};
+					document.getElementsByClassName("btn")[0].appendChild(containers);`, data)
+}
@@ -0,0 +1,274 @@
+package topidchart
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+)
+
+// dashboardFile is the dashboard of a tag in the directory of the tag.
+const dashboardFile = "dashboard.json"
+
+// The panels of the dashboards besides the extended metric panels, see metricPanels.
+const (
+	panelCPU         = "cpu"
+	panelMEM         = "mem"
+	panelMetrics     = "metrics"     // the extended metric panels with data, selectable on the page
+	panelSummary     = "summary"     // table of the processes shown
+	panelAnnotations = "annotations" // session start, end, outages and snapshots
+)
+
+// dashboardPanel is a panel of a dashboard.
+type dashboardPanel struct {
+	Panel  string
+	Width  string // CSS size in px, %, vh, vw or em, e.g. 1400px, the default of the panel if empty
+	Height string
+}
+
+// dashboard is the layout of the chart page of the sessions of a tag,
+// defined in JSON in <dir>/<tag>/dashboard.json.
+type dashboard struct {
+	Panels []dashboardPanel // in the order shown
+	Filter *Filter          // the default filter, all the thresholds should be set
+	Group  string           // the default grouping, see groupName
+	Norm   string           // the default normalization, e.g. cpu,mem
+}
+
+// defaultDashboard is the layout of the tags without dashboard.
+var defaultDashboard = &dashboard{
+	Panels: []dashboardPanel{{Panel: panelCPU}, {Panel: panelMEM}, {Panel: panelMetrics}},
+}
+
+func findMetricPanel(name string) *metricPanel {
+	for _, mp := range metricPanels {
+		if mp.name == name {
+			return mp
+		}
+	}
+	return nil
+}
+
+// panelSizePattern matches the sizes of the panels, which are put into the style
+// of the charts and the js as they are.
+var panelSizePattern = regexp.MustCompile(`^\d+(px|%|vh|vw|em)$`)
+
+func (d *dashboard) validate() error {
+	for _, p := range d.Panels {
+		switch p.Panel {
+		case panelCPU, panelMEM, panelMetrics, panelSummary, panelAnnotations:
+		default:
+			if findMetricPanel(p.Panel) == nil {
+				return fmt.Errorf("unknown panel %q", p.Panel)
+			}
+		}
+		for _, size := range []string{p.Width, p.Height} {
+			if size != "" && !panelSizePattern.MatchString(size) {
+				return fmt.Errorf("invalid size %q of panel %q, should be like 800px, 50%%, 40vh, 80vw or 30em", size, p.Panel)
+			}
+		}
+	}
+	switch d.Group {
+	case "", groupByName, groupByContainer:
+	default:
+		return fmt.Errorf("unknown group %q", d.Group)
+	}
+	return nil
+}
+
+// loadDashboard returns the dashboard of the tag, the default one if the tag
+// has no dashboard or the dashboard is invalid.
+func (cs *chartServer) loadDashboard(tag string) *dashboard {
+	if tag == "" || !validName(tag) {
+		return defaultDashboard
+	}
+	data, err := ioutil.ReadFile(fmt.Sprintf("%v/%v/%v", cs.dir, tag, dashboardFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			cs.lg.Warnln(err)
+		}
+		return defaultDashboard
+	}
+	d := &dashboard{}
+	err = json.Unmarshal(data, d)
+	if err == nil {
+		err = d.validate()
+	}
+	if err != nil {
+		cs.lg.Warnf("dashboard of tag %v: %v, using the default", tag, err)
+		return defaultDashboard
+	}
+	if len(d.Panels) == 0 {
+		d.Panels = defaultDashboard.Panels
+	}
+	return d
+}
+
+// filter returns the default filter of the dashboard based on def.
+func (d *dashboard) filter(def *filter) filter {
+	f := *def
+	if d.Filter != nil {
+		f.cpuavg = d.Filter.CPUAvg
+		f.cpumax = d.Filter.CPUMax
+		f.memavg = d.Filter.MemAvg
+		f.memmax = d.Filter.MemMax
+		f.top = d.Filter.Top
+		f.container = d.Filter.Container
+	}
+	f.group = d.Group
+	return f
+}
+
+// resize sets the size of the chart of the panel if set.
+func resize(line *charts.Line, p dashboardPanel) *charts.Line {
+	if p.Width != "" {
+		line.Initialization.Width = p.Width
+	}
+	if p.Height != "" {
+		line.Initialization.Height = p.Height
+	}
+	return line
+}
+
+// htmlPanel is a panel of the dashboard that is not a chart.
+type htmlPanel struct {
+	html   string
+	panel  dashboardPanel
+	before int // index of the chart the panel is placed before
+}
+
+// htmlPanelsJS returns the js to place the panels among the charts,
+// it should run after all the charts are created.
+func htmlPanelsJS(panels []htmlPanel, lines []*charts.Line) string {
+	var b strings.Builder
+	b.WriteString(`var box = document.getElementsByClassName("box")[0];`)
+	for _, p := range panels {
+		next := ""
+		if p.before < len(lines) {
+			next = lines[p.before].ChartID
+		}
+		width, height := p.panel.Width, p.panel.Height
+		if width == "" {
+			width = "1400px"
+		}
+		if height == "" {
+			height = "none"
+		}
+		content, _ := json.Marshal(p.html)
+		fmt.Fprintf(&b, `
+					(function(){
+						var panel = document.createElement("div");
+						panel.className = "container";
+						panel.style = "width:%s;max-height:%s;overflow:auto;margin:10px 0";
+						panel.innerHTML = %s;
+						var next = document.getElementById("%s");
+						box.insertBefore(panel, next ? next.parentNode : null);
+					})();`, width, height, content, next)
+	}
+	return b.String()
+}
+
+// summaryHTML returns the table of the processes shown, sorted by avg CPU.
+func (prs *processRecords) summaryHTML() string {
+	names := make(map[string]bool)
+	for k := range prs.cpu {
+		names[k] = true
+	}
+	for k := range prs.mem {
+		names[k] = true
+	}
+	rows := make([]string, 0, len(names))
+	for k := range names {
+		rows = append(rows, k)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if prs.cpuavg[rows[i]] != prs.cpuavg[rows[j]] {
+			return prs.cpuavg[rows[i]] > prs.cpuavg[rows[j]]
+		}
+		return rows[i] < rows[j]
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<table border="1" style="border-collapse:collapse;font-size:13px"><tr><th>Process</th>`+
+		`<th>CPU avg</th><th>CPU max</th><th>MEM avg</th><th>MEM max</th></tr>`+
+		`<tr><th></th><th colspan="2">%s</th><th colspan="2">%s</th></tr>`,
+		html.EscapeString(prs.cpuUnit), html.EscapeString(prs.memUnit))
+	for _, k := range rows {
+		fmt.Fprintf(&b, `<tr><td>%s</td><td>%.2f</td><td>%.2f</td><td>%.2f</td><td>%.2f</td></tr>`,
+			html.EscapeString(k), prs.cpuavg[k], prs.cpumax[k], prs.memavg[k], prs.memmax[k])
+	}
+	b.WriteString("</table>")
+	return b.String()
+}
+
+// annotationsHTML returns the list of the events of the session, each links to
+// the chart page focused on the time of the event.
+func (cs *chartServer) annotationsHTML(tag, session string, meta *sessionMeta) string {
+	type event struct {
+		ts   int64
+		text string
+		link string // optional link of the event
+	}
+	var events []event
+	if meta != nil {
+		events = append(events, event{ts: meta.Start, text: "session started"})
+		if meta.End != 0 {
+			events = append(events, event{ts: meta.End, text: "session ended"})
+		}
+		for _, g := range meta.Gaps {
+			events = append(events, event{ts: g.From, text: fmt.Sprintf("outage of %v", time.Duration(g.To-g.From)*time.Second)})
+		}
+	}
+	snapshots, err := loadSnapshots(fmt.Sprintf("%v/%v/snapshot-%v.data", cs.dir, tag, session))
+	if err != nil && !os.IsNotExist(err) {
+		cs.lg.Warnln(err)
+	}
+	for _, s := range snapshots {
+		events = append(events, event{ts: s.Timestamp, text: "snapshot", link: fmt.Sprintf("/%s/%s/snapshot?at=%d", tag, session, s.Timestamp)})
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].ts < events[j].ts })
+
+	var b strings.Builder
+	b.WriteString(`<b>Annotations</b><ul style="font-size:13px">`)
+	for _, e := range events {
+		text := html.EscapeString(e.text)
+		if e.link != "" {
+			text = fmt.Sprintf(`<a href="%s">%s</a>`, e.link, text)
+		}
+		fmt.Fprintf(&b, `<li><a href="?at=%d">%s</a> %s</li>`, e.ts, time.Unix(e.ts, 0).Format("2006-01-02 15:04:05"), text)
+	}
+	if len(events) == 0 {
+		b.WriteString("<li>none</li>")
+	}
+	b.WriteString("</ul>")
+	return b.String()
+}
+
+// groupJS returns the js to add the grouping selector.
+func groupJS(selected string) string {
+	var options strings.Builder
+	for _, g := range [][2]string{{"", "per process"}, {groupByName, "by name"}, {groupByContainer, "by container"}} {
+		attr := ""
+		if g[0] == selected {
+			attr = " selected"
+		}
+		fmt.Fprintf(&options, `<option value="%s"%s>%s</option>`, g[0], attr, g[1])
+	}
+	return fmt.Sprintf(`var group = document.createElement("select");
+					group.id = "group";
+					group.style = "margin-top:10px;width:100px";
+					group.innerHTML = '%s';
+					group.onchange=function(){
+						var params = new URLSearchParams(location.search);
+						params.set("group", this.value);
+						location.search = params.toString();
+					};
+					document.getElementsByClassName("btn")[0].appendChild(group);`, options.String())
+}
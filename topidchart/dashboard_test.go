@@ -0,0 +1,31 @@
+package topidchart
+
+import "testing"
+
+func TestDashboardValidate(t *testing.T) {
+	cases := []struct {
+		panel dashboardPanel
+		valid bool
+	}{
+		{dashboardPanel{Panel: panelCPU}, true},
+		{dashboardPanel{Panel: panelCPU, Width: "1400px", Height: "50vh"}, true},
+		{dashboardPanel{Panel: panelSummary, Width: "80%", Height: "30em"}, true},
+		{dashboardPanel{Panel: panelMEM, Width: "90vw"}, true},
+		{dashboardPanel{Panel: "bogus"}, false},
+		{dashboardPanel{Panel: panelCPU, Width: "1400"}, false},
+		{dashboardPanel{Panel: panelCPU, Width: "1.5em"}, false},
+		{dashboardPanel{Panel: panelCPU, Height: "100px;background:red"}, false},
+		{dashboardPanel{Panel: panelSummary, Height: `1px";alert(1);"`}, false},
+		{dashboardPanel{Panel: panelSummary, Width: "calc(100% - 10px)"}, false},
+	}
+	for _, c := range cases {
+		d := &dashboard{Panels: []dashboardPanel{c.panel}}
+		if err := d.validate(); (err == nil) != c.valid {
+			t.Errorf("%+v: got %v, want valid %v", c.panel, err, c.valid)
+		}
+	}
+
+	if err := (&dashboard{Group: "bogus"}).validate(); err == nil {
+		t.Error("unknown group accepted")
+	}
+}
@@ -0,0 +1,123 @@
+package topidchart
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+)
+
+// keyframeInterval is the max number of records between two keyframes in delta mode.
+const keyframeInterval = 60
+
+var errNoKeyframe = errors.New("delta record dropped: no keyframe received")
+
+// deltaDecoder reconstructs full records from delta records.
+type deltaDecoder struct {
+	synced    bool
+	processes map[int]ProcessInfoV2
+}
+
+func newDeltaDecoder() *deltaDecoder {
+	return &deltaDecoder{processes: make(map[int]ProcessInfoV2)}
+}
+
+// decode reconstructs the record in place, the record is dropped with
+// errNoKeyframe if no keyframe has been received.
+func (dd *deltaDecoder) decode(record *RecordV2) error {
+	if record.Keyframe {
+		dd.synced = true
+		dd.processes = make(map[int]ProcessInfoV2, len(record.Processes))
+	}
+	if !dd.synced {
+		return errNoKeyframe
+	}
+
+	for _, pid := range record.Gone {
+		delete(dd.processes, pid)
+	}
+	for _, p := range record.Processes {
+		if p.Name == "" {
+			if name, ok := record.Names[p.Pid]; ok {
+				p.Name = name
+			} else {
+				p.Name = dd.processes[p.Pid].Name
+			}
+		}
+		dd.processes[p.Pid] = p
+	}
+
+	processes := make([]ProcessInfoV2, 0, len(dd.processes))
+	for _, p := range dd.processes {
+		processes = append(processes, p)
+	}
+	sort.Slice(processes, func(i, j int) bool { return processes[i].Pid < processes[j].Pid })
+
+	record.Processes = processes
+	record.Keyframe = false
+	record.Names = nil
+	record.Gone = nil
+	return nil
+}
+
+// DeltaEncoder turns full records into delta records for the sessions in delta mode.
+type DeltaEncoder struct {
+	interval  int
+	count     int
+	processes map[int]ProcessInfoV2
+}
+
+// NewDeltaEncoder creates a DeltaEncoder that makes a keyframe every interval records,
+// interval should be SessionResponseV2.KeyframeInterval.
+func NewDeltaEncoder(interval int) *DeltaEncoder {
+	if interval <= 0 {
+		interval = keyframeInterval
+	}
+	return &DeltaEncoder{interval: interval}
+}
+
+// Reset makes the next record a keyframe, it should be called when the
+// stream to the server is re-established.
+func (de *DeltaEncoder) Reset() {
+	de.processes = nil
+}
+
+// Encode returns the delta record of the full record r, r is not modified.
+func (de *DeltaEncoder) Encode(r *RecordV2) *RecordV2 {
+	delta := *r
+	if de.processes == nil || de.count%de.interval == 0 {
+		de.count = 0
+		delta.Keyframe = true
+	}
+	de.count++
+
+	last := de.processes
+	de.processes = make(map[int]ProcessInfoV2, len(r.Processes))
+	for _, p := range r.Processes {
+		de.processes[p.Pid] = p
+	}
+	if delta.Keyframe {
+		return &delta
+	}
+
+	delta.Processes = nil
+	for _, p := range r.Processes {
+		prev, ok := last[p.Pid]
+		if ok && reflect.DeepEqual(prev, p) {
+			continue
+		}
+		if !ok || prev.Name != p.Name {
+			if delta.Names == nil {
+				delta.Names = make(map[int]string)
+			}
+			delta.Names[p.Pid] = p.Name
+		}
+		p.Name = ""
+		delta.Processes = append(delta.Processes, p)
+	}
+	for pid := range last {
+		if _, ok := de.processes[pid]; !ok {
+			delta.Gone = append(delta.Gone, pid)
+		}
+	}
+	return &delta
+}
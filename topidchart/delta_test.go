@@ -0,0 +1,93 @@
+package topidchart
+
+import (
+	"reflect"
+	"testing"
+)
+
+func deltaFrames() [][]ProcessInfoV2 {
+	return [][]ProcessInfoV2{
+		{{Pid: 1, Name: "init", Ucpu: 1}, {Pid: 2, Name: "a", Ucpu: 2}},
+		{{Pid: 1, Name: "init", Ucpu: 1}, {Pid: 2, Name: "a", Ucpu: 3}},
+		{{Pid: 1, Name: "init", Ucpu: 1}, {Pid: 3, Name: "b", Mem: 100}},
+		{{Pid: 1, Name: "init", Ucpu: 2}, {Pid: 3, Name: "b2", Mem: 100}},
+		{},
+		{{Pid: 4, Name: "c"}},
+	}
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	for _, interval := range []int{1, 2, 4, 60} {
+		de := NewDeltaEncoder(interval)
+		dd := newDeltaDecoder()
+		for i, processes := range deltaFrames() {
+			r := &RecordV2{Timestamp: int64(i), Processes: processes}
+			delta := de.Encode(r)
+			if wantKey := i%interval == 0; delta.Keyframe != wantKey {
+				t.Errorf("interval %d record %d: got keyframe %v, want %v", interval, i, delta.Keyframe, wantKey)
+			}
+			if err := dd.decode(delta); err != nil {
+				t.Fatalf("interval %d record %d: %v", interval, i, err)
+			}
+			if len(processes) == 0 && len(delta.Processes) == 0 {
+				continue
+			}
+			if !reflect.DeepEqual(delta.Processes, processes) {
+				t.Errorf("interval %d record %d: got %v, want %v", interval, i, delta.Processes, processes)
+			}
+		}
+	}
+}
+
+func TestDeltaEncodeChanges(t *testing.T) {
+	de := NewDeltaEncoder(60)
+	frames := deltaFrames()
+	de.Encode(&RecordV2{Processes: frames[0]})
+
+	delta := de.Encode(&RecordV2{Processes: frames[1]})
+	if len(delta.Processes) != 1 || delta.Processes[0].Pid != 2 || delta.Processes[0].Name != "" {
+		t.Errorf("got %v, want only the changed pid 2 without name", delta.Processes)
+	}
+	if len(delta.Names) != 0 || len(delta.Gone) != 0 {
+		t.Errorf("got names %v gone %v, want none", delta.Names, delta.Gone)
+	}
+
+	delta = de.Encode(&RecordV2{Processes: frames[2]})
+	if !reflect.DeepEqual(delta.Gone, []int{2}) || delta.Names[3] != "b" {
+		t.Errorf("got names %v gone %v, want name of 3 and 2 gone", delta.Names, delta.Gone)
+	}
+
+	delta = de.Encode(&RecordV2{Processes: frames[3]})
+	if delta.Names[3] != "b2" {
+		t.Errorf("got names %v, want the new name of 3", delta.Names)
+	}
+}
+
+func TestDeltaDecodeNoKeyframe(t *testing.T) {
+	de := NewDeltaEncoder(3)
+	dd := newDeltaDecoder()
+	frames := deltaFrames()
+	for i, processes := range frames {
+		delta := de.Encode(&RecordV2{Processes: processes})
+		if i == 0 {
+			// the keyframe is lost
+			continue
+		}
+		err := dd.decode(delta)
+		switch {
+		case i < 3 && err != errNoKeyframe:
+			t.Errorf("record %d: got %v, want errNoKeyframe", i, err)
+		case i >= 3 && err != nil:
+			t.Errorf("record %d: got %v after the keyframe", i, err)
+		}
+	}
+}
+
+func TestDeltaEncoderReset(t *testing.T) {
+	de := NewDeltaEncoder(60)
+	de.Encode(&RecordV2{Processes: deltaFrames()[0]})
+	de.Reset()
+	if delta := de.Encode(&RecordV2{Processes: deltaFrames()[1]}); !delta.Keyframe {
+		t.Error("got a delta record after Reset, want a keyframe")
+	}
+}
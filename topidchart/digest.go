@@ -0,0 +1,626 @@
+package topidchart
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/godevsig/glib/sys/log"
+)
+
+// DigestPeriod is how often the digests are generated.
+type DigestPeriod int
+
+// Digest periods, the daily digests start at local midnight and the weekly ones on Monday.
+const (
+	DigestNone DigestPeriod = iota // no digest
+	DigestDaily
+	DigestWeekly
+)
+
+// ParseDigestPeriod returns the period of the name: none, daily or weekly.
+func ParseDigestPeriod(name string) (DigestPeriod, error) {
+	switch name {
+	case "", "none":
+		return DigestNone, nil
+	case "daily":
+		return DigestDaily, nil
+	case "weekly":
+		return DigestWeekly, nil
+	}
+	return DigestNone, fmt.Errorf("unknown digest period %q", name)
+}
+
+func (p DigestPeriod) String() string {
+	switch p {
+	case DigestDaily:
+		return "daily"
+	case DigestWeekly:
+		return "weekly"
+	}
+	return "none"
+}
+
+// DigestConfig is the config of the periodic digests of the tags.
+type DigestConfig struct {
+	Period   DigestPeriod
+	Top      int     // number of the top consumers listed, DefaultDigestTop if 0
+	AlertCPU float32 // CPU usage in percent of one core a process alerts above, 0 disables
+	AlertMEM float32 // MEM usage in MB a process alerts above, 0 disables
+	Webhook  string  // optional URL the JSON digests are posted to
+	SMTP     SMTPConfig
+}
+
+// SMTPConfig is the optional mail sink of the digests, disabled if Addr is empty.
+type SMTPConfig struct {
+	Addr     string // host:port of the SMTP server
+	From     string
+	To       []string
+	Username string // PLAIN auth is used if set
+	Password string
+}
+
+const (
+	// DefaultDigestTop is the default number of the top consumers in the digests.
+	DefaultDigestTop = 10
+	// alertSamples is the number of consecutive samples above the threshold to fire an alert.
+	alertSamples = 3
+	// leakMinSamples is the min number of samples to detect memory leak of a process.
+	leakMinSamples = 10
+	// leakMinCorrelation is the min correlation of the memory growth and the time of a leak.
+	leakMinCorrelation = 0.9
+	// regressionRatio is the min increase of a consumer over the previous period to be a regression.
+	regressionRatio = 1.2
+	// sinkTimeout is the timeout of sending a digest to the webhook.
+	sinkTimeout = 10 * time.Second
+)
+
+// digest is the summary of the sessions of a tag in a period.
+type digest struct {
+	Tag         string
+	Period      string
+	From        time.Time
+	To          time.Time
+	Sessions    []digestSession
+	TopCPU      []digestConsumer // sorted by avg CPU
+	TopMEM      []digestConsumer // sorted by max MEM
+	Alerts      []digestAlert
+	Leaks       []digestLeak
+	Regressions []digestRegression // compared to the previous period
+}
+
+type digestSession struct {
+	Session  string
+	Host     string
+	Start    time.Time
+	Duration int64 // in seconds, 0 if unknown
+	URL      string
+}
+
+// digestConsumer is the usage of the processes of the same name in all the sessions.
+type digestConsumer struct {
+	Name     string
+	CPUAvg   float32 // in percent of one core
+	CPUMax   float32
+	MEMAvg   float32 // in MB
+	MEMMax   float32
+	Sessions int
+
+	samples int
+}
+
+type digestAlert struct {
+	Session   string
+	Process   string // empty for outages
+	Kind      string // cpu, mem or outage
+	Time      time.Time
+	Duration  int64 // in seconds
+	Peak      float32
+	Threshold float32
+}
+
+type digestLeak struct {
+	Session string
+	Process string
+	From    float32 // in MB
+	To      float32
+	Rate    float32 // in MB per hour
+}
+
+type digestRegression struct {
+	Process  string
+	Metric   string // cpu avg or mem max
+	Previous float32
+	Current  float32
+	Change   float32 // in percent
+}
+
+const digestTpl = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="UTF-8">
+	<title>{{.Period}} digest of {{.Tag}}</title>
+	<style>
+		body { font: 14px Sans-Serif; color: #333; margin: 20px; }
+		table { border-collapse: collapse; margin-bottom: 10px; }
+		th, td { text-align: left; padding: 4px 12px; border-bottom: 1px solid #ddd; }
+		th { background: #eee; }
+		a { color: #2980B9; text-decoration: none; }
+	</style>
+</head>
+<body>
+<h2>{{.Period}} digest of {{.Tag}}</h2>
+<p>{{.From.Format "2006-01-02 15:04"}} to {{.To.Format "2006-01-02 15:04"}}</p>
+<h3>{{len .Sessions}} session(s)</h3>
+<table>
+	<tr><th>Session</th><th>Host</th><th>Started</th><th>Duration</th></tr>
+	{{- range .Sessions}}
+	<tr><td><a href="{{.URL}}">{{.Session}}</a></td><td>{{.Host}}</td><td>{{.Start.Format "2006-01-02 15:04:05"}}</td><td>{{seconds .Duration}}</td></tr>
+	{{- end}}
+</table>
+<h3>Top CPU consumers</h3>
+{{template "consumers" .TopCPU}}
+<h3>Top MEM consumers</h3>
+{{template "consumers" .TopMEM}}
+<h3>{{len .Alerts}} alert(s)</h3>
+{{- if .Alerts}}
+<table>
+	<tr><th>Time</th><th>Session</th><th>Process</th><th>Alert</th><th>Duration</th><th>Peak</th></tr>
+	{{- range .Alerts}}
+	<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Session}}</td><td>{{.Process}}</td>
+		<td>{{if eq .Kind "outage"}}outage{{else}}{{.Kind}} above {{printf "%.0f" .Threshold}}{{end}}</td>
+		<td>{{seconds .Duration}}</td><td>{{if ne .Kind "outage"}}{{printf "%.2f" .Peak}}{{end}}</td></tr>
+	{{- end}}
+</table>
+{{- end}}
+<h3>{{len .Leaks}} suspected leak(s)</h3>
+{{- if .Leaks}}
+<table>
+	<tr><th>Session</th><th>Process</th><th>MEM from (MB)</th><th>MEM to (MB)</th><th>MB per hour</th></tr>
+	{{- range .Leaks}}
+	<tr><td>{{.Session}}</td><td>{{.Process}}</td><td>{{printf "%.2f" .From}}</td><td>{{printf "%.2f" .To}}</td><td>{{printf "%.2f" .Rate}}</td></tr>
+	{{- end}}
+</table>
+{{- end}}
+<h3>{{len .Regressions}} regression(s) over the previous period</h3>
+{{- if .Regressions}}
+<table>
+	<tr><th>Process</th><th>Metric</th><th>Previous</th><th>Current</th><th>Change</th></tr>
+	{{- range .Regressions}}
+	<tr><td>{{.Process}}</td><td>{{.Metric}}</td><td>{{printf "%.2f" .Previous}}</td><td>{{printf "%.2f" .Current}}</td><td>+{{printf "%.0f" .Change}}%</td></tr>
+	{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+{{define "consumers"}}
+<table>
+	<tr><th>Process</th><th>CPU avg</th><th>CPU max</th><th>MEM avg (MB)</th><th>MEM max (MB)</th><th>Sessions</th></tr>
+	{{- range .}}
+	<tr><td>{{.Name}}</td><td>{{printf "%.2f" .CPUAvg}}</td><td>{{printf "%.2f" .CPUMax}}</td><td>{{printf "%.2f" .MEMAvg}}</td><td>{{printf "%.2f" .MEMMax}}</td><td>{{.Sessions}}</td></tr>
+	{{- end}}
+</table>
+{{- end}}
+`
+
+var digestTmpl = template.Must(template.New("digest").Funcs(template.FuncMap{
+	"seconds": func(s int64) time.Duration { return time.Duration(s) * time.Second },
+}).Parse(digestTpl))
+
+// digester generates the digests of all the tags at the end of each period.
+type digester struct {
+	lg   *log.Logger
+	dir  string
+	base string // URL of the chart server
+	cfg  DigestConfig
+	done chan struct{}
+}
+
+func newDigester(lg *log.Logger, dir, base string, cfg DigestConfig) *digester {
+	if cfg.Top <= 0 {
+		cfg.Top = DefaultDigestTop
+	}
+	return &digester{lg: lg, dir: dir, base: base, cfg: cfg, done: make(chan struct{})}
+}
+
+// periodStart returns the start of the period t is in.
+func (d *digester) periodStart(t time.Time) time.Time {
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if d.cfg.Period == DigestWeekly {
+		start = start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+	}
+	return start
+}
+
+// shift returns the start of the period n periods after the one started at start.
+func (d *digester) shift(start time.Time, n int) time.Time {
+	if d.cfg.Period == DigestWeekly {
+		return start.AddDate(0, 0, 7*n)
+	}
+	return start.AddDate(0, 0, n)
+}
+
+// run generates the digests of the last period if missing, then the ones of
+// each period when it ends until stop is called.
+func (d *digester) run() {
+	d.lg.Infof("%v digests enabled", d.cfg.Period)
+	for {
+		end := d.periodStart(time.Now())
+		d.generate(d.shift(end, -1), end)
+
+		// a bit after the end to be sure it is in the next period
+		timer := time.NewTimer(time.Until(d.shift(end, 1)) + time.Second)
+		select {
+		case <-timer.C:
+		case <-d.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (d *digester) stop() {
+	close(d.done)
+}
+
+func (d *digester) filename(tag string, from time.Time, ext string) string {
+	return filepath.Join(d.dir, tag, fmt.Sprintf("digest-%v-%v.%v", d.cfg.Period, from.Format("20060102"), ext))
+}
+
+// generate writes the digests of the tags with sessions in the period,
+// the tags already having the digest of the period are skipped.
+func (d *digester) generate(from, to time.Time) {
+	tags := make(map[string][]historyEntry)
+	for _, e := range loadHistory(d.dir) {
+		tags[e.Tag] = append(tags[e.Tag], e)
+	}
+	for tag, entries := range tags {
+		if _, err := os.Stat(d.filename(tag, from, "json")); err == nil {
+			continue
+		}
+		dg := d.build(tag, entries, from, to)
+		if len(dg.Sessions) == 0 {
+			continue
+		}
+		if err := d.write(dg); err != nil {
+			d.lg.Errorf("write digest of tag %v: %v", tag, err)
+			continue
+		}
+		d.lg.Infof("%v digest of tag %v generated with %d session(s)", d.cfg.Period, tag, len(dg.Sessions))
+		d.send(dg)
+	}
+}
+
+// overlaps returns the sessions of entries ran in the period.
+func overlaps(entries []historyEntry, from, to time.Time) []historyEntry {
+	var ret []historyEntry
+	for _, e := range entries {
+		if e.Start.Before(to) && !e.Start.Add(e.Duration).Before(from) {
+			ret = append(ret, e)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Start.Before(ret[j].Start) })
+	return ret
+}
+
+// build returns the digest of the sessions of the tag in the period.
+func (d *digester) build(tag string, entries []historyEntry, from, to time.Time) *digest {
+	dg := &digest{Tag: tag, Period: d.cfg.Period.String(), From: from, To: to}
+	consumers := make(map[string]*digestConsumer)
+	for _, e := range overlaps(entries, from, to) {
+		dg.Sessions = append(dg.Sessions, digestSession{
+			Session:  e.Session,
+			Host:     e.Host,
+			Start:    e.Start,
+			Duration: int64(e.Duration / time.Second),
+			URL:      fmt.Sprintf("%s/%s/%s", d.base, tag, e.Session),
+		})
+		d.analyzeSession(dg, consumers, e, from, to)
+	}
+
+	dg.TopCPU = topConsumers(consumers, d.cfg.Top, func(c *digestConsumer) float32 { return c.CPUAvg })
+	dg.TopMEM = topConsumers(consumers, d.cfg.Top, func(c *digestConsumer) float32 { return c.MEMMax })
+	sort.SliceStable(dg.Alerts, func(i, j int) bool { return dg.Alerts[i].Time.Before(dg.Alerts[j].Time) })
+	sort.SliceStable(dg.Leaks, func(i, j int) bool { return dg.Leaks[i].Rate > dg.Leaks[j].Rate })
+
+	if len(consumers) != 0 {
+		prevFrom := d.shift(from, -1)
+		previous := make(map[string]*digestConsumer)
+		prev := &digest{}
+		for _, e := range overlaps(entries, prevFrom, from) {
+			d.analyzeSession(prev, previous, e, prevFrom, from)
+		}
+		dg.Regressions = regressions(previous, consumers)
+	}
+	return dg
+}
+
+// analyzeSession adds the usage, alerts and leaks of the records of the session in the period.
+func (d *digester) analyzeSession(dg *digest, consumers map[string]*digestConsumer, e historyEntry, from, to time.Time) {
+	byName := newRecords()
+	byProcess := newRecords()
+	filename := fmt.Sprintf("%v/%v/process-%v.data", d.dir, e.Tag, e.Session)
+	err := walkRecords(filename, func(r *pRecord) bool {
+		if r.Timestamp < from.Unix() {
+			return true
+		}
+		if r.Timestamp >= to.Unix() {
+			return false
+		}
+		byProcess.add(r, "", "")
+		byName.add(r, "", groupByName)
+		return true
+	})
+	if err != nil {
+		d.lg.Warnf("digest of session %v/%v: %v", e.Tag, e.Session, err)
+	}
+	if meta, err := loadMeta(d.dir, e.Tag, e.Session); err == nil {
+		for _, g := range meta.Gaps {
+			if g.To > from.Unix() && g.From < to.Unix() {
+				dg.Alerts = append(dg.Alerts, digestAlert{Session: e.Session, Kind: "outage",
+					Time: time.Unix(g.From, 0), Duration: g.To - g.From})
+			}
+		}
+	}
+	if len(byName.stamps) == 0 {
+		return
+	}
+
+	byName.applyFilter(&filter{})
+	samples := len(byName.stamps)
+	names := make(map[string]bool)
+	for k := range byName.cpuavg {
+		names[k] = true
+	}
+	for k := range byName.memavg {
+		names[k] = true
+	}
+	for k := range names {
+		c := consumers[k]
+		if c == nil {
+			c = &digestConsumer{Name: k}
+			consumers[k] = c
+		}
+		// the averages are weighted by the samples of each session
+		total := float32(c.samples + samples)
+		c.CPUAvg = (c.CPUAvg*float32(c.samples) + byName.cpuavg[k]*float32(samples)) / total
+		c.MEMAvg = (c.MEMAvg*float32(c.samples) + byName.memavg[k]*float32(samples)) / total
+		if byName.cpumax[k] > c.CPUMax {
+			c.CPUMax = byName.cpumax[k]
+		}
+		if byName.memmax[k] > c.MEMMax {
+			c.MEMMax = byName.memmax[k]
+		}
+		c.samples += samples
+		c.Sessions++
+	}
+
+	byProcess.applyFilter(&filter{})
+	dg.Alerts = append(dg.Alerts, byProcess.alerts(e.Session, "cpu", byProcess.cpu, d.cfg.AlertCPU)...)
+	dg.Alerts = append(dg.Alerts, byProcess.alerts(e.Session, "mem", byProcess.mem, d.cfg.AlertMEM)...)
+	for k, v := range byProcess.mem {
+		if leak := byProcess.leak(v); leak != nil {
+			leak.Session = e.Session
+			leak.Process = k
+			dg.Leaks = append(dg.Leaks, *leak)
+		}
+	}
+}
+
+// alerts returns an alert for each time the series stay above the threshold for alertSamples.
+func (prs *processRecords) alerts(session, kind string, series map[string][]float32, threshold float32) []digestAlert {
+	if threshold <= 0 {
+		return nil
+	}
+	var alerts []digestAlert
+	for k, v := range series {
+		start := -1
+		var peak float32
+		for i := 0; i <= len(v); i++ {
+			if i < len(v) && v[i] > threshold {
+				if start < 0 {
+					start, peak = i, 0
+				}
+				if v[i] > peak {
+					peak = v[i]
+				}
+				continue
+			}
+			if start >= 0 && i-start >= alertSamples {
+				alerts = append(alerts, digestAlert{Session: session, Process: k, Kind: kind,
+					Time: time.Unix(prs.stamps[start], 0), Duration: prs.stamps[i-1] - prs.stamps[start],
+					Peak: peak, Threshold: threshold})
+			}
+			start = -1
+		}
+	}
+	return alerts
+}
+
+// leak returns the leak if the memory of the process grows steadily while it is alive,
+// by at least memavgThreshold MB and 10 percent, nil otherwise.
+func (prs *processRecords) leak(v []float32) *digestLeak {
+	first, last := -1, -1
+	for i, m := range v {
+		if m != 0 {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first < 0 || last-first+1 < leakMinSamples {
+		return nil
+	}
+
+	// least squares fit of the memory over the time
+	var n, sx, sy, sxx, syy, sxy float64
+	for i := first; i <= last; i++ {
+		x := float64(prs.stamps[i] - prs.stamps[first])
+		y := float64(v[i])
+		n++
+		sx += x
+		sy += y
+		sxx += x * x
+		syy += y * y
+		sxy += x * y
+	}
+	dx := n*sxx - sx*sx
+	dy := n*syy - sy*sy
+	if dx <= 0 || dy <= 0 {
+		return nil
+	}
+	slope := (n*sxy - sx*sy) / dx
+	r := (n*sxy - sx*sy) / math.Sqrt(dx*dy)
+	growth := slope * float64(prs.stamps[last]-prs.stamps[first])
+	if r < leakMinCorrelation || growth < memavgThreshold || growth < 0.1*float64(v[first]) {
+		return nil
+	}
+	return &digestLeak{From: v[first], To: v[last], Rate: float32(slope * 3600)}
+}
+
+// topConsumers returns the top n consumers by the value.
+func topConsumers(consumers map[string]*digestConsumer, n int, value func(c *digestConsumer) float32) []digestConsumer {
+	l := make([]digestConsumer, 0, len(consumers))
+	for _, c := range consumers {
+		l = append(l, *c)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if value(&l[i]) != value(&l[j]) {
+			return value(&l[i]) > value(&l[j])
+		}
+		return l[i].Name < l[j].Name
+	})
+	if len(l) > n {
+		l = l[:n]
+	}
+	return l
+}
+
+// regressions returns the consumers whose avg CPU or max MEM increased by regressionRatio
+// and at least the default avg thresholds over the previous period.
+func regressions(previous, current map[string]*digestConsumer) []digestRegression {
+	var ret []digestRegression
+	check := func(name, metric string, prev, cur, min float32) {
+		if prev > 0 && cur >= prev*regressionRatio && cur-prev >= min {
+			ret = append(ret, digestRegression{Process: name, Metric: metric,
+				Previous: prev, Current: cur, Change: (cur - prev) / prev * 100})
+		}
+	}
+	for name, c := range current {
+		p := previous[name]
+		if p == nil {
+			continue
+		}
+		check(name, "cpu avg", p.CPUAvg, c.CPUAvg, cpuavgThreshold)
+		check(name, "mem max", p.MEMMax, c.MEMMax, memavgThreshold)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Change > ret[j].Change })
+	return ret
+}
+
+// write writes the digest in JSON and HTML into the directory of the tag, the JSON
+// is written last since it marks the digest of the period generated.
+func (d *digester) write(dg *digest) error {
+	var html bytes.Buffer
+	if err := digestTmpl.Execute(&html, dg); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(dg, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(d.filename(dg.Tag, dg.From, "html"), html.Bytes()); err != nil {
+		return err
+	}
+	return writeFileAtomic(d.filename(dg.Tag, dg.From, "json"), data)
+}
+
+// writeFileAtomic writes the data to a temp file then renames it,
+// so readers never see a partially written file.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".digest-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// send sends the digest to the configured sinks, the failures are only logged.
+func (d *digester) send(dg *digest) {
+	if d.cfg.Webhook != "" {
+		if err := d.postWebhook(dg); err != nil {
+			d.lg.Warnf("send digest of tag %v to webhook: %v", dg.Tag, err)
+		}
+	}
+	if d.cfg.SMTP.Addr != "" {
+		if err := d.sendMail(dg); err != nil {
+			d.lg.Warnf("send digest of tag %v by mail: %v", dg.Tag, err)
+		}
+	}
+}
+
+func (d *digester) postWebhook(dg *digest) error {
+	data, err := json.Marshal(dg)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: sinkTimeout}
+	resp, err := client.Post(d.cfg.Webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %v", resp.Status)
+	}
+	return nil
+}
+
+func (d *digester) sendMail(dg *digest) error {
+	cfg := d.cfg.SMTP
+	if len(cfg.To) == 0 {
+		return fmt.Errorf("no recipient")
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: topid %v digest of %v from %v\r\n", dg.Period, dg.Tag, dg.From.Format("2006-01-02"))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/html; charset=UTF-8\r\n\r\n")
+	if err := digestTmpl.Execute(&msg, dg); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		host := cfg.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+	return smtp.SendMail(cfg.Addr, auth, cfg.From, cfg.To, msg.Bytes())
+}
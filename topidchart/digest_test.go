@@ -0,0 +1,174 @@
+package topidchart
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigestPeriod(t *testing.T) {
+	locs := []*time.Location{time.UTC}
+	// the week the DST ends
+	if loc, err := time.LoadLocation("Europe/Berlin"); err == nil {
+		locs = append(locs, loc)
+	}
+	for _, loc := range locs {
+		date := func(year int, month time.Month, day, hour int) time.Time {
+			return time.Date(year, month, day, hour, 0, 0, 0, loc)
+		}
+		cases := []struct {
+			period     DigestPeriod
+			t          time.Time
+			start      time.Time
+			prev, next time.Time
+		}{
+			{DigestDaily, date(2026, 12, 31, 23), date(2026, 12, 31, 0), date(2026, 12, 30, 0), date(2027, 1, 1, 0)},
+			{DigestDaily, date(2026, 10, 25, 12), date(2026, 10, 25, 0), date(2026, 10, 24, 0), date(2026, 10, 26, 0)},
+			{DigestWeekly, date(2026, 10, 19, 0), date(2026, 10, 19, 0), date(2026, 10, 12, 0), date(2026, 10, 26, 0)},
+			{DigestWeekly, date(2026, 10, 25, 23), date(2026, 10, 19, 0), date(2026, 10, 12, 0), date(2026, 10, 26, 0)},
+			{DigestWeekly, date(2026, 12, 30, 12), date(2026, 12, 28, 0), date(2026, 12, 21, 0), date(2027, 1, 4, 0)},
+			{DigestWeekly, date(2027, 1, 3, 23), date(2026, 12, 28, 0), date(2026, 12, 21, 0), date(2027, 1, 4, 0)},
+		}
+		for _, c := range cases {
+			d := newDigester(testLogger, "", "", DigestConfig{Period: c.period})
+			start := d.periodStart(c.t)
+			if !start.Equal(c.start) {
+				t.Errorf("%v %v: start %v, want %v", c.period, c.t, start, c.start)
+			}
+			if prev := d.shift(start, -1); !prev.Equal(c.prev) {
+				t.Errorf("%v %v: previous %v, want %v", c.period, c.t, prev, c.prev)
+			}
+			if next := d.shift(start, 1); !next.Equal(c.next) {
+				t.Errorf("%v %v: next %v, want %v", c.period, c.t, next, c.next)
+			}
+		}
+	}
+}
+
+// fakeSMTP serves the SMTP sessions on a local port and returns its address
+// and the data of the mails received.
+func fakeSMTP(t *testing.T) (string, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	mails := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tp := textproto.NewConn(conn)
+				tp.PrintfLine("220 localhost ESMTP")
+				for {
+					line, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+					case "EHLO", "HELO", "MAIL", "RCPT":
+						tp.PrintfLine("250 OK")
+					case "DATA":
+						tp.PrintfLine("354 go ahead")
+						data, err := tp.ReadDotBytes()
+						if err != nil {
+							return
+						}
+						mails <- string(data)
+						tp.PrintfLine("250 OK")
+					case "QUIT":
+						tp.PrintfLine("221 bye")
+						return
+					default:
+						tp.PrintfLine("502 %s not implemented", cmd)
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), mails
+}
+
+func TestDigestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	from := time.Date(2026, 10, 12, 0, 0, 0, 0, time.Local)
+	var records []*RecordV2
+	for i, cpu := range []float32{10, 80, 90, 85, 10} {
+		records = append(records, &RecordV2{
+			Timestamp: from.Add(time.Hour).Unix() + int64(i)*60,
+			Processes: []ProcessInfoV2{{Pid: 1, Name: "app", Ucpu: cpu, Mem: 1 << 20}},
+		})
+	}
+	id := writeSession(t, dir, "board1", nil, records...)
+	// out of the period
+	writeSession(t, dir, "board2", nil, &RecordV2{Timestamp: from.Add(-time.Hour).Unix(), Processes: records[0].Processes})
+
+	posted := make(chan *digest, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var dg digest
+		if err := json.NewDecoder(r.Body).Decode(&dg); err != nil {
+			t.Error(err)
+		}
+		posted <- &dg
+	}))
+	defer webhook.Close()
+	addr, mails := fakeSMTP(t)
+
+	d := newDigester(testLogger, dir, "http://host:9998", DigestConfig{
+		Period:   DigestDaily,
+		AlertCPU: 50,
+		Webhook:  webhook.URL,
+		SMTP:     SMTPConfig{Addr: addr, From: "topid@host", To: []string{"dev@host"}},
+	})
+	d.generate(from, d.shift(from, 1))
+
+	for _, ext := range []string{"json", "html"} {
+		if _, err := os.Stat(d.filename("board1", from, ext)); err != nil {
+			t.Error(err)
+		}
+		if _, err := os.Stat(d.filename("board2", from, ext)); err == nil {
+			t.Errorf("%s digest generated for the tag without sessions in the period", ext)
+		}
+	}
+
+	select {
+	case dg := <-posted:
+		if dg.Tag != "board1" || len(dg.Sessions) != 1 || dg.Sessions[0].URL != "http://host:9998/board1/"+id {
+			t.Errorf("got sessions %+v", dg.Sessions)
+		}
+		if len(dg.TopCPU) != 1 || dg.TopCPU[0].Name != "app" || dg.TopCPU[0].CPUMax != 90 {
+			t.Errorf("got top CPU %+v", dg.TopCPU)
+		}
+		if len(dg.Alerts) != 1 || dg.Alerts[0].Kind != "cpu" || dg.Alerts[0].Peak != 90 || dg.Alerts[0].Duration != 120 {
+			t.Errorf("got alerts %+v", dg.Alerts)
+		}
+	default:
+		t.Error("digest not posted to the webhook")
+	}
+	select {
+	case mail := <-mails:
+		for _, want := range []string{"To: dev@host\n", "Subject: topid daily digest of board1 from 2026-10-12\n", "<h2>daily digest of board1</h2>"} {
+			if !strings.Contains(mail, want) {
+				t.Errorf("%q not in the mail:\n%s", want, mail)
+			}
+		}
+	default:
+		t.Error("digest not mailed")
+	}
+
+	// the digest of the period exists
+	d.generate(from, d.shift(from, 1))
+	if len(posted) != 0 || len(mails) != 0 {
+		t.Error("existing digest generated again")
+	}
+}
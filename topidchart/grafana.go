@@ -0,0 +1,277 @@
+package topidchart
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The grafana API serves the series of a session to the Grafana JSON/SimpleJSON datasource.
+// The targets are in the form of <metric>:<kind>:<name>, metric is cpu or mem,
+// kind is process for the series of a process, group for the sum of the
+// processes with the same name, or container for the sum of the processes in the container.
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// contains reports whether ts in unix time is in the range, the zero range contains all.
+func (gr *grafanaRange) contains(ts int64) bool {
+	if !gr.From.IsZero() && ts < gr.From.Unix() {
+		return false
+	}
+	if !gr.To.IsZero() && ts > gr.To.Unix() {
+		return false
+	}
+	return true
+}
+
+type grafanaSearch struct {
+	Target string `json:"target"`
+}
+
+type grafanaTarget struct {
+	Target string `json:"target"`
+	Type   string `json:"type"`
+}
+
+type grafanaQuery struct {
+	Range         grafanaRange    `json:"range"`
+	Targets       []grafanaTarget `json:"targets"`
+	MaxDataPoints int             `json:"maxDataPoints"`
+}
+
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"` // [value, unix time in ms]
+}
+
+type grafanaAnnotationQuery struct {
+	Range      grafanaRange           `json:"range"`
+	Annotation map[string]interface{} `json:"annotation"`
+}
+
+type grafanaAnnotation struct {
+	Annotation map[string]interface{} `json:"annotation"`
+	Time       int64                  `json:"time"`
+	TimeEnd    int64                  `json:"timeEnd,omitempty"`
+	Title      string                 `json:"title"`
+	Text       string                 `json:"text,omitempty"`
+	Tags       []string               `json:"tags,omitempty"`
+}
+
+// grafanaValues returns the values of the targets in the record.
+func grafanaValues(rec *pRecord) map[string]float64 {
+	values := make(map[string]float64, 4*len(rec.Processes))
+	for _, p := range rec.Processes {
+		cpu := float64(floatConv(p.Ucpu + p.Scpu))
+		mem := float64(p.Mem) / 1024
+		name := seriesName(p)
+		values["cpu:process:"+name] += cpu
+		values["mem:process:"+name] += mem
+		values["cpu:group:"+p.Name] += cpu
+		values["mem:group:"+p.Name] += mem
+		if ctr := containerName(&p); ctr != "" {
+			values["cpu:container:"+ctr] += cpu
+			values["mem:container:"+ctr] += mem
+		}
+	}
+	return values
+}
+
+// grafanaSession returns the session of the request,
+// the session named latest is the last updated session of the tag.
+func (cs *chartServer) grafanaSession(r *http.Request) (tag, session string) {
+	params := mux.Vars(r)
+	tag, session = params["tag"], params["session"]
+	if session != "latest" {
+		return
+	}
+
+	files, _ := filepath.Glob(filepath.Join(cs.dir, tag, "process-*.data"))
+	var last time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil || fi.ModTime().Before(last) {
+			continue
+		}
+		last = fi.ModTime()
+		session = strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), "process-"), ".data")
+	}
+	return
+}
+
+func (cs *chartServer) grafanaFile(r *http.Request) string {
+	tag, session := cs.grafanaSession(r)
+	return fmt.Sprintf("%v/%v/process-%v.data", cs.dir, tag, session)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+// grafanaCORS allows the browser access mode of the datasource.
+func grafanaCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "accept, content-type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		if r.Method == http.MethodOptions {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// grafanaTestHandler is called by Grafana to test the datasource.
+func (cs *chartServer) grafanaTestHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := os.Stat(cs.grafanaFile(r)); err != nil {
+		http.Error(w, "Session not found.", 404)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+func (cs *chartServer) grafanaSearchHandler(w http.ResponseWriter, r *http.Request) {
+	var req grafanaSearch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	found := make(map[string]bool)
+	err := walkRecords(cs.grafanaFile(r), func(rec *pRecord) bool {
+		for target := range grafanaValues(rec) {
+			found[target] = true
+		}
+		return true
+	})
+	if err != nil && len(found) == 0 {
+		http.Error(w, "Session not found.", 404)
+		return
+	}
+
+	targets := make([]string, 0, len(found))
+	for target := range found {
+		if strings.Contains(target, req.Target) {
+			targets = append(targets, target)
+		}
+	}
+	sort.Strings(targets)
+	if err := writeJSON(w, targets); err != nil {
+		cs.lg.Errorln(err)
+	}
+}
+
+// downsample averages the datapoints into at most max points.
+func downsample(points [][2]float64, max int) [][2]float64 {
+	if max <= 0 || len(points) <= max {
+		return points
+	}
+	step := (len(points) + max - 1) / max
+	out := make([][2]float64, 0, max)
+	for i := 0; i < len(points); i += step {
+		end := i + step
+		if end > len(points) {
+			end = len(points)
+		}
+		var sum float64
+		for _, p := range points[i:end] {
+			sum += p[0]
+		}
+		out = append(out, [2]float64{sum / float64(end-i), points[i][1]})
+	}
+	return out
+}
+
+func (cs *chartServer) grafanaQueryHandler(w http.ResponseWriter, r *http.Request) {
+	var req grafanaQuery
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	series := make([]grafanaSeries, len(req.Targets))
+	for i, t := range req.Targets {
+		series[i].Target = t.Target
+		series[i].Datapoints = [][2]float64{}
+	}
+	err := walkRecords(cs.grafanaFile(r), func(rec *pRecord) bool {
+		if !req.Range.contains(rec.Timestamp) {
+			return true
+		}
+		values := grafanaValues(rec)
+		ms := float64(rec.Timestamp * 1000)
+		for i := range series {
+			// a process not in the record has no usage
+			series[i].Datapoints = append(series[i].Datapoints, [2]float64{values[series[i].Target], ms})
+		}
+		return true
+	})
+	if err != nil {
+		cs.lg.Errorln(err)
+	}
+
+	for i := range series {
+		series[i].Datapoints = downsample(series[i].Datapoints, req.MaxDataPoints)
+	}
+	if err := writeJSON(w, series); err != nil {
+		cs.lg.Errorln(err)
+	}
+}
+
+// grafanaAnnotationsHandler returns the start, end and outages of the session, or
+// the snapshots if the query of the annotation is snapshot.
+func (cs *chartServer) grafanaAnnotationsHandler(w http.ResponseWriter, r *http.Request) {
+	var req grafanaAnnotationQuery
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tag, session := cs.grafanaSession(r)
+
+	annotations := []grafanaAnnotation{}
+	add := func(a grafanaAnnotation) {
+		if req.Range.contains(a.Time/1000) || (a.TimeEnd != 0 && req.Range.contains(a.TimeEnd/1000)) {
+			a.Annotation = req.Annotation
+			annotations = append(annotations, a)
+		}
+	}
+
+	if query, _ := req.Annotation["query"].(string); query == "snapshot" {
+		snapshots, err := loadSnapshots(fmt.Sprintf("%v/%v/snapshot-%v.data", cs.dir, tag, session))
+		if err != nil {
+			cs.lg.Errorln(err)
+		}
+		for _, s := range snapshots {
+			add(grafanaAnnotation{
+				Time:  s.Timestamp * 1000,
+				Title: "snapshot",
+				Text:  fmt.Sprintf(`<a href="http://%s:%s/%s/%s/snapshot?at=%d">%s</a>`, cs.ip, cs.chartport, tag, session, s.Timestamp, time.Unix(s.Timestamp, 0).Format("15:04:05")),
+				Tags:  []string{"snapshot"},
+			})
+		}
+	} else if meta, err := loadMeta(cs.dir, tag, session); err == nil {
+		add(grafanaAnnotation{Time: meta.Start * 1000, Title: "session started", Tags: []string{"session"}})
+		if meta.End != 0 {
+			add(grafanaAnnotation{Time: meta.End * 1000, Title: "session ended", Tags: []string{"session"}})
+		}
+		for _, g := range meta.Gaps {
+			add(grafanaAnnotation{Time: g.From * 1000, TimeEnd: g.To * 1000, Title: "outage", Tags: []string{"outage"}})
+		}
+	}
+
+	if err := writeJSON(w, annotations); err != nil {
+		cs.lg.Errorln(err)
+	}
+}
@@ -0,0 +1,171 @@
+package topidchart
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const grafanaContainer = "0123456789abcdef0123456789abcdef"
+
+func newGrafanaServer(t *testing.T) (*httptest.Server, string) {
+	dir := t.TempDir()
+	proc := func(cpu float32) []ProcessInfoV2 {
+		return []ProcessInfoV2{
+			{Pid: 1, Name: "app", Ucpu: cpu, Mem: 1024},
+			{Pid: 2, Name: "db", Ucpu: 1, Scpu: 1, Mem: 2048, ContainerID: grafanaContainer},
+		}
+	}
+	id := writeSession(t, dir, "board1", []gap{{From: 1012, To: 1015}},
+		&RecordV2{Timestamp: 1000, Processes: proc(10)},
+		&RecordV2{Timestamp: 1010, Processes: proc(20), Snapshot: "ps"},
+		&RecordV2{Timestamp: 1020, Processes: proc(30)},
+	)
+	cs := &chartServer{ip: "host", chartport: "9998", dir: dir, lg: testLogger}
+	srv := httptest.NewServer(cs.router())
+	t.Cleanup(srv.Close)
+	return srv, id
+}
+
+// grafanaPost posts the JSON body to the API of the session and decodes the reply into v.
+func grafanaPost(t *testing.T, srv *httptest.Server, session, api, body string, v interface{}) int {
+	resp, err := http.Post(fmt.Sprintf("%s/grafana/board1/%s/%s", srv.URL, session, api), "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestGrafanaTestPage(t *testing.T) {
+	srv, id := newGrafanaServer(t)
+	for session, want := range map[string]int{id: 200, "latest": 200, "none": 404} {
+		resp, err := http.Get(fmt.Sprintf("%s/grafana/board1/%s/", srv.URL, session))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: got %d, want %d", session, resp.StatusCode, want)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodOptions, fmt.Sprintf("%s/grafana/board1/%s/query", srv.URL, id), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("OPTIONS: got %d %v", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestGrafanaSearch(t *testing.T) {
+	srv, id := newGrafanaServer(t)
+
+	var targets []string
+	if code := grafanaPost(t, srv, id, "search", `{"target":"cpu:"}`, &targets); code != 200 {
+		t.Fatalf("got %d", code)
+	}
+	want := []string{"cpu:container:0123456789ab", "cpu:group:app", "cpu:group:db", "cpu:process:app-1", "cpu:process:db-2"}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("got %v, want %v", targets, want)
+	}
+
+	targets = nil
+	if code := grafanaPost(t, srv, "latest", "search", ``, &targets); code != 200 || len(targets) != 10 {
+		t.Errorf("latest: got %d %v", code, targets)
+	}
+	if code := grafanaPost(t, srv, "none", "search", `{}`, nil); code != 404 {
+		t.Errorf("missing session: got %d", code)
+	}
+}
+
+func TestGrafanaQuery(t *testing.T) {
+	srv, id := newGrafanaServer(t)
+
+	cases := []struct {
+		body string
+		want []grafanaSeries
+	}{
+		{
+			`{"range":{"from":"1970-01-01T00:16:45Z","to":"1970-01-01T00:17:00Z"},
+			"targets":[{"target":"cpu:process:app-1"},{"target":"mem:container:0123456789ab"},{"target":"cpu:process:gone-3"}]}`,
+			[]grafanaSeries{
+				{"cpu:process:app-1", [][2]float64{{20, 1010000}, {30, 1020000}}},
+				{"mem:container:0123456789ab", [][2]float64{{2, 1010000}, {2, 1020000}}},
+				{"cpu:process:gone-3", [][2]float64{{0, 1010000}, {0, 1020000}}},
+			},
+		},
+		{
+			`{"targets":[{"target":"cpu:group:app"}],"maxDataPoints":2}`,
+			[]grafanaSeries{{"cpu:group:app", [][2]float64{{15, 1000000}, {30, 1020000}}}},
+		},
+		{
+			`{"range":{"from":"1970-01-01T01:00:00Z","to":"1970-01-01T02:00:00Z"},"targets":[{"target":"cpu:group:app"}]}`,
+			[]grafanaSeries{{"cpu:group:app", [][2]float64{}}},
+		},
+	}
+	for _, c := range cases {
+		var series []grafanaSeries
+		if code := grafanaPost(t, srv, id, "query", c.body, &series); code != 200 {
+			t.Errorf("%s: got %d", c.body, code)
+			continue
+		}
+		if !reflect.DeepEqual(series, c.want) {
+			t.Errorf("%s: got %v, want %v", c.body, series, c.want)
+		}
+	}
+	if code := grafanaPost(t, srv, id, "query", `{`, nil); code != http.StatusBadRequest {
+		t.Errorf("invalid query: got %d", code)
+	}
+}
+
+func TestGrafanaAnnotations(t *testing.T) {
+	srv, id := newGrafanaServer(t)
+
+	titles := func(body string) []string {
+		var annotations []grafanaAnnotation
+		if code := grafanaPost(t, srv, id, "annotations", body, &annotations); code != 200 {
+			t.Fatalf("%s: got %d", body, code)
+		}
+		var titles []string
+		for _, a := range annotations {
+			titles = append(titles, a.Title)
+		}
+		return titles
+	}
+
+	cases := []struct {
+		body string
+		want []string
+	}{
+		{`{"annotation":{"name":"session"}}`, []string{"session started", "session ended", "outage"}},
+		{`{"range":{"from":"1970-01-01T00:16:50Z","to":"1970-01-01T00:16:55Z"}}`, []string{"outage"}},
+		{`{"range":{"from":"1970-01-01T00:16:56Z","to":"1970-01-01T00:17:00Z"}}`, []string{"session ended"}},
+		{`{"annotation":{"query":"snapshot"}}`, []string{"snapshot"}},
+		{`{"range":{"from":"1970-01-01T00:16:55Z"},"annotation":{"query":"snapshot"}}`, nil},
+	}
+	for _, c := range cases {
+		if got := titles(c.body); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.body, got, c.want)
+		}
+	}
+
+	var annotations []grafanaAnnotation
+	grafanaPost(t, srv, id, "annotations", `{"annotation":{"name":"a","query":"snapshot"}}`, &annotations)
+	if len(annotations) != 1 || annotations[0].Time != 1010000 || annotations[0].Annotation["name"] != "a" ||
+		!strings.Contains(annotations[0].Text, "/board1/"+id+"/snapshot?at=1010") {
+		t.Errorf("got %+v", annotations)
+	}
+}
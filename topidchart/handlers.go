@@ -1,12 +1,7 @@
 package topidchart
 
 import (
-	"encoding/gob"
 	"fmt"
-	"io"
-	"os"
-	"path"
-	"time"
 
 	as "github.com/godevsig/adaptiveservice"
 	"github.com/godevsig/glib/sys/log"
@@ -14,7 +9,8 @@ import (
 
 type pRecord struct {
 	Timestamp int64
-	Processes []ProcessInfo
+	Processes []ProcessInfoV2
+	Sys       *SysStats
 }
 
 type sRecord struct {
@@ -22,61 +18,120 @@ type sRecord struct {
 	Snapshot  string
 }
 
-// Handle handles SessionRequest.
+// Handle handles SessionRequest of the clients built before versioning, their
+// Records are stored as RecordV2 and the session can not be resumed.
 func (msg *SessionRequest) Handle(stream as.ContextStream) (reply interface{}) {
 	lg := stream.GetContext().(*log.Logger)
-	id := time.Now().Format("20060102") + "-" + randStringRunes(8)
 
-	filepath := fmt.Sprintf("%v/%v", dataDir, msg.Tag)
-	info := fmt.Sprintf("info-%v.data", id)
-	process := fmt.Sprintf("process-%v.data", id)
-	snapshot := fmt.Sprintf("snapshot-%v.data", id)
-	if err := os.MkdirAll(filepath, 0777); err != nil {
+	s, err := newSession(dataDir, msg.v2())
+	if err != nil {
 		return err
 	}
+	s.legacy = true
+	sessions.add(s)
+	go sessions.serve(lg, stream, s, 0)
+
+	return &SessionResponse{ChartURL: s.chartURL()}
+}
+
+// v2 converts the request to SessionRequestV2 of version 1.
+func (msg *SessionRequest) v2() *SessionRequestV2 {
+	return &SessionRequestV2{
+		Version:   1,
+		Tag:       msg.Tag,
+		SysInfo:   SysInfoV2{CPUInfo: msg.SysInfo.CPUInfo, KernelInfo: msg.SysInfo.KernelInfo},
+		ExtraInfo: msg.ExtraInfo,
+	}
+}
 
-	infoFile, err := os.OpenFile(path.Join(filepath, info), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+// v2 converts the record to RecordV2.
+func (r *Record) v2() *RecordV2 {
+	record := &RecordV2{Timestamp: r.Timestamp, Snapshot: r.Snapshot}
+	for _, p := range r.Processes {
+		record.Processes = append(record.Processes, ProcessInfoV2{
+			Pid:  p.Pid,
+			Name: p.Name,
+			Ucpu: p.Ucpu,
+			Scpu: p.Scpu,
+			Mem:  p.Mem,
+		})
+	}
+	return record
+}
+
+// Handle handles SessionRequestV2.
+func (msg *SessionRequestV2) Handle(stream as.ContextStream) (reply interface{}) {
+	lg := stream.GetContext().(*log.Logger)
+
+	if err := checkProtocol(msg.Version, msg.Capabilities); err != nil {
+		return err
+	}
+	s, err := newSession(dataDir, msg)
 	if err != nil {
 		return err
 	}
-	infoFile.WriteString(fmt.Sprintf("------CPUInfo------\n%s\n------KernelInfo------\n%s\n------ExtraInfo------\n%s\n", msg.SysInfo.CPUInfo, msg.SysInfo.KernelInfo, msg.ExtraInfo))
-	infoFile.Close()
+	sessions.add(s)
+	go sessions.serve(lg, stream, s, 0)
 
-	processFile, err := os.OpenFile(path.Join(filepath, process), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
-	if err != nil {
+	return s.response()
+}
+
+// Handle handles ResumeSession.
+func (msg *ResumeSession) Handle(stream as.ContextStream) (reply interface{}) {
+	lg := stream.GetContext().(*log.Logger)
+
+	if err := checkProtocol(msg.Version, msg.Capabilities); err != nil {
 		return err
 	}
-	snapshotFile, err := os.OpenFile(path.Join(filepath, snapshot), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	s, gen, err := sessions.resume(msg.Token)
 	if err != nil {
 		return err
 	}
-	pEnc := gob.NewEncoder(processFile)
-	sEnc := gob.NewEncoder(snapshotFile)
-
-	go func() {
-		defer func() { processFile.Close(); snapshotFile.Close() }()
-		lg.Debugln("data processing started")
-
-		for {
-			var record Record
-			err := stream.Recv(&record)
-			if err != nil {
-				if err != io.EOF && err != io.ErrUnexpectedEOF {
-					lg.Errorln(err)
-				}
-				break
-			}
-			pEnc.Encode(&pRecord{record.Timestamp, record.Processes})
-
-			if record.Snapshot != "" {
-				sEnc.Encode(&sRecord{record.Timestamp, record.Snapshot})
-			}
+	lg.Infof("session %v/%v resumed", s.meta.Tag, s.meta.ID)
+	go sessions.serve(lg, stream, s, gen)
+
+	return s.response()
+}
+
+// minProtocolVersion is the oldest version of SessionRequestV2 the server accepts,
+// SessionRequest is always accepted.
+const minProtocolVersion = 2
+
+// capabilities are the optional features the server supports.
+var capabilities = []string{CapDelta, CapSys, CapSnapshot, CapExtMetrics, CapThreads, CapContainers}
+
+func hasCapability(caps []string, c string) bool {
+	for _, v := range caps {
+		if v == c {
+			return true
 		}
-	}()
+	}
+	return false
+}
 
-	return &SessionResponse{fmt.Sprintf("http://%v/%v/%v", hostAddr, msg.Tag, id)}
+// checkProtocol returns error if the server does not support the version
+// or the capabilities of the client.
+func checkProtocol(version int, caps []string) error {
+	if version < minProtocolVersion || version > ProtocolVersion {
+		return fmt.Errorf("unsupported protocol version %d, the server supports %d to %d",
+			version, minProtocolVersion, ProtocolVersion)
+	}
+	var unsupported []string
+	for _, c := range caps {
+		if !hasCapability(capabilities, c) {
+			unsupported = append(unsupported, c)
+		}
+	}
+	if len(unsupported) != 0 {
+		return fmt.Errorf("unsupported capabilities %v, the server supports %v", unsupported, capabilities)
+	}
+	return nil
 }
 
 var knownMsgs = []as.KnownMessage{
 	(*SessionRequest)(nil),
+	(*SessionRequestV2)(nil),
+	(*ResumeSession)(nil),
+	(*ReplaySession)(nil),
+	(*SubscribeSession)(nil),
 }
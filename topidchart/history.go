@@ -0,0 +1,274 @@
+package topidchart
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyPageSize is the number of sessions per page of the history.
+const historyPageSize = 50
+
+type label struct {
+	Key   string
+	Value string
+	URL   string // the history filtered by the label in addition
+}
+
+type historyEntry struct {
+	Tag      string
+	Session  string
+	Host     string
+	RunID    string
+	Start    time.Time
+	Duration time.Duration
+	Labels   []label
+
+	text string // all the searchable text in lower case
+}
+
+type historyPage struct {
+	Query    string
+	Label    string
+	Sort     string
+	Total    int
+	Entries  []historyEntry
+	Page     int
+	Pages    int
+	PrevURL  string
+	NextURL  string
+	FilesURL string
+}
+
+const historyTpl = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="UTF-8">
+	<title>History</title>
+	<style>
+		body { font: 14px Sans-Serif; color: #333; margin: 20px; }
+		table { border-collapse: collapse; }
+		th, td { text-align: left; padding: 4px 12px; border-bottom: 1px solid #ddd; }
+		th { background: #eee; }
+		a { color: #2980B9; text-decoration: none; }
+		.label { background: #eee; border-radius: 3px; padding: 1px 4px; margin-right: 4px; white-space: nowrap; }
+		.bar a, .bar input, .bar select { margin-right: 12px; }
+	</style>
+</head>
+<body>
+<p class="bar"><a href="/readme">README</a><a href="{{.FilesURL}}">RAW FILES</a></p>
+<form class="bar" method="get" action="/history">
+	<input type="text" name="q" value="{{.Query}}" placeholder="tag, session, host or text" size="30">
+	<input type="text" name="label" value="{{.Label}}" placeholder="key=value,key=value" size="30">
+	<select name="sort">
+		<option value="date"{{if eq .Sort "date"}} selected{{end}}>newest first</option>
+		<option value="duration"{{if eq .Sort "duration"}} selected{{end}}>longest first</option>
+	</select>
+	<input type="submit" value="SEARCH">
+</form>
+<h3>{{.Total}} session(s)</h3>
+{{- if .Entries}}
+<table>
+	<tr><th>Tag</th><th>Session</th><th>Host</th><th>Started</th><th>Duration</th><th>Labels</th><th></th></tr>
+	{{- range .Entries}}
+	<tr>
+		<td>{{.Tag}}</td>
+		<td><a href="/{{.Tag}}/{{.Session}}">{{.Session}}</a></td>
+		<td>{{.Host}}</td>
+		<td>{{.Start.Format "2006-01-02 15:04:05"}}</td>
+		<td>{{.Duration}}</td>
+		<td>{{range .Labels}}<a class="label" href="{{.URL}}">{{.Key}}={{.Value}}</a>{{end}}</td>
+		<td><a href="/{{.Tag}}/{{.Session}}/info">info</a>{{if .RunID}} <a href="/run/{{.RunID}}">run</a>{{end}}</td>
+	</tr>
+	{{- end}}
+</table>
+<p class="bar">
+	{{- if .PrevURL}}<a href="{{.PrevURL}}">&lt; prev</a>{{end}}
+	page {{.Page}} of {{.Pages}}
+	{{- if .NextURL}}<a href="{{.NextURL}}">next &gt;</a>{{end}}
+</p>
+{{- end}}
+</body>
+</html>
+`
+
+var historyTmpl = template.Must(template.New("history").Parse(historyTpl))
+
+// loadHistory returns all the sessions under dir, sessions created by older
+// servers have no meta and are listed by their data files only.
+func loadHistory(dir string) []historyEntry {
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "process-*.data"))
+	entries := make([]historyEntry, 0, len(files))
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		e := historyEntry{
+			Tag:     filepath.Base(filepath.Dir(f)),
+			Session: strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), "process-"), ".data"),
+		}
+		// the data file is written on each record, so its modification
+		// time is the end of the sessions not closed cleanly
+		end := fi.ModTime()
+		if meta, err := loadMeta(dir, e.Tag, e.Session); err == nil {
+			e.Host = meta.SysInfo.Hostname
+			e.RunID = meta.RunID
+			e.Start = time.Unix(meta.Start, 0)
+			if meta.End != 0 {
+				end = time.Unix(meta.End, 0)
+			}
+			for k, v := range meta.Labels {
+				e.Labels = append(e.Labels, label{Key: k, Value: v})
+			}
+			sort.Slice(e.Labels, func(i, j int) bool { return e.Labels[i].Key < e.Labels[j].Key })
+			e.text = meta.ExtraInfo
+		} else if info, err := os.Stat(fmt.Sprintf("%v/%v/info-%v.data", dir, e.Tag, e.Session)); err == nil {
+			// the info file is written once at the start
+			e.Start = info.ModTime()
+		} else {
+			e.Start = end
+		}
+		if end.After(e.Start) {
+			e.Duration = end.Sub(e.Start).Truncate(time.Second)
+		}
+
+		text := []string{e.Tag, e.Session, e.Host, e.RunID, e.text}
+		for _, l := range e.Labels {
+			text = append(text, l.Key+"="+l.Value)
+		}
+		e.text = strings.ToLower(strings.Join(text, "\n"))
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// parseLabels parses the label filter in the form of key=value,key=value.
+func parseLabels(s string) map[string]string {
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			labels[kv] = ""
+			continue
+		}
+		labels[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+	}
+	return labels
+}
+
+// match reports whether the entry contains the query and has all the labels,
+// a label with empty value matches any value.
+func (e *historyEntry) match(query string, labels map[string]string) bool {
+	if query != "" && !strings.Contains(e.text, query) {
+		return false
+	}
+	for k, v := range labels {
+		found := false
+		for _, l := range e.Labels {
+			if l.Key == k && (v == "" || l.Value == v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// historyURL returns the history URL of vars with the key set to value.
+func historyURL(vars url.Values, key, value string) string {
+	v := url.Values{}
+	for k, vs := range vars {
+		v[k] = vs
+	}
+	v.Set(key, value)
+	return "/history?" + v.Encode()
+}
+
+func (cs *chartServer) historyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+	page := &historyPage{
+		Query:    vars.Get("q"),
+		Label:    vars.Get("label"),
+		Sort:     vars.Get("sort"),
+		Page:     1,
+		FilesURL: fmt.Sprintf("http://%s:%s", cs.ip, cs.fileport),
+	}
+	if page.Sort != "duration" {
+		page.Sort = "date"
+	}
+	if n, err := strconv.Atoi(vars.Get("page")); err == nil && n > 0 {
+		page.Page = n
+	}
+
+	query := strings.ToLower(page.Query)
+	labels := parseLabels(page.Label)
+	var entries []historyEntry
+	for _, e := range loadHistory(cs.dir) {
+		if e.match(query, labels) {
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if page.Sort == "duration" && entries[i].Duration != entries[j].Duration {
+			return entries[i].Duration > entries[j].Duration
+		}
+		return entries[i].Start.After(entries[j].Start)
+	})
+
+	page.Total = len(entries)
+	page.Pages = (len(entries) + historyPageSize - 1) / historyPageSize
+	if page.Page > page.Pages {
+		page.Page = page.Pages
+	}
+	if page.Page < 1 {
+		page.Page = 1
+	}
+	start := (page.Page - 1) * historyPageSize
+	end := start + historyPageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+	page.Entries = entries[start:end]
+	if page.Page > 1 {
+		page.PrevURL = historyURL(vars, "page", strconv.Itoa(page.Page-1))
+	}
+	if page.Page < page.Pages {
+		page.NextURL = historyURL(vars, "page", strconv.Itoa(page.Page+1))
+	}
+
+	for i := range page.Entries {
+		for j := range page.Entries[i].Labels {
+			l := &page.Entries[i].Labels[j]
+			filter := l.Key + "=" + l.Value
+			if _, ok := labels[l.Key]; ok {
+				filter = page.Label
+			} else if page.Label != "" {
+				filter = page.Label + "," + filter
+			}
+			v := url.Values{"label": {filter}, "sort": {page.Sort}}
+			if page.Query != "" {
+				v.Set("q", page.Query)
+			}
+			l.URL = "/history?" + v.Encode()
+		}
+	}
+
+	if err := historyTmpl.Execute(w, page); err != nil {
+		cs.lg.Errorln(err)
+	}
+}
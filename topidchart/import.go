@@ -0,0 +1,566 @@
+package topidchart
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Import formats.
+const (
+	FormatTop     = "top"     // output of procps top -b
+	FormatPidstat = "pidstat" // output of sysstat pidstat, -u -r -d -w -v -t reports supported
+	FormatCSV     = "csv"     // CSV with header timestamp,pid,name,ucpu,scpu,cpu,mem,ppid,threads
+)
+
+var errNoRecords = errors.New("no records found")
+
+// importer writes the parsed records into a new session, which is created on the first record.
+type importer struct {
+	dir    string
+	msg    SessionRequestV2
+	s      *session
+	last   int64
+	count  int
+	dryRun bool // only count the records and track the time
+}
+
+func (im *importer) emit(r *RecordV2) error {
+	im.count++
+	im.last = r.Timestamp
+	if im.dryRun {
+		return nil
+	}
+	if im.s == nil {
+		s, err := newSession(im.dir, &im.msg)
+		if err != nil {
+			return err
+		}
+		s.meta.Start = r.Timestamp
+		im.s = s
+	}
+	return im.s.write(r)
+}
+
+func (im *importer) close() error {
+	if im.s == nil {
+		return errNoRecords
+	}
+	im.s.lastRecv = time.Unix(im.last, 0)
+	return im.s.close(true)
+}
+
+// dayClock converts times of day in order to unix time, it moves to the next
+// day when the time of day goes backwards.
+type dayClock struct {
+	date time.Time // midnight of the current day
+	prev time.Duration
+	days int // days moved
+}
+
+func (dc *dayClock) at(tod time.Duration) int64 {
+	if tod < dc.prev {
+		dc.date = dc.date.AddDate(0, 0, 1)
+		dc.days++
+	}
+	dc.prev = tod
+	return dc.date.Add(tod).Unix()
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// parseTimeOfDay parses 15:04:05, optionally followed by AM or PM in ampm.
+func parseTimeOfDay(s, ampm string) (time.Duration, bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	var v [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, false
+		}
+		v[i] = n
+	}
+	switch ampm {
+	case "AM":
+		if v[0] == 12 {
+			v[0] = 0
+		}
+	case "PM":
+		if v[0] != 12 {
+			v[0] += 12
+		}
+	}
+	return time.Duration(v[0])*time.Hour + time.Duration(v[1])*time.Minute + time.Duration(v[2])*time.Second, true
+}
+
+// parseSize parses the memory size in KB with optional unit suffix of top.
+func parseSize(s string) uint64 {
+	scale := 1.0
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		s = s[:len(s)-1]
+	case "m":
+		scale, s = 1024, s[:len(s)-1]
+	case "g":
+		scale, s = 1024*1024, s[:len(s)-1]
+	case "t":
+		scale, s = 1024*1024*1024, s[:len(s)-1]
+	}
+	v, _ := strconv.ParseFloat(s, 64)
+	return uint64(v * scale)
+}
+
+func newScanner(r io.Reader) *bufio.Scanner {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	return sc
+}
+
+var (
+	topMemRe  = regexp.MustCompile(`^(\w)iB Mem\s*:\s*([\d.]+)\s+total,\s*([\d.]+)\s+free`)
+	topSwapRe = regexp.MustCompile(`^(\w)iB Swap\s*:\s*([\d.]+)\s+total,\s*([\d.]+)\s+free.*?([\d.]+)\s+avail Mem`)
+	topIdleRe = regexp.MustCompile(`([\d.]+)\s*id,`)
+)
+
+func topUnit(u string) string {
+	return map[string]string{"K": "k", "M": "m", "G": "g", "T": "t"}[u]
+}
+
+// parseTop parses the batches of top -b, each starts with the summary line like
+// "top - 10:20:30 up 1 day, ...", followed by the process table.
+func parseTop(r io.Reader, clock *dayClock, im *importer) error {
+	sc := newScanner(r)
+	var rec *RecordV2
+	var cols map[string]int
+	flush := func() error {
+		if rec != nil && len(rec.Processes) != 0 {
+			return im.emit(rec)
+		}
+		return nil
+	}
+
+	for sc.Scan() {
+		line := sc.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "top - ") && len(fields) > 2:
+			if err := flush(); err != nil {
+				return err
+			}
+			rec, cols = nil, nil
+			if tod, ok := parseTimeOfDay(fields[2], ""); ok {
+				rec = &RecordV2{Timestamp: clock.at(tod), Sys: &SysStats{}}
+			}
+		case rec == nil:
+		case strings.HasPrefix(line, "%Cpu"):
+			if m := topIdleRe.FindStringSubmatch(line); m != nil {
+				idle, _ := strconv.ParseFloat(m[1], 32)
+				rec.Sys.CPU = floatConv(float32(100 - idle))
+			}
+		case topMemRe.MatchString(line):
+			m := topMemRe.FindStringSubmatch(line)
+			im.msg.SysInfo.MemTotal = parseSize(m[2] + topUnit(m[1]))
+			rec.Sys.MemFree = parseSize(m[3] + topUnit(m[1]))
+		case topSwapRe.MatchString(line):
+			m := topSwapRe.FindStringSubmatch(line)
+			rec.Sys.SwapTotal = parseSize(m[2] + topUnit(m[1]))
+			rec.Sys.SwapFree = parseSize(m[3] + topUnit(m[1]))
+			rec.Sys.MemAvailable = parseSize(m[4] + topUnit(m[1]))
+		case fields[0] == "PID" && fields[len(fields)-1] == "COMMAND":
+			cols = make(map[string]int)
+			for i, f := range fields {
+				cols[f] = i
+			}
+		case cols != nil && len(fields) >= len(cols):
+			pid, err := strconv.Atoi(fields[cols["PID"]])
+			if err != nil {
+				continue
+			}
+			p := ProcessInfoV2{Pid: pid, Name: strings.Join(fields[cols["COMMAND"]:], " ")}
+			if i, ok := cols["%CPU"]; ok {
+				p.Ucpu = string2float32(fields[i])
+			}
+			if i, ok := cols["RES"]; ok {
+				p.Mem = parseSize(fields[i])
+			}
+			if i, ok := cols["PPID"]; ok {
+				p.Ppid, _ = strconv.Atoi(fields[i])
+			}
+			if i, ok := cols["nTH"]; ok {
+				p.NumThreads, _ = strconv.Atoi(fields[i])
+			}
+			rec.Processes = append(rec.Processes, p)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+var pidstatHeadRe = regexp.MustCompile(`^Linux\s+(\S+)\s+\((\S+)\)\s+(\S+)\s+(\S+)\s+\((\d+) CPU\)`)
+
+// parsePidstat parses the output of pidstat, the reports of the same time are
+// merged into one record.
+func parsePidstat(r io.Reader, clock *dayClock, im *importer) error {
+	sc := newScanner(r)
+	var rec *RecordV2
+	var tod time.Duration
+	var prev int64
+	var cols map[string]int
+	var ntime int              // number of time tokens, 2 with AM/PM
+	procs := make(map[int]int) // pid to index in rec.Processes
+	last := -1                 // index of the last process row
+
+	flush := func() error {
+		if rec != nil && len(rec.Processes) != 0 {
+			prev = rec.Timestamp
+			return im.emit(rec)
+		}
+		return nil
+	}
+
+	for sc.Scan() {
+		line := sc.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if m := pidstatHeadRe.FindStringSubmatch(line); m != nil {
+			im.msg.SysInfo.KernelVersion = m[1]
+			im.msg.SysInfo.Hostname = m[2]
+			im.msg.SysInfo.Arch = strings.Trim(m[4], "_")
+			im.msg.SysInfo.NumCPU, _ = strconv.Atoi(m[5])
+			for _, layout := range []string{"01/02/2006", "01/02/06", "2006-01-02"} {
+				if date, err := time.ParseInLocation(layout, m[3], time.Local); err == nil {
+					clock.date = date.AddDate(0, 0, clock.days)
+					break
+				}
+			}
+			continue
+		}
+		if strings.HasSuffix(fields[0], ":") {
+			// Average: lines
+			continue
+		}
+
+		ampm := ""
+		if len(fields) > 1 && (fields[1] == "AM" || fields[1] == "PM") {
+			ampm = fields[1]
+		}
+		t, ok := parseTimeOfDay(fields[0], ampm)
+		if !ok {
+			continue
+		}
+		n := 1
+		if ampm != "" {
+			n = 2
+		}
+		if fields[len(fields)-1] == "Command" {
+			cols, ntime = make(map[string]int), n
+			for i, f := range fields[n:] {
+				cols[f] = i + n
+			}
+			continue
+		}
+		if cols == nil || n != ntime || len(fields) < len(cols)+n {
+			continue
+		}
+
+		if rec == nil || t != tod {
+			if err := flush(); err != nil {
+				return err
+			}
+			tod = t
+			rec = &RecordV2{Timestamp: clock.at(t)}
+			procs = make(map[int]int)
+			last = -1
+		}
+		var dt float64
+		if prev != 0 {
+			dt = float64(rec.Timestamp - prev)
+		}
+		value := func(col string) (float64, bool) {
+			i, ok := cols[col]
+			if !ok {
+				return 0, false
+			}
+			v, err := strconv.ParseFloat(fields[i], 64)
+			return v, err == nil
+		}
+		name := strings.Join(fields[cols["Command"]:], " ")
+
+		pidCol := "PID"
+		if i, ok := cols["TGID"]; ok {
+			if fields[i] == "-" {
+				// a thread row of the previous process row
+				tid, _ := value("TID")
+				if last < 0 {
+					continue
+				}
+				p := &rec.Processes[last]
+				var th *ThreadInfo
+				for i := range p.Threads {
+					if p.Threads[i].Tid == int(tid) {
+						th = &p.Threads[i]
+					}
+				}
+				if th == nil {
+					p.Threads = append(p.Threads, ThreadInfo{Tid: int(tid), Name: strings.TrimPrefix(name, "|__")})
+					th = &p.Threads[len(p.Threads)-1]
+				}
+				if v, ok := value("%usr"); ok {
+					th.Ucpu = float32(v)
+				}
+				if v, ok := value("%system"); ok {
+					th.Scpu = float32(v)
+				}
+				continue
+			}
+			pidCol = "TGID"
+		}
+		pid, ok := value(pidCol)
+		if !ok {
+			continue
+		}
+		idx, ok := procs[int(pid)]
+		if !ok {
+			idx = len(rec.Processes)
+			procs[int(pid)] = idx
+			rec.Processes = append(rec.Processes, ProcessInfoV2{Pid: int(pid), Name: name})
+		}
+		last = idx
+		p := &rec.Processes[idx]
+		if v, ok := value("%usr"); ok {
+			p.Ucpu = float32(v)
+		}
+		if v, ok := value("%system"); ok {
+			p.Scpu = float32(v)
+		}
+		if v, ok := value("RSS"); ok {
+			p.Mem = uint64(v)
+		}
+		if v, ok := value("kB_rd/s"); ok {
+			p.ReadBytes = uint64(v * 1024 * dt)
+		}
+		if v, ok := value("kB_wr/s"); ok {
+			p.WriteBytes = uint64(v * 1024 * dt)
+		}
+		if v, ok := value("cswch/s"); ok {
+			p.VolCtxsw = uint64(v * dt)
+		}
+		if v, ok := value("nvcswch/s"); ok {
+			p.InvolCtxsw = uint64(v * dt)
+		}
+		if v, ok := value("threads"); ok {
+			p.NumThreads = int(v)
+		}
+		if v, ok := value("fd-nr"); ok {
+			p.NumFDs = int(v)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// parseCSVTime parses unix time in seconds or date time in local time.
+func parseCSVTime(s string) (int64, error) {
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return v, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid timestamp %q", s)
+}
+
+// parseCSV parses CSV with header, the rows of the same timestamp are one record.
+// The csv output of Parse can be imported, the rows of other kinds than process are skipped.
+// Required columns are timestamp and pid, mem is in KB, cpu is the total of ucpu and scpu
+// and only used as ucpu if both are empty.
+func parseCSV(r io.Reader, im *importer) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	cols := make(map[string]int)
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	if _, ok := cols["timestamp"]; !ok {
+		return errors.New("csv: timestamp column required")
+	}
+	if _, ok := cols["pid"]; !ok {
+		return errors.New("csv: pid column required")
+	}
+
+	var rec *RecordV2
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		field := func(col string) string {
+			if i, ok := cols[col]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		if kind := field("kind"); kind != "" && kind != kindProcess {
+			// the rows other than the processes in the output of Parse
+			continue
+		}
+		ts, err := parseCSVTime(field("timestamp"))
+		if err != nil {
+			return fmt.Errorf("csv line %d: %v", line, err)
+		}
+		pid, err := strconv.Atoi(field("pid"))
+		if err != nil {
+			return fmt.Errorf("csv line %d: invalid pid", line)
+		}
+		if rec == nil || rec.Timestamp != ts {
+			if rec != nil {
+				if err := im.emit(rec); err != nil {
+					return err
+				}
+			}
+			rec = &RecordV2{Timestamp: ts}
+		}
+		p := ProcessInfoV2{
+			Pid:  pid,
+			Name: field("name"),
+			Ucpu: string2float32(field("ucpu")),
+			Scpu: string2float32(field("scpu")),
+			Mem:  uint64(string2float32(field("mem"))),
+		}
+		if field("ucpu") == "" && field("scpu") == "" {
+			p.Ucpu = string2float32(field("cpu"))
+		}
+		p.Ppid, _ = strconv.Atoi(field("ppid"))
+		p.NumThreads, _ = strconv.Atoi(field("threads"))
+		p.Cgroup = field("cgroup")
+		p.ContainerID = field("container")
+		rec.Processes = append(rec.Processes, p)
+	}
+	if rec != nil {
+		return im.emit(rec)
+	}
+	return nil
+}
+
+// detectFormat detects the format by the first non-empty line.
+func detectFormat(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sc := newScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "top - "):
+			return FormatTop, nil
+		case pidstatHeadRe.MatchString(line):
+			return FormatPidstat, nil
+		case strings.Contains(strings.ToLower(line), "timestamp"):
+			return FormatCSV, nil
+		}
+		break
+	}
+	return "", errors.New("unknown format")
+}
+
+// ImportFile imports the file of the format into a new session of the tag under dir,
+// and returns the session ID. The format is detected from the content if empty.
+// The captures with only time of day, e.g. top, are dated so that the last
+// record is on the modification date of the file.
+func ImportFile(dir, filename, format, tag string) (string, error) {
+	if format == "" {
+		f, err := detectFormat(filename)
+		if err != nil {
+			return "", err
+		}
+		format = f
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+
+	parse := func(clock *dayClock, im *importer) error {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		switch format {
+		case FormatTop:
+			return parseTop(f, clock, im)
+		case FormatPidstat:
+			return parsePidstat(f, clock, im)
+		case FormatCSV:
+			return parseCSV(f, im)
+		}
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	// count the days the captures span in a dry run to date the first record
+	date := midnight(fi.ModTime())
+	probe := &importer{dryRun: true}
+	probeClock := &dayClock{date: date}
+	if err := parse(probeClock, probe); err != nil {
+		return "", err
+	}
+	if probe.count == 0 {
+		return "", errNoRecords
+	}
+
+	im := &importer{
+		dir: dir,
+		msg: SessionRequestV2{
+			Tag:       tag,
+			ExtraInfo: fmt.Sprintf("imported from %s in %s format", fi.Name(), format),
+			Labels:    map[string]string{"imported": format},
+		},
+	}
+	clock := &dayClock{date: date.AddDate(0, 0, -probeClock.days)}
+	if err := parse(clock, im); err != nil {
+		if im.s != nil {
+			im.close()
+		}
+		return "", err
+	}
+	if err := im.close(); err != nil {
+		return "", err
+	}
+	return im.s.meta.ID, nil
+}
@@ -0,0 +1,174 @@
+package topidchart
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// importRecords imports the content in the format and returns the stored records.
+func importRecords(t *testing.T, format, content string) []pRecord {
+	t.Helper()
+	dir := t.TempDir()
+	capture := filepath.Join(dir, "capture.txt")
+	if err := os.WriteFile(capture, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, err := ImportFile(dir, capture, format, "imported")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []pRecord
+	err = walkRecords(fmt.Sprintf("%s/imported/process-%s.data", dir, id), func(r *pRecord) bool {
+		records = append(records, *r)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func findProcess(r pRecord, pid int) *ProcessInfoV2 {
+	for i := range r.Processes {
+		if r.Processes[i].Pid == pid {
+			return &r.Processes[i]
+		}
+	}
+	return nil
+}
+
+const topCapture = `top - 23:59:58 up 10 days,  1:02,  1 user,  load average: 0.10, 0.20, 0.30
+Tasks: 2 total,   1 running,   1 sleeping,   0 stopped,   0 zombie
+%Cpu(s):  5.0 us,  3.0 sy,  0.0 ni, 90.0 id,  2.0 wa,  0.0 hi,  0.0 si,  0.0 st
+MiB Mem :   7822.0 total,   1000.0 free,   3000.0 used,   3822.0 buff/cache
+MiB Swap:   2048.0 total,   2048.0 free,      0.0 used.   4000.0 avail Mem
+
+    PID USER      PR  NI    VIRT    RES    SHR S  %CPU  %MEM     TIME+ COMMAND
+   1234 root      20   0  100000  2.5m   1000 S  12.5   0.1   0:01.00 my app
+      1 root      20   0  168000  11000   8000 S   0.0   0.1   0:02.00 systemd
+
+top - 00:00:01 up 10 days,  1:02,  1 user,  load average: 0.10, 0.20, 0.30
+%Cpu(s):  5.0 us,  3.0 sy,  0.0 ni, 80.0 id,  2.0 wa,  0.0 hi,  0.0 si,  0.0 st
+
+    PID USER      PR  NI    VIRT    RES    SHR S  %CPU  %MEM     TIME+ COMMAND
+   1234 root      20   0  100000   3072   1000 S  25.0   0.1   0:01.00 my app
+`
+
+func TestImportTop(t *testing.T) {
+	records := importRecords(t, FormatTop, topCapture)
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	if d := records[1].Timestamp - records[0].Timestamp; d != 3 {
+		t.Errorf("got %d seconds between the records across midnight, want 3", d)
+	}
+	p := findProcess(records[0], 1234)
+	if p == nil || p.Name != "my app" || p.Ucpu != 12.5 || p.Mem != 2560 {
+		t.Errorf("got %+v", p)
+	}
+	if records[0].Sys == nil || records[0].Sys.CPU != 10 || records[0].Sys.MemFree != 1000*1024 {
+		t.Errorf("got sys %+v", records[0].Sys)
+	}
+	if p := findProcess(records[1], 1234); p == nil || p.Ucpu != 25 || p.Mem != 3072 {
+		t.Errorf("got %+v", p)
+	}
+}
+
+const pidstatCapture = `Linux 5.15.0-91-generic (myhost) 	01/02/2024 	_x86_64_	(8 CPU)
+
+10:00:00 AM   UID      TGID       TID    %usr %system  %guest   %wait    %CPU   CPU  Command
+10:00:00 AM  1000      4321         -   10.00    5.00    0.00    0.00   15.00     1  worker
+10:00:00 AM  1000         -      4321    6.00    3.00    0.00    0.00    9.00     1  |__worker
+10:00:00 AM  1000         -      4322    4.00    2.00    0.00    0.00    6.00     2  |__pool
+
+10:00:00 AM   UID       PID  minflt/s  majflt/s     VSZ     RSS   %MEM  Command
+10:00:00 AM  1000      4321      0.00      0.00  200000   40960   0.50  worker
+
+10:00:02 AM   UID      TGID       TID    %usr %system  %guest   %wait    %CPU   CPU  Command
+10:00:02 AM  1000      4321         -   20.00    5.00    0.00    0.00   25.00     1  worker
+
+10:00:02 AM   UID       PID   kB_rd/s   kB_wr/s kB_ccwr/s iodelay  Command
+10:00:02 AM  1000      4321      1.00      2.00      0.00       0  worker
+
+Average:      UID      TGID       TID    %usr %system  %guest   %wait    %CPU   CPU  Command
+Average:     1000      4321         -   15.00    5.00    0.00    0.00   20.00     -  worker
+`
+
+func TestImportPidstat(t *testing.T) {
+	records := importRecords(t, FormatPidstat, pidstatCapture)
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	want := time.Date(2024, 1, 2, 10, 0, 0, 0, time.Local).Unix()
+	if records[0].Timestamp != want {
+		t.Errorf("got timestamp %v, want %v", time.Unix(records[0].Timestamp, 0), time.Unix(want, 0))
+	}
+	p := findProcess(records[0], 4321)
+	if p == nil || p.Ucpu != 10 || p.Scpu != 5 || p.Mem != 40960 || len(p.Threads) != 2 {
+		t.Fatalf("got %+v", p)
+	}
+	if th := p.Threads[1]; th.Tid != 4322 || th.Name != "pool" || th.Ucpu != 4 {
+		t.Errorf("got thread %+v", th)
+	}
+	p = findProcess(records[1], 4321)
+	if p == nil || p.Ucpu != 20 || p.ReadBytes != 2048 || p.WriteBytes != 4096 {
+		t.Errorf("got %+v", p)
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	cases := []struct {
+		name       string
+		content    string
+		ucpu, scpu float32
+	}{
+		{"all cpu columns", "timestamp,pid,name,ucpu,scpu,cpu,mem,ppid,threads\n100,10,app,3,2,5,2048,1,4\n", 3, 2},
+		{"total cpu only", "timestamp,pid,name,cpu,mem\n100,10,app,5,2048\n", 5, 0},
+		{"empty ucpu and scpu", "timestamp,pid,name,ucpu,scpu,cpu,mem\n100,10,app,,,5,2048\n", 5, 0},
+	}
+	for _, c := range cases {
+		records := importRecords(t, FormatCSV, c.content)
+		if len(records) != 1 {
+			t.Fatalf("%s: got %d records, want 1", c.name, len(records))
+		}
+		p := findProcess(records[0], 10)
+		if p == nil || p.Ucpu != c.ucpu || p.Scpu != c.scpu || p.Mem != 2048 || p.Name != "app" {
+			t.Errorf("%s: got %+v, want ucpu %v scpu %v", c.name, p, c.ucpu, c.scpu)
+		}
+	}
+}
+
+func TestImportCSVRecords(t *testing.T) {
+	content := `timestamp,pid,name,ucpu,scpu,mem
+2024-01-02 10:00:00,1,init,1,0,1024
+2024-01-02 10:00:00,2,app,2,1,2048
+2024-01-02 10:00:05,2,app,4,1,2048
+`
+	records := importRecords(t, FormatCSV, content)
+	if len(records) != 2 || len(records[0].Processes) != 2 || len(records[1].Processes) != 1 {
+		t.Fatalf("got %+v", records)
+	}
+	if d := records[1].Timestamp - records[0].Timestamp; d != 5 {
+		t.Errorf("got %d seconds between the records, want 5", d)
+	}
+}
+
+func TestImportCSVInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for _, content := range []string{
+		"pid,name\n1,init\n",
+		"timestamp,pid\nyesterday,1\n",
+		"timestamp,pid\n100,x\n",
+	} {
+		capture := filepath.Join(dir, "capture.csv")
+		if err := os.WriteFile(capture, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ImportFile(dir, capture, FormatCSV, "invalid"); err == nil {
+			t.Errorf("%q imported without error", content)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package topidchart
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// ingestResponse is the reply of creating a session over HTTP,
+// the records of the session should be posted to RecordsURL.
+type ingestResponse struct {
+	SessionResponseV2
+	RecordsURL string
+}
+
+// ingestResult is the reply of posting records.
+type ingestResult struct {
+	Records int    // records written
+	Dropped int    // records failed to write, e.g. delta records before keyframe
+	Error   string `json:",omitempty"` // the decode error, or the first write error other than no keyframe
+}
+
+// ingestSessionHandler creates a session from the SessionRequestV2 in JSON.
+// The session is closed when no records are posted in the resume window.
+func (cs *chartServer) ingestSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if sessions == nil || sessions.window == 0 {
+		http.Error(w, "HTTP ingestion needs resume enabled.", http.StatusServiceUnavailable)
+		return
+	}
+
+	var msg SessionRequestV2
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if msg.Tag == "" {
+		http.Error(w, "Tag is required.", http.StatusBadRequest)
+		return
+	}
+	// Version is optional in JSON
+	if msg.Version == 0 {
+		msg.Version = ProtocolVersion
+	}
+	if err := checkProtocol(msg.Version, msg.Capabilities); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s, err := newSession(dataDir, &msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token := sessions.add(s)
+	// no stream until records are posted
+	sessions.idle(s, 0)
+	cs.lg.Infof("session %v/%v created over HTTP", s.meta.Tag, s.meta.ID)
+
+	resp := &ingestResponse{
+		SessionResponseV2: *s.response(),
+		RecordsURL:        fmt.Sprintf("http://%v/ingest/%v", hostAddr, token),
+	}
+	if err := writeJSON(w, resp); err != nil {
+		cs.lg.Errorln(err)
+	}
+}
+
+// ingestRecordsHandler writes the records in newline delimited JSON into the session,
+// the records can be posted in one request or in batches by several requests.
+// The empty record ends the session after the records before it are written.
+func (cs *chartServer) ingestRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	if sessions == nil {
+		http.Error(w, "HTTP ingestion needs resume enabled.", http.StatusServiceUnavailable)
+		return
+	}
+	s, gen, err := sessions.attach(mux.Vars(r)["token"])
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	ended := false
+	defer func() {
+		if ended {
+			sessions.detach(s, gen, true)
+		} else {
+			sessions.idle(s, gen)
+		}
+	}()
+
+	var result ingestResult
+	var pending sync.WaitGroup
+	// written by the writer of the session
+	var writeErr error
+	decoder := json.NewDecoder(r.Body)
+	for {
+		var record RecordV2
+		if err := decoder.Decode(&record); err != nil {
+			if err != io.EOF {
+				sessions.decodeFailed()
+				result.Error = err.Error()
+			}
+			break
+		}
+		if record.isEnd() {
+			cs.lg.Debugf("session %v/%v ended", s.meta.Tag, s.meta.ID)
+			ended = true
+			break
+		}
+		pending.Add(1)
+		sessions.writers.enqueue(s, &record, func(err error) {
+			defer pending.Done()
+			if err != nil {
+				cs.lg.Warnf("session %v/%v: %v", s.meta.Tag, s.meta.ID, err)
+				result.Dropped++
+				if err != errNoKeyframe && writeErr == nil {
+					writeErr = err
+				}
+			} else {
+				result.Records++
+			}
+			sessions.received(s, err)
+		})
+	}
+	pending.Wait()
+
+	status := http.StatusOK
+	if result.Error != "" {
+		status = http.StatusBadRequest
+	} else if writeErr != nil {
+		result.Error = writeErr.Error()
+		status = http.StatusInternalServerError
+	}
+	if status != http.StatusOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+	}
+	if err := writeJSON(w, &result); err != nil {
+		cs.lg.Errorln(err)
+	}
+}
+
+// ingestCloseHandler closes the session without waiting for the resume window.
+func (cs *chartServer) ingestCloseHandler(w http.ResponseWriter, r *http.Request) {
+	if sessions == nil {
+		http.Error(w, "HTTP ingestion needs resume enabled.", http.StatusServiceUnavailable)
+		return
+	}
+	if err := sessions.remove(mux.Vars(r)["token"]); err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,127 @@
+package topidchart
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newIngestServer(t *testing.T) *httptest.Server {
+	dataDir = t.TempDir()
+	sessions = newSessionMgr(testLogger, time.Minute, time.Hour, SyncNone)
+	t.Cleanup(func() {
+		sessions.closeAll()
+		sessions = nil
+	})
+	cs := &chartServer{ip: "host", chartport: "9998", dir: dataDir, lg: testLogger}
+	srv := httptest.NewServer(cs.router())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// ingest creates a session over HTTP and returns its records URL on srv.
+func ingest(t *testing.T, srv *httptest.Server) (string, *ingestResponse) {
+	resp, err := http.Post(srv.URL+"/ingest", "application/json", strings.NewReader(`{"Tag":"board1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var ir ingestResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ir); err != nil {
+		t.Fatal(err)
+	}
+	return srv.URL + ir.RecordsURL[strings.Index(ir.RecordsURL, "/ingest/"):], &ir
+}
+
+func postRecords(t *testing.T, url, records string) *ingestResult {
+	resp, err := http.Post(url, "application/x-ndjson", strings.NewReader(records))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result ingestResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return &result
+}
+
+func TestIngestStats(t *testing.T) {
+	srv := newIngestServer(t)
+	url, _ := ingest(t, srv)
+
+	check := func(live int) {
+		t.Helper()
+		st := sessions.stats()
+		if st.active != 1 || st.waiting != 0 || len(st.live) != live {
+			t.Errorf("got %d active, %d waiting, %d live", st.active, st.waiting, len(st.live))
+		}
+	}
+	check(0)
+	result := postRecords(t, url, `{"Timestamp":100,"Processes":[{"Pid":1,"Name":"init","Ucpu":1}]}`+"\n")
+	if result.Records != 1 {
+		t.Fatalf("got %+v", result)
+	}
+	check(1)
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	metrics, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(metrics), `topid_process_cpu_percent{tag="board1"`) {
+		t.Errorf("process metrics not exposed:\n%s", metrics)
+	}
+}
+
+func TestIngestEnd(t *testing.T) {
+	srv := newIngestServer(t)
+	url, ir := ingest(t, srv)
+
+	records := `{"Timestamp":100,"Processes":[{"Pid":1,"Name":"init","Ucpu":1}]}
+{"Timestamp":105,"Processes":[{"Pid":1,"Name":"init","Ucpu":2}]}
+{}
+{"Timestamp":110,"Processes":[{"Pid":1,"Name":"init","Ucpu":3}]}
+`
+	if result := postRecords(t, url, records); result.Records != 2 || result.Dropped != 0 || result.Error != "" {
+		t.Errorf("got %+v", result)
+	}
+	if st := sessions.stats(); st.active != 0 || st.waiting != 0 {
+		t.Errorf("got %d active, %d waiting after the end", st.active, st.waiting)
+	}
+
+	id := ir.ChartURL[strings.LastIndex(ir.ChartURL, "/")+1:]
+	meta, err := loadMeta(dataDir, "board1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.End == 0 {
+		t.Errorf("meta stored as %+v", meta)
+	}
+	var n int
+	walkRecords(fmt.Sprintf("%s/board1/process-%s.data", dataDir, id), func(r *pRecord) bool {
+		n++
+		return true
+	})
+	if n != 2 {
+		t.Errorf("got %d records, want 2", n)
+	}
+
+	resp, err := http.Post(url, "application/x-ndjson", strings.NewReader("{}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("post to the ended session: got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,273 @@
+package topidchart
+
+import (
+	"errors"
+	"sort"
+
+	as "github.com/godevsig/adaptiveservice"
+	"github.com/godevsig/glib/sys/log"
+)
+
+var errSessionNotLive = errors.New("session not live")
+
+// subscriberQueueSize is the max number of records queued for a subscriber,
+// the later records are dropped until the subscriber catches up.
+const subscriberQueueSize = 16
+
+// publish queues the record to the subscribers, it should be called with session lock held.
+func (s *session) publish(record *RecordV2) {
+	for _, ch := range s.subscribers {
+		select {
+		case ch <- record:
+		default:
+		}
+	}
+}
+
+// subscribe returns the channel of the records stored later, which is closed with the session.
+func (s *session) subscribe() (chan *RecordV2, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil, errSessionClosed
+	}
+	ch := make(chan *RecordV2, subscriberQueueSize)
+	s.subscribers = append(s.subscribers, ch)
+	return ch, nil
+}
+
+func (s *session) unsubscribe(ch chan *RecordV2) {
+	s.Lock()
+	defer s.Unlock()
+	for i, c := range s.subscribers {
+		if c == ch {
+			s.subscribers = append(s.subscribers[:i], s.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+// find returns the live session tag/id, the newest live session of the tag if id is empty.
+func (mgr *sessionMgr) find(tag, id string) *session {
+	mgr.Lock()
+	defer mgr.Unlock()
+	var found *session
+	for _, s := range mgr.sessions {
+		if s.meta.Tag != tag {
+			continue
+		}
+		if id == "" && (found == nil || s.meta.Start > found.meta.Start) {
+			found = s
+		} else if s.meta.ID == id {
+			return s
+		}
+	}
+	return found
+}
+
+// Handle handles SubscribeSession.
+func (msg *SubscribeSession) Handle(stream as.ContextStream) (reply interface{}) {
+	lg := stream.GetContext().(*log.Logger)
+
+	s := sessions.find(msg.Tag, msg.Session)
+	if s == nil {
+		return errSessionNotLive
+	}
+	ch, err := s.subscribe()
+	if err != nil {
+		return errSessionNotLive
+	}
+	go func() {
+		for r := range ch {
+			if err := stream.Send(r); err != nil {
+				lg.Debugf("subscriber of session %v/%v left: %v", s.meta.Tag, s.meta.ID, err)
+				s.unsubscribe(ch)
+				return
+			}
+		}
+		// an empty record marks the end
+		if err := stream.Send(&RecordV2{}); err != nil {
+			lg.Debugln(err)
+		}
+	}()
+	return s.meta.ID
+}
+
+// Filter selects the processes shown in the views, it is the same as
+// the filter, top and container URL parameters of the web views.
+type Filter struct {
+	CPUAvg    float32 // processes with both avg and max CPU under the thresholds are hidden
+	CPUMax    float32
+	MemAvg    float32 // processes with both avg and max MEM under the thresholds are hidden
+	MemMax    float32
+	Top       int    // show only the top N processes by avg CPU and by avg MEM, 0 means no limit
+	Container string // see the Containers section of README
+	Group     string // sum the processes by name or container, per process if empty
+}
+
+// DefaultFilter returns the default filter of the web views.
+func DefaultFilter() Filter {
+	return Filter{
+		CPUAvg: cpuavgThreshold,
+		CPUMax: cpumaxThreshold,
+		MemAvg: memavgThreshold,
+		MemMax: memmaxThreshold,
+	}
+}
+
+// LiveRow is a process or a group of processes in LiveTable, the CPU is in percent
+// of one core and the MEM in MB.
+type LiveRow struct {
+	Name      string // the series name of the charts, name-pid, the name of kernel threads or the group
+	Container string // the short container ID, empty if not in container
+	Alive     bool   // in the latest record
+	CPU       []float32
+	Mem       []float32
+	CPUAvg    float32
+	CPUMax    float32
+	MemAvg    float32
+	MemMax    float32
+}
+
+// LiveTable keeps the latest records of a session and selects the processes
+// by the same rules of the web views, to show the session in other forms.
+type LiveTable struct {
+	window  int
+	records []*pRecord
+}
+
+// NewLiveTable returns a LiveTable of the latest window records.
+func NewLiveTable(window int) *LiveTable {
+	if window <= 0 {
+		window = 1
+	}
+	return &LiveTable{window: window}
+}
+
+// Add adds the record, the oldest record is dropped if the window is full.
+// The record should be a full record, not delta encoded.
+func (lt *LiveTable) Add(r *RecordV2) {
+	lt.records = append(lt.records, &pRecord{r.Timestamp, r.Processes, r.Sys})
+	if len(lt.records) > lt.window {
+		lt.records = append(lt.records[:0], lt.records[len(lt.records)-lt.window:]...)
+	}
+}
+
+// Latest returns the timestamp and the system statistics of the latest record.
+func (lt *LiveTable) Latest() (int64, *SysStats) {
+	if len(lt.records) == 0 {
+		return 0, nil
+	}
+	r := lt.records[len(lt.records)-1]
+	return r.Timestamp, r.Sys
+}
+
+func (lt *LiveTable) analysis(container, group string) *processRecords {
+	prs := newRecords()
+	for _, r := range lt.records {
+		buf := *r
+		// filterContainer filters in place
+		buf.Processes = append([]ProcessInfoV2(nil), r.Processes...)
+		prs.add(&buf, container, group)
+	}
+	return prs
+}
+
+// Rows returns the processes selected by the filter in the window,
+// sorted by avg CPU in descending order.
+func (lt *LiveTable) Rows(f Filter) []LiveRow {
+	prs := lt.analysis(f.Container, f.Group)
+	if len(prs.time) == 0 {
+		return nil
+	}
+
+	containers := make(map[string]string)
+	alive := make(map[string]bool)
+	for i, r := range lt.records {
+		for j := range r.Processes {
+			name := groupName(r.Processes[j], f.Group)
+			containers[name] = containerName(&r.Processes[j])
+			if i == len(lt.records)-1 {
+				alive[name] = true
+			}
+		}
+	}
+
+	// applyFilter deletes the series not selected
+	cpu := make(map[string][]float32, len(prs.cpu))
+	mem := make(map[string][]float32, len(prs.mem))
+	for k, v := range prs.cpu {
+		cpu[k] = v
+		mem[k] = prs.mem[k]
+	}
+	prs.applyFilter(&filter{
+		cpuavg:    f.CPUAvg,
+		cpumax:    f.CPUMax,
+		memavg:    f.MemAvg,
+		memmax:    f.MemMax,
+		top:       f.Top,
+		container: f.Container,
+		group:     f.Group,
+	})
+
+	selected := make(map[string]bool)
+	for k := range prs.cpu {
+		selected[k] = true
+	}
+	for k := range prs.mem {
+		selected[k] = true
+	}
+	pad := func(v []float32) []float32 {
+		if len(v) < len(prs.time) {
+			v = append(v, make([]float32, len(prs.time)-len(v))...)
+		}
+		return v
+	}
+	rows := make([]LiveRow, 0, len(selected))
+	for k := range selected {
+		rows = append(rows, newLiveRow(k, containers[k], alive[k], pad(cpu[k]), pad(mem[k])))
+	}
+	sortRows(rows)
+	return rows
+}
+
+// ContainerRows returns the containers in the window as the Container CPU and MEM
+// panels of the web views, empty if no process is in container.
+func (lt *LiveTable) ContainerRows() []LiveRow {
+	prs := lt.analysis("", "")
+	prs.trimMetrics()
+	cpu, mem := prs.panels["ctrcpu"], prs.panels["ctrmem"]
+	zeros := make([]float32, len(prs.time))
+	var rows []LiveRow
+	for k := range prs.containers {
+		c, m := cpu[k], mem[k]
+		if c == nil && m == nil {
+			continue
+		}
+		if c == nil {
+			c = zeros
+		}
+		if m == nil {
+			m = zeros
+		}
+		rows = append(rows, newLiveRow(k, k, true, c, m))
+	}
+	sortRows(rows)
+	return rows
+}
+
+func newLiveRow(name, container string, alive bool, cpu, mem []float32) LiveRow {
+	row := LiveRow{Name: name, Container: container, Alive: alive, CPU: cpu, Mem: mem}
+	row.CPUMax, row.CPUAvg = maxAndAvg(cpu)
+	row.MemMax, row.MemAvg = maxAndAvg(mem)
+	return row
+}
+
+func sortRows(rows []LiveRow) {
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].CPUAvg != rows[j].CPUAvg {
+			return rows[i].CPUAvg > rows[j].CPUAvg
+		}
+		return rows[i].Name < rows[j].Name
+	})
+}
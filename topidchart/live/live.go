@@ -0,0 +1,429 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+	topid "github.com/godevsig/grepo/topidchart"
+)
+
+var stopped int32
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline returns the last width points of the series scaled to max.
+func sparkline(series []float32, max float32, width int) string {
+	if len(series) > width {
+		series = series[len(series)-width:]
+	}
+	var b strings.Builder
+	for i := len(series); i < width; i++ {
+		b.WriteByte(' ')
+	}
+	for _, v := range series {
+		i := 0
+		if max > 0 {
+			i = int(v / max * float32(len(sparks)-1))
+		}
+		if i < 0 {
+			i = 0
+		} else if i >= len(sparks) {
+			i = len(sparks) - 1
+		}
+		b.WriteRune(sparks[i])
+	}
+	return b.String()
+}
+
+func latest(series []float32) float32 {
+	if len(series) == 0 {
+		return 0
+	}
+	return series[len(series)-1]
+}
+
+// view is the state of the table changed by the keys.
+type view struct {
+	title   string
+	filter  topid.Filter
+	sortBy  string // cpu, avg, mem or name
+	reverse bool
+	group   bool   // group by container
+	alive   bool   // hide the exited processes, marked X in the S column
+	grep    string // show only the names containing grep
+	prompt  string // the prompt of the line being input, empty if none
+	input   []byte
+	ended   bool
+	width   int // width of the sparklines
+}
+
+const help = "keys: c/a/m/n sort by cpu/avg cpu/mem/name, r reverse, +/- top N, / name filter, " +
+	"x container filter, g group by container, h hide exited, q quit"
+
+func (v *view) sortRows(rows []topid.LiveRow) {
+	less := func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		switch v.sortBy {
+		case "cpu":
+			if latest(a.CPU) != latest(b.CPU) {
+				return latest(a.CPU) > latest(b.CPU)
+			}
+		case "mem":
+			if latest(a.Mem) != latest(b.Mem) {
+				return latest(a.Mem) > latest(b.Mem)
+			}
+		case "avg":
+			if a.CPUAvg != b.CPUAvg {
+				return a.CPUAvg > b.CPUAvg
+			}
+		}
+		return a.Name < b.Name
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if v.reverse {
+			return less(j, i)
+		}
+		return less(i, j)
+	})
+}
+
+func (v *view) render(table *topid.LiveTable) {
+	var rows []topid.LiveRow
+	if v.group {
+		rows = table.ContainerRows()
+	} else {
+		rows = table.Rows(v.filter)
+	}
+	shown := rows[:0]
+	for _, row := range rows {
+		if v.grep != "" && !strings.Contains(row.Name, v.grep) {
+			continue
+		}
+		if v.alive && !row.Alive {
+			continue
+		}
+		shown = append(shown, row)
+	}
+	v.sortRows(shown)
+
+	var b strings.Builder
+	// clear the screen and move to the top left
+	b.WriteString("\033[H\033[2J")
+	ts, sys := table.Latest()
+	status := "live"
+	if v.ended {
+		status = "ended"
+	}
+	fmt.Fprintf(&b, "%s  %s  [%s]\n", v.title, time.Unix(ts, 0).Format("2006-01-02 15:04:05"), status)
+	if sys != nil {
+		fmt.Fprintf(&b, "sys: cpu %.1f%%  load %.2f %.2f %.2f  mem free %dMB available %dMB\n",
+			sys.CPU, sys.Load1, sys.Load5, sys.Load15, sys.MemFree/1024, sys.MemAvailable/1024)
+	}
+	container := v.filter.Container
+	if container == "" {
+		container = "all"
+	}
+	fmt.Fprintf(&b, "sort: %s  top: %d  filter: %g,%g,%g,%g  name: %q  container: %s  grouped: %v\n",
+		v.sortBy, v.filter.Top, v.filter.CPUAvg, v.filter.CPUMax, v.filter.MemAvg, v.filter.MemMax,
+		v.grep, container, v.group)
+	fmt.Fprintf(&b, "%s\n\n", help)
+
+	fmt.Fprintf(&b, "%-24s %1s %-12s %7s %7s %7s %-*s %9s %-*s\n", "NAME", "S", "CONTAINER", "CPU%", "AVG", "MAX",
+		v.width, "CPU HISTORY", "MEM(MB)", v.width, "MEM HISTORY")
+	for _, row := range shown {
+		name := row.Name
+		if len(name) > 24 {
+			name = name[:24]
+		}
+		state := ""
+		if !row.Alive {
+			state = "X"
+		}
+		// scale the CPU sparklines to one core at least, so that idle processes stay flat
+		cpuScale := row.CPUMax
+		if cpuScale < 100 {
+			cpuScale = 100
+		}
+		fmt.Fprintf(&b, "%-24s %1s %-12s %7.1f %7.1f %7.1f %s %9.0f %s\n", name, state, row.Container,
+			latest(row.CPU), row.CPUAvg, row.CPUMax, sparkline(row.CPU, cpuScale, v.width),
+			latest(row.Mem), sparkline(row.Mem, row.MemMax, v.width))
+	}
+	if v.prompt != "" {
+		fmt.Fprintf(&b, "\n%s: %s", v.prompt, v.input)
+	}
+	fmt.Print(b.String())
+}
+
+// key handles the key, and returns false to quit.
+func (v *view) key(c byte) bool {
+	if v.prompt != "" {
+		switch c {
+		case '\r', '\n':
+			if v.prompt == "name" {
+				v.grep = string(v.input)
+			} else {
+				v.filter.Container = string(v.input)
+			}
+			v.prompt = ""
+		case 27: // esc
+			v.prompt = ""
+		case 127, 8: // backspace
+			if len(v.input) != 0 {
+				v.input = v.input[:len(v.input)-1]
+			}
+		default:
+			v.input = append(v.input, c)
+		}
+		return true
+	}
+
+	switch c {
+	case 'q':
+		return false
+	case 'c':
+		v.sortBy = "cpu"
+	case 'a':
+		v.sortBy = "avg"
+	case 'm':
+		v.sortBy = "mem"
+	case 'n':
+		v.sortBy = "name"
+	case 'r':
+		v.reverse = !v.reverse
+	case '+':
+		v.filter.Top++
+	case '-':
+		if v.filter.Top > 0 {
+			v.filter.Top--
+		}
+	case '/':
+		v.prompt, v.input = "name", []byte(v.grep)
+	case 'x':
+		v.prompt, v.input = "container (host for the processes not in container)", []byte(v.filter.Container)
+	case 'g':
+		v.group = !v.group
+	case 'h':
+		v.alive = !v.alive
+	}
+	return true
+}
+
+// rawTerminal puts the terminal into cbreak mode to read the keys one by one,
+// and returns the function to restore it.
+func rawTerminal() (restore func(), err error) {
+	stty := func(args ...string) (string, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	state, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("cbreak", "-echo"); err != nil {
+		return nil, err
+	}
+	return func() { stty(state) }, nil
+}
+
+// subscribe subscribes to the live session, or asks the server to replay the
+// session if it is not live. It returns the ID of the session.
+func subscribe(c *as.Client, tag, session string, replay bool, speed float64) (as.Connection, string, error) {
+	connect := func() (as.Connection, error) {
+		conn := <-c.Discover("platform", "topidchart")
+		if conn == nil {
+			return nil, errors.New("connect to topidchart failed")
+		}
+		return conn, nil
+	}
+
+	if !replay {
+		conn, err := connect()
+		if err != nil {
+			return nil, "", err
+		}
+		var id string
+		err = conn.SendRecv(&topid.SubscribeSession{Tag: tag, Session: session}, &id)
+		if err == nil {
+			return conn, id, nil
+		}
+		conn.Close()
+		if session == "" {
+			return nil, "", fmt.Errorf("subscribe to %v: %v", tag, err)
+		}
+	}
+
+	conn, err := connect()
+	if err != nil {
+		return nil, "", err
+	}
+	msg := topid.ReplaySession{Tag: tag, Session: session, Speed: speed}
+	if err := conn.SendRecv(&msg, nil); err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("replay %v/%v: %v", tag, session, err)
+	}
+	return conn, session, nil
+}
+
+func parseFilter(s string, f *topid.Filter) error {
+	values := strings.Split(s, ",")
+	if len(values) != 4 {
+		return fmt.Errorf("invalid filter %q", s)
+	}
+	var v [4]float32
+	for i := range values {
+		f, err := strconv.ParseFloat(strings.TrimSpace(values[i]), 32)
+		if err != nil {
+			return fmt.Errorf("invalid filter %q", s)
+		}
+		v[i] = float32(f)
+	}
+	f.CPUAvg, f.CPUMax, f.MemAvg, f.MemMax = v[0], v[1], v[2], v[3]
+	return nil
+}
+
+// Start starts the app
+func Start(args []string) (err error) {
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(os.Stdout)
+
+	def := topid.DefaultFilter()
+	tag := flags.String("tag", "", "tag of the session")
+	session := flags.String("session", "", "session to view, the newest live session of the tag if not set")
+	replay := flags.Bool("replay", false, "replay the stored session instead of subscribing to it")
+	speed := flags.Float64("speed", 1, "replay speed of the finished sessions, 0 for max speed")
+	top := flags.Int("top", 10, "show only the top N processes by avg CPU and by avg MEM, 0 means no limit")
+	filterArg := flags.String("filter", fmt.Sprintf("%g,%g,%g,%g", def.CPUAvg, def.CPUMax, def.MemAvg, def.MemMax),
+		"hide the processes under the thresholds of avg CPU, max CPU, avg MEM and max MEM, as the web views")
+	container := flags.String("container", "", "show only the processes in the container, host for the processes not in container")
+	sortBy := flags.String("sort", "avg", "sort by cpu, avg, mem or name")
+	window := flags.Int("window", 60, "number of the latest records the averages and the sparklines are computed on")
+	width := flags.Int("width", 30, "width of the sparklines")
+
+	if err = flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			err = nil
+		}
+		return err
+	}
+	if *tag == "" {
+		return errors.New("-tag is required")
+	}
+	if *replay && *session == "" {
+		return errors.New("-session is required to replay")
+	}
+
+	v := &view{sortBy: *sortBy, width: *width}
+	v.filter.Top = *top
+	v.filter.Container = *container
+	if err := parseFilter(*filterArg, &v.filter); err != nil {
+		return err
+	}
+
+	c := as.NewClient().SetDiscoverTimeout(3)
+	conn, id, err := subscribe(c, *tag, *session, *replay, *speed)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	v.title = fmt.Sprintf("topid %v/%v", *tag, id)
+
+	records := make(chan *topid.RecordV2, 16)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			r := &topid.RecordV2{}
+			if err := conn.Recv(r); err != nil {
+				recvErr <- err
+				return
+			}
+			if r.Timestamp == 0 {
+				close(records)
+				return
+			}
+			records <- r
+		}
+	}()
+
+	keys := make(chan byte)
+	restore, err := rawTerminal()
+	// without a terminal, e.g. in a pipe, there are no keys and the app quits when the session ends
+	interactive := err == nil
+	if interactive {
+		defer restore()
+		go func() {
+			buf := make([]byte, 1)
+			for {
+				if n, err := os.Stdin.Read(buf); err != nil || n == 0 {
+					return
+				}
+				keys <- buf[0]
+			}
+		}()
+	}
+
+	table := topid.NewLiveTable(*window)
+	// the records of a fast replay are rendered at most every refresh
+	const refresh = 200 * time.Millisecond
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	var rendered time.Time
+	dirty := false
+	for atomic.LoadInt32(&stopped) == 0 {
+		select {
+		case r, ok := <-records:
+			if !ok {
+				records = nil
+				v.ended = true
+				v.render(table)
+				if !interactive {
+					return nil
+				}
+				continue
+			}
+			table.Add(r)
+			dirty = true
+		case c := <-keys:
+			if !v.key(c) {
+				fmt.Println()
+				return nil
+			}
+			dirty = true
+			rendered = time.Time{}
+		case err := <-recvErr:
+			fmt.Println()
+			return err
+		case <-ticker.C:
+		}
+		if dirty && time.Since(rendered) >= refresh {
+			v.render(table)
+			rendered = time.Now()
+			dirty = false
+		}
+	}
+	fmt.Println()
+	return nil
+}
+
+// Stop stops the app
+func Stop() {
+	fmt.Println("topid live stopping...")
+	atomic.StoreInt32(&stopped, 1)
+}
+
+func main() {
+	if err := Start(os.Args[1:]); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,227 @@
+package topidchart
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/go-echarts/go-echarts/v2/components"
+	as "github.com/godevsig/adaptiveservice"
+	"github.com/godevsig/grepo/recorder"
+	"github.com/gorilla/mux"
+)
+
+var errNoRecorder = errors.New("recorder server not found")
+
+// defaultLogsAround is the default seconds of the logs shown before and after the time.
+const defaultLogsAround = 10
+
+// logQuerier queries the recorder server on a cached connection.
+type logQuerier struct {
+	sync.Mutex
+	conn as.Connection
+}
+
+// query returns the lines recorded by the recorder sessions of the tag
+// between from and to, in unix time in seconds. The connection is discovered
+// again if the query fails on the cached one, e.g. the recorder restarted.
+func (lq *logQuerier) query(tag string, from, to int64) ([]recorder.LogLine, error) {
+	lq.Lock()
+	defer lq.Unlock()
+
+	msg := &recorder.LogQuery{Tag: tag, From: from * 1000, To: to*1000 + 999}
+	var err error
+	for retry := 0; retry < 2; retry++ {
+		if lq.conn == nil {
+			c := as.NewClient().SetDiscoverTimeout(0)
+			lq.conn = <-c.Discover("platform", "recorder")
+			if lq.conn == nil {
+				return nil, errNoRecorder
+			}
+		}
+		var rep recorder.LogLines
+		if err = lq.conn.SendRecv(msg, &rep); err == nil {
+			return rep.Lines, nil
+		}
+		lq.conn.Close()
+		lq.conn = nil
+	}
+	return nil, err
+}
+
+func (lq *logQuerier) close() {
+	lq.Lock()
+	defer lq.Unlock()
+	if lq.conn != nil {
+		lq.conn.Close()
+		lq.conn = nil
+	}
+}
+
+// logTag returns the recorder tag linked to the session, the same tag by default.
+func logTag(r *http.Request) string {
+	if tag := r.URL.Query().Get("logtag"); tag != "" {
+		return tag
+	}
+	return mux.Vars(r)["tag"]
+}
+
+// logLinesHandler returns the recorder lines around the at parameter in JSON.
+func (cs *chartServer) logLinesHandler(w http.ResponseWriter, r *http.Request) {
+	at := queryInt64(r, "at")
+	around := queryInt64(r, "around")
+	if around <= 0 {
+		around = defaultLogsAround
+	}
+
+	var result struct {
+		Lines []recorder.LogLine
+		Error string `json:",omitempty"`
+	}
+	lines, err := cs.logs.query(logTag(r), at-around, at+around)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.Lines = lines
+	if result.Lines == nil {
+		result.Lines = []recorder.LogLine{}
+	}
+	if err := writeJSON(w, &result); err != nil {
+		cs.lg.Errorln(err)
+	}
+}
+
+// logsJS returns the js of the logs panel under the CPU and MEM charts. Hovering
+// the charts shows the lines around the time, clicking a line jumps the charts to it.
+func (prs *processRecords) logsJS(cpuID, memID, tag string, around int64) string {
+	stamps, _ := json.Marshal(prs.stamps)
+	query := "&around=" + strconv.FormatInt(around, 10)
+	if tag != "" {
+		query += "&logtag=" + url.QueryEscape(tag)
+	}
+	return fmt.Sprintf(`var stamps = %[1]s;
+					var logCharts = [[goecharts_%[2]s, option_%[2]s], [goecharts_%[3]s, option_%[3]s]];
+					var panel = document.createElement("div");
+					panel.id = "logpanel";
+					panel.style = "clear:both;margin-left:200px;width:1400px;height:300px;overflow:auto;font-family:monospace;font-size:12px;white-space:pre;border:1px solid #ccc";
+					panel.textContent = "Hover over the charts to show the logs around the time.";
+					document.body.appendChild(panel);
+					var shown = -1;
+					var pending = null;
+					function indexOf(ts){
+						var i = 0;
+						while(i < stamps.length-1 && stamps[i+1] <= ts){ i++; }
+						return i;
+					}
+					function jump(ts){
+						var i = indexOf(ts);
+						for(var k in logCharts){
+							var c = logCharts[k];
+							if(c[1].series.length > 0){
+								c[1].series[0].markLine = {symbol:"none", data:[{xAxis:i}]};
+								c[0].setOption(c[1]);
+							}
+							c[0].dispatchAction({type:"dataZoom", startValue:Math.max(i-30, 0), endValue:i+30});
+						}
+					}
+					function showLogs(i){
+						if(i == shown || i < 0 || i >= stamps.length){ return; }
+						shown = i;
+						var at = stamps[i];
+						fetch(location.pathname + "/lines?at=" + at + "%[4]s").then(function(r){ return r.json(); }).then(function(data){
+							if(shown != i){ return; }
+							panel.textContent = "";
+							if(data.Error){
+								panel.textContent = data.Error;
+								return;
+							}
+							if(data.Lines.length == 0){
+								panel.textContent = "No logs around " + new Date(at*1000).toLocaleString() + ".";
+								return;
+							}
+							var nearest = null;
+							data.Lines.forEach(function(line){
+								var div = document.createElement("div");
+								var t = new Date(line.Time);
+								div.textContent = t.toLocaleTimeString() + "." + String(line.Time%%1000).padStart(3, "0") + " [" + line.Session + "] " + line.Text;
+								div.style.cursor = "pointer";
+								div.title = "click to jump the charts to this line";
+								div.onclick = function(){
+									jump(Math.floor(line.Time/1000));
+									panel.querySelectorAll("div").forEach(function(d){ d.style.background = ""; });
+									this.style.background = "#FCF3CF";
+								};
+								if(nearest == null && line.Time >= at*1000){
+									nearest = div;
+									div.style.background = "#D6EAF8";
+								}
+								panel.appendChild(div);
+							});
+							if(nearest != null){
+								panel.scrollTop = nearest.offsetTop - panel.offsetTop - 100;
+							}
+						});
+					}
+					for(var k in logCharts){
+						logCharts[k][0].on("updateAxisPointer", function(e){
+							if(e.axesInfo.length == 0){ return; }
+							var i = e.axesInfo[0].value;
+							clearTimeout(pending);
+							pending = setTimeout(function(){ showLogs(i); }, 200);
+						});
+					}
+					var focus = %[5]d;
+					if(focus >= 0){ showLogs(focus); }
+					var base = location.pathname.replace(/\/logs$/, "");
+					var views = {snapshot:"/snapshot", info:"/info", pieview:"/pie", treeview:"/tree"};
+					Object.keys(views).forEach(function(id){
+						document.getElementById(id).onclick = function(){ location.href = base + views[id]; };
+					});
+					var btn = document.getElementById("logs");
+					btn.value = "LINEVIEW";
+					btn.onclick = function(){ location.href = base + location.search; };`,
+		stamps, cpuID, memID, query, prs.focus)
+}
+
+// logsHandler shows the CPU and MEM charts with the recorder logs of the same tag,
+// or the tag set by the logtag parameter.
+func (cs *chartServer) logsHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	tag := params["tag"]
+	in := fmt.Sprintf("%v/%v/process-%v.data", cs.dir, tag, params["session"])
+	if _, err := os.Stat(in); err != nil {
+		http.Error(w, "Session not found.", 404)
+		return
+	}
+
+	vars := r.URL.Query()
+	records := newRecords()
+	if err := records.analysis(in, cs.parseFilter(tag, vars)); err != nil {
+		cs.lg.Errorln(err)
+		return
+	}
+	if at := vars.Get("at"); at != "" {
+		ts, _ := strconv.ParseInt(at, 10, 64)
+		records.focusOn(ts)
+	}
+	around := queryInt64(r, "around")
+	if around <= 0 {
+		around = defaultLogsAround
+	}
+
+	cpu := records.lineCPU()
+	mem := records.lineMEM()
+	mem.AddJSFuncs(records.logsJS(cpu.ChartID, mem.ChartID, vars.Get("logtag"), around))
+
+	cs.updatePageTpl()
+	page := components.NewPage()
+	page.PageTitle = "Performance Analysis Tool"
+	page.AddCharts(cpu, mem)
+	page.SetLayout(components.PageFlexLayout)
+	page.Render(w)
+}
@@ -4,6 +4,26 @@ import (
 	as "github.com/godevsig/adaptiveservice"
 )
 
+// The message types below are encoded by position without the field names, so
+// the layout of a released message must never change, a new type is added instead.
+// SessionRequest, SessionResponse, Record, ProcessInfo and SysInfo are the messages
+// of the clients built before versioning, the newer clients use SessionRequestV2.
+
+// ProtocolVersion is the version of SessionRequestV2, it is increased on the changes
+// that older servers or clients can not handle. SessionRequest is version 1.
+// Optional features that do not break the older peers are advertised as capabilities.
+const ProtocolVersion = 2
+
+// The capabilities of the optional features.
+const (
+	CapDelta      = "delta"      // delta mode, see RecordV2
+	CapSys        = "sys"        // RecordV2.Sys
+	CapSnapshot   = "snapshot"   // RecordV2.Snapshot
+	CapExtMetrics = "extmetrics" // the extended statistics in ProcessInfoV2
+	CapThreads    = "threads"    // ProcessInfoV2.Threads
+	CapContainers = "containers" // ProcessInfoV2.Cgroup and ContainerID
+)
+
 // SessionRequest is the message sent by client.
 // Return SessionResponse.
 // Client should send one or more Record after SessionResponse is received.
@@ -41,10 +61,162 @@ type SysInfo struct {
 	KernelInfo string
 }
 
+// SessionRequestV2 is the message sent by client.
+// Return SessionResponseV2.
+// Client should send one or more RecordV2 after SessionResponseV2 is received,
+// and an empty RecordV2 at the end, then the server closes the session right away.
+// Without it, the session is kept for ResumeSession within the resume window.
+// If Records fail to be stored, e.g. on disk full, the server sends an error on the
+// stream, once until a Record is stored again.
+//
+// Version is the ProtocolVersion of the client, and Capabilities are the optional
+// features the client uses. The server rejects the request with an error if it does
+// not support the version or any of the capabilities.
+type SessionRequestV2 struct {
+	Version      int
+	Capabilities []string
+	Tag          string
+	SysInfo      SysInfoV2
+	ExtraInfo    string
+	Delta        bool              // ask for delta mode, see RecordV2, same as CapDelta
+	RunID        string            // optional, sessions with the same RunID are shown together in the run dashboard
+	Labels       map[string]string // optional, e.g. build ID, branch, board type or test name
+}
+
+// SessionResponseV2 is the message replied by server.
+type SessionResponseV2 struct {
+	Version          int      // ProtocolVersion of the server
+	Capabilities     []string // the optional features the server supports
+	ChartURL         string
+	Delta            bool   // delta mode accepted
+	KeyframeInterval int    // in delta mode, client should send a keyframe at least every KeyframeInterval records
+	ResumeToken      string // used by ResumeSession
+	RunURL           string // the run dashboard if RunID was set
+}
+
+// ResumeSession is the message sent by client to continue a session after
+// the stream carrying its Records broke, e.g. on network outage.
+// Return SessionResponseV2 of the resumed session or error if the token has expired.
+// Client should send RecordV2 after SessionResponseV2 is received, in delta mode
+// starting with a keyframe.
+// Version and Capabilities are checked as in SessionRequestV2, the client that
+// resumes may be upgraded or not the one that created the session.
+type ResumeSession struct {
+	Token        string
+	Version      int
+	Capabilities []string
+}
+
+// ReplaySession is the message sent by subscriber to get the stored Records
+// of the session Tag/Session, at Speed times the pace they were recorded, 0 for max speed.
+// Return 0 or error if the session is not found, then the Records are sent as RecordV2
+// with timestamps rebased to the current time, followed by an empty RecordV2 marking the end.
+type ReplaySession struct {
+	Tag     string
+	Session string
+	Speed   float64
+}
+
+// SubscribeSession is the message sent by subscriber to get the Records of the live
+// session Tag/Session as they are stored, the newest live session of the Tag if Session is empty.
+// Return the ID of the session or error if no such session is live, then the Records are
+// sent as RecordV2 as they are stored, followed by an empty RecordV2 when the session is closed.
+// Records are dropped if the subscriber does not keep up.
+type SubscribeSession struct {
+	Tag     string
+	Session string
+}
+
+// ProcessInfoV2 is process statistics.
+type ProcessInfoV2 struct {
+	Pid  int
+	Name string
+	Ucpu float32
+	Scpu float32
+	Mem  uint64 // in KB
+	Ppid int    // parent pid, optional, 0 if not collected
+
+	// Optional extended statistics, zero if not collected.
+	// Counters are accumulated in the interval since the previous Record.
+	ReadBytes  uint64 // bytes read from storage
+	WriteBytes uint64 // bytes written to storage
+	VolCtxsw   uint64 // voluntary context switches
+	InvolCtxsw uint64 // involuntary context switches
+	NumThreads int
+	NumFDs     int // number of open file descriptors
+
+	Cgroup      string // optional cgroup path, e.g. /system.slice/docker-<id>.scope
+	ContainerID string // optional container ID in lower case hex, empty for the processes not in container
+
+	Threads []ThreadInfo // optional per thread statistics
+}
+
+// ThreadInfo is thread statistics of a process.
+type ThreadInfo struct {
+	Tid  int
+	Name string
+	Ucpu float32
+	Scpu float32
+}
+
+// RecordV2 is sent by client periodically including target processes info,
+// an optional snapshot such as process tree, and timestamp.
+//
+// In delta mode, the first Record must be a keyframe that has Keyframe set
+// and carries all the processes. The later Records carry only the processes
+// that have changed since the previous Record, with empty Name, the names of
+// the processes new since the previous Record are in Names, and the pids of
+// the exited processes are in Gone. Records received before a keyframe are dropped,
+// so periodic keyframes allow the server to recover.
+type RecordV2 struct {
+	Timestamp int64
+	Processes []ProcessInfoV2
+	Snapshot  string
+	Sys       *SysStats // optional system wide statistics
+
+	Keyframe bool
+	Names    map[int]string // pid to process name dictionary
+	Gone     []int
+}
+
+// SysStats is system wide statistics, all memory sizes are in KB.
+type SysStats struct {
+	CPU          float32   // total CPU usage in percent of the whole machine
+	PerCore      []float32 // CPU usage in percent of each core
+	Load1        float32
+	Load5        float32
+	Load15       float32
+	MemFree      uint64
+	MemAvailable uint64
+	SwapTotal    uint64
+	SwapFree     uint64
+}
+
+// SysInfoV2 is part of SessionRequestV2 used to initiate a collecting session.
+// CPUInfo and KernelInfo are free-form text, the other fields are optional
+// structured info, zero if not collected.
+type SysInfoV2 struct {
+	CPUInfo    string
+	KernelInfo string
+
+	NumCPU        int
+	CPUModel      string
+	MemTotal      uint64 // in KB
+	KernelVersion string
+	Arch          string
+	Hostname      string
+}
+
 func init() {
 	as.RegisterType((*SessionRequest)(nil))
 	as.RegisterType((*SessionResponse)(nil))
 	as.RegisterType((*Record)(nil))
+	as.RegisterType((*SessionRequestV2)(nil))
+	as.RegisterType((*SessionResponseV2)(nil))
+	as.RegisterType((*ResumeSession)(nil))
+	as.RegisterType((*ReplaySession)(nil))
+	as.RegisterType((*SubscribeSession)(nil))
+	as.RegisterType((*RecordV2)(nil))
 }
 
 //go:generate mkdir -p $GOPACKAGE
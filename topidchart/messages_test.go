@@ -0,0 +1,185 @@
+package topidchart
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+	"github.com/godevsig/glib/sys/log"
+	"github.com/niubaoshu/gotiny"
+)
+
+var testLogger = func() *log.Logger {
+	stream := log.NewStream("")
+	stream.SetOutputter(ioutil.Discard)
+	return stream.NewLogger("test", log.Linfo)
+}()
+
+// The layouts of the messages of the clients built before versioning,
+// as in the topidchartmsg copies they were built with.
+type v1SessionRequest struct {
+	Tag       string
+	SysInfo   v1SysInfo
+	ExtraInfo string
+}
+
+type v1SessionResponse struct {
+	ChartURL string
+}
+
+type v1ProcessInfo struct {
+	Pid  int
+	Name string
+	Ucpu float32
+	Scpu float32
+	Mem  uint64
+}
+
+type v1Record struct {
+	Timestamp int64
+	Processes []v1ProcessInfo
+	Snapshot  string
+}
+
+type v1SysInfo struct {
+	CPUInfo    string
+	KernelInfo string
+}
+
+func v1Records() []v1Record {
+	return []v1Record{
+		{Timestamp: 100, Processes: []v1ProcessInfo{{1, "init", 0.5, 0.25, 1024}, {42, "app", 10, 5, 2048}}, Snapshot: "ps"},
+		{Timestamp: 105, Processes: []v1ProcessInfo{{42, "app", 20, 1, 4096}}},
+		{}, // the end
+	}
+}
+
+func TestLegacyLayout(t *testing.T) {
+	req := v1SessionRequest{Tag: "board1", SysInfo: v1SysInfo{"cpu", "kernel"}, ExtraInfo: "extra"}
+	buf := gotiny.Marshal(&req)
+	var msg SessionRequest
+	gotiny.Unmarshal(buf, &msg)
+	if msg.Tag != "board1" || msg.SysInfo.CPUInfo != "cpu" || msg.SysInfo.KernelInfo != "kernel" || msg.ExtraInfo != "extra" {
+		t.Errorf("SessionRequest decoded as %+v", msg)
+	}
+	if !bytes.Equal(gotiny.Marshal(&msg), buf) {
+		t.Error("SessionRequest layout changed")
+	}
+
+	resp := SessionResponse{ChartURL: "http://host/board1/1"}
+	var v1resp v1SessionResponse
+	gotiny.Unmarshal(gotiny.Marshal(&resp), &v1resp)
+	if v1resp.ChartURL != resp.ChartURL {
+		t.Errorf("SessionResponse decoded as %+v", v1resp)
+	}
+
+	for _, v1rec := range v1Records() {
+		buf := gotiny.Marshal(&v1rec)
+		var rec Record
+		gotiny.Unmarshal(buf, &rec)
+		if !bytes.Equal(gotiny.Marshal(&rec), buf) {
+			t.Errorf("Record layout changed: %+v", rec)
+		}
+		if rec.Timestamp != v1rec.Timestamp || rec.Snapshot != v1rec.Snapshot || len(rec.Processes) != len(v1rec.Processes) {
+			t.Errorf("Record decoded as %+v", rec)
+			continue
+		}
+		for i, p := range rec.Processes {
+			if v1ProcessInfo(p) != v1rec.Processes[i] {
+				t.Errorf("ProcessInfo decoded as %+v", p)
+			}
+		}
+	}
+}
+
+// legacyStream is the stream of a legacy client, the messages are gotiny encoded
+// by the client and decoded by the server.
+type legacyStream struct {
+	as.ContextStream
+	msgs [][]byte
+	sent []interface{}
+}
+
+func (ls *legacyStream) GetContext() interface{} {
+	return testLogger
+}
+
+func (ls *legacyStream) Recv(msgPtr interface{}) error {
+	if len(ls.msgs) == 0 {
+		return io.EOF
+	}
+	gotiny.Unmarshal(ls.msgs[0], msgPtr)
+	ls.msgs = ls.msgs[1:]
+	return nil
+}
+
+func (ls *legacyStream) Send(msg interface{}) error {
+	ls.sent = append(ls.sent, msg)
+	return nil
+}
+
+func TestLegacySession(t *testing.T) {
+	t.Run("end", func(t *testing.T) { testLegacySession(t, v1Records()) })
+	// legacy sessions can not be resumed, so they are closed when the stream breaks
+	t.Run("broken", func(t *testing.T) { testLegacySession(t, v1Records()[:2]) })
+}
+
+func testLegacySession(t *testing.T, records []v1Record) {
+	dataDir = t.TempDir()
+	sessions = newSessionMgr(testLogger, time.Minute, time.Hour, SyncNone)
+	defer func() { sessions = nil }()
+
+	var req SessionRequest
+	gotiny.Unmarshal(gotiny.Marshal(&v1SessionRequest{Tag: "board1", SysInfo: v1SysInfo{"cpu", "kernel"}}), &req)
+	stream := &legacyStream{}
+	for _, v1rec := range records {
+		stream.msgs = append(stream.msgs, gotiny.Marshal(&v1rec))
+	}
+
+	resp, ok := req.Handle(stream).(*SessionResponse)
+	if !ok {
+		t.Fatalf("got %#v, want *SessionResponse", resp)
+	}
+	live := func() int {
+		sessions.Lock()
+		defer sessions.Unlock()
+		return len(sessions.sessions)
+	}
+	for i := 0; i < 100 && live() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := live(); n != 0 {
+		t.Fatalf("%d sessions live after the end", n)
+	}
+
+	id := path.Base(resp.ChartURL)
+	meta, err := loadMeta(dataDir, "board1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.SysInfo.CPUInfo != "cpu" || meta.SysInfo.KernelInfo != "kernel" || meta.End == 0 {
+		t.Errorf("meta stored as %+v", meta)
+	}
+	var got []pRecord
+	file := fmt.Sprintf("%s/board1/process-%s.data", dataDir, id)
+	err = walkRecords(file, func(r *pRecord) bool {
+		got = append(got, *r)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []pRecord{
+		{100, []ProcessInfoV2{{Pid: 1, Name: "init", Ucpu: 0.5, Scpu: 0.25, Mem: 1024}, {Pid: 42, Name: "app", Ucpu: 10, Scpu: 5, Mem: 2048}}, nil},
+		{105, []ProcessInfoV2{{Pid: 42, Name: "app", Ucpu: 20, Scpu: 1, Mem: 4096}}, nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got records %+v, want %+v", got, want)
+	}
+}
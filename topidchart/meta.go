@@ -0,0 +1,195 @@
+package topidchart
+
+import (
+	"encoding/gob"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sessionMeta is the structured info of a collecting session,
+// saved in meta-<id>.data along with the other data files of the session.
+type sessionMeta struct {
+	Tag       string
+	ID        string
+	Start     int64 // unix time the session was created
+	SysInfo   SysInfoV2
+	ExtraInfo string
+	Gaps      []gap  // outages the session was resumed from
+	RunID     string // the run the session joined, empty if none
+	Labels    map[string]string
+	End       int64 // unix time the session was closed, 0 if still open or not closed cleanly
+}
+
+// gap is a period in unix time without records.
+type gap struct {
+	From int64
+	To   int64
+}
+
+func metaFile(dir, tag, id string) string {
+	return fmt.Sprintf("%v/%v/meta-%v.data", dir, tag, id)
+}
+
+// saveMeta writes the meta to a temp file then renames it,
+// so readers never see a partially written meta.
+func saveMeta(dir string, meta *sessionMeta) error {
+	filename := metaFile(dir, meta.Tag, meta.ID)
+	tmp, err := ioutil.TempFile(path.Dir(filename), ".meta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(meta); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// loadMeta reads the meta of the session, sessions created by older servers have no meta.
+func loadMeta(dir, tag, id string) (*sessionMeta, error) {
+	return readMeta(metaFile(dir, tag, id))
+}
+
+func readMeta(filename string) (*sessionMeta, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	meta := &sessionMeta{}
+	if err := gob.NewDecoder(f).Decode(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+type infoPage struct {
+	Tag      string
+	Session  string
+	Meta     *sessionMeta
+	Start    string
+	Duration time.Duration
+	MemTotal uint64 // in MB
+	Raw      string // info text of sessions without meta
+	Gaps     []gapView
+}
+
+type gapView struct {
+	From     string
+	To       string
+	Duration time.Duration
+}
+
+const infoTpl = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="UTF-8">
+	<title>Info of {{.Tag}}/{{.Session}}</title>
+	<style>
+		body { font: 14px Sans-Serif; color: #333; margin: 20px; }
+		table { border-collapse: collapse; }
+		th, td { text-align: left; padding: 4px 12px; border-bottom: 1px solid #ddd; }
+		th { background: #eee; }
+		pre { background: #f7f7f7; padding: 8px; overflow-x: auto; }
+		a { color: #2980B9; text-decoration: none; }
+	</style>
+</head>
+<body>
+<p><a href="/{{.Tag}}/{{.Session}}">&#x1F680; CHART</a></p>
+{{- with .Meta}}
+<h3>System</h3>
+<table>
+	<tr><th>Tag</th><td>{{.Tag}}</td></tr>
+	<tr><th>Session</th><td>{{.ID}}</td></tr>
+	<tr><th>Started</th><td>{{$.Start}}</td></tr>
+	{{- if .End}}
+	<tr><th>Duration</th><td>{{$.Duration}}</td></tr>
+	{{- end}}
+	{{- range $k, $v := .Labels}}
+	<tr><th>{{$k}}</th><td><a href="/history?label={{$k}}={{$v}}">{{$v}}</a></td></tr>
+	{{- end}}
+	{{- if .RunID}}
+	<tr><th>Run</th><td><a href="/run/{{.RunID}}">{{.RunID}}</a></td></tr>
+	{{- end}}
+	<tr><th>Hostname</th><td>{{.SysInfo.Hostname}}</td></tr>
+	<tr><th>Architecture</th><td>{{.SysInfo.Arch}}</td></tr>
+	<tr><th>Kernel version</th><td>{{.SysInfo.KernelVersion}}</td></tr>
+	<tr><th>CPU model</th><td>{{.SysInfo.CPUModel}}</td></tr>
+	<tr><th>CPU cores</th><td>{{if .SysInfo.NumCPU}}{{.SysInfo.NumCPU}}{{end}}</td></tr>
+	<tr><th>Total memory</th><td>{{if $.MemTotal}}{{$.MemTotal}} MB{{end}}</td></tr>
+</table>
+{{- if $.Gaps}}
+<h3>Outages</h3>
+<table>
+	<tr><th>From</th><th>To</th><th>Duration</th></tr>
+	{{- range $.Gaps}}
+	<tr><td>{{.From}}</td><td>{{.To}}</td><td>{{.Duration}}</td></tr>
+	{{- end}}
+</table>
+{{- end}}
+{{- if .SysInfo.CPUInfo}}
+<h3>CPU Info</h3>
+<pre>{{.SysInfo.CPUInfo}}</pre>
+{{- end}}
+{{- if .SysInfo.KernelInfo}}
+<h3>Kernel Info</h3>
+<pre>{{.SysInfo.KernelInfo}}</pre>
+{{- end}}
+{{- if .ExtraInfo}}
+<h3>Extra Info</h3>
+<pre>{{.ExtraInfo}}</pre>
+{{- end}}
+{{- else}}
+<pre>{{.Raw}}</pre>
+{{- end}}
+</body>
+</html>
+`
+
+var infoTmpl = template.Must(template.New("info").Parse(infoTpl))
+
+func (cs *chartServer) infoHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	page := &infoPage{Tag: params["tag"], Session: params["session"]}
+
+	if meta, err := loadMeta(cs.dir, page.Tag, page.Session); err == nil {
+		page.Meta = meta
+		page.Start = time.Unix(meta.Start, 0).Format("2006-01-02 15:04:05")
+		page.MemTotal = meta.SysInfo.MemTotal / 1024
+		if meta.End != 0 {
+			page.Duration = time.Duration(meta.End-meta.Start) * time.Second
+		}
+		for _, g := range meta.Gaps {
+			page.Gaps = append(page.Gaps, gapView{
+				From:     time.Unix(g.From, 0).Format("2006-01-02 15:04:05"),
+				To:       time.Unix(g.To, 0).Format("2006-01-02 15:04:05"),
+				Duration: time.Duration(g.To-g.From) * time.Second,
+			})
+		}
+	} else {
+		in := fmt.Sprintf("%v/%v/info-%v.data", cs.dir, page.Tag, page.Session)
+		info, err := ioutil.ReadFile(in)
+		if err != nil {
+			http.Error(w, "File not found.", 404)
+			return
+		}
+		page.Raw = string(info)
+	}
+
+	if err := infoTmpl.Execute(w, page); err != nil {
+		cs.lg.Errorln(err)
+	}
+}
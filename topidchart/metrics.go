@@ -0,0 +1,277 @@
+package topidchart
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/opts"
+	"github.com/go-echarts/go-echarts/v2/types"
+)
+
+// maxPanelSeries is the max number of series shown in an extended metric panel.
+const maxPanelSeries = 20
+
+// metricPanel is an optional chart panel of extended metrics.
+type metricPanel struct {
+	name  string // used in the panels URL parameter
+	title string
+	unit  string
+	stack bool
+	// process returns the per process value, dt is the interval in seconds since
+	// the previous record, 0 for the first record.
+	process func(p *ProcessInfoV2, dt float32) float32
+	// group returns the series of the process if the process values are
+	// summed by group, empty to leave the process out.
+	group func(p *ProcessInfoV2) string
+	// system adds system wide values of s.
+	system func(s *SysStats, add func(series string, v float32))
+}
+
+func perSecond(v uint64, dt float32) float32 {
+	if dt <= 0 {
+		return 0
+	}
+	return floatConv(float32(v) / dt)
+}
+
+var metricPanels = []*metricPanel{
+	{name: "syscpu", title: "System CPU", unit: "Percent",
+		system: func(s *SysStats, add func(string, float32)) { add("total", floatConv(s.CPU)) }},
+	{name: "percore", title: "Per Core CPU", unit: "Percent",
+		system: func(s *SysStats, add func(string, float32)) {
+			for i, v := range s.PerCore {
+				add(fmt.Sprintf("cpu%d", i), floatConv(v))
+			}
+		}},
+	{name: "load", title: "Load Average", unit: "Load",
+		system: func(s *SysStats, add func(string, float32)) {
+			add("load1", s.Load1)
+			add("load5", s.Load5)
+			add("load15", s.Load15)
+		}},
+	{name: "sysmem", title: "System MEM", unit: "MB",
+		system: func(s *SysStats, add func(string, float32)) {
+			add("free", float32(s.MemFree/1024))
+			add("available", float32(s.MemAvailable/1024))
+			var swapUsed uint64
+			if s.SwapTotal > s.SwapFree {
+				swapUsed = s.SwapTotal - s.SwapFree
+			}
+			add("swap used", float32(swapUsed/1024))
+		}},
+	{name: "read", title: "I/O Read", unit: "KB/s", stack: true,
+		process: func(p *ProcessInfoV2, dt float32) float32 { return perSecond(p.ReadBytes/1024, dt) }},
+	{name: "write", title: "I/O Write", unit: "KB/s", stack: true,
+		process: func(p *ProcessInfoV2, dt float32) float32 { return perSecond(p.WriteBytes/1024, dt) }},
+	{name: "vcsw", title: "Voluntary Context Switches", unit: "Per second", stack: true,
+		process: func(p *ProcessInfoV2, dt float32) float32 { return perSecond(p.VolCtxsw, dt) }},
+	{name: "ivcsw", title: "Involuntary Context Switches", unit: "Per second", stack: true,
+		process: func(p *ProcessInfoV2, dt float32) float32 { return perSecond(p.InvolCtxsw, dt) }},
+	{name: "threads", title: "Threads", unit: "Count", stack: true,
+		process: func(p *ProcessInfoV2, dt float32) float32 { return float32(p.NumThreads) }},
+	{name: "fds", title: "Open FDs", unit: "Count", stack: true,
+		process: func(p *ProcessInfoV2, dt float32) float32 { return float32(p.NumFDs) }},
+	{name: "ctrcpu", title: "Container CPU", unit: "Percent", stack: true, group: containerName,
+		process: func(p *ProcessInfoV2, dt float32) float32 { return floatConv(p.Ucpu + p.Scpu) }},
+	{name: "ctrmem", title: "Container MEM", unit: "MB", stack: true, group: containerName,
+		process: func(p *ProcessInfoV2, dt float32) float32 { return float32(p.Mem / 1024) }},
+}
+
+// appendPoint appends v to the series of name as the nth point, pads zeros
+// for the missing points before.
+func appendPoint(m map[string][]float32, name string, n int, v float32) {
+	series := m[name]
+	if len(series) < n-1 {
+		series = append(series, make([]float32, n-1-len(series))...)
+	}
+	m[name] = append(series, v)
+}
+
+// addMetrics adds the extended metrics of the record which is the nth point of the charts.
+func (prs *processRecords) addMetrics(rec *pRecord, n int, dt float32) {
+	for _, mp := range metricPanels {
+		series := prs.panels[mp.name]
+		if series == nil {
+			series = make(map[string][]float32)
+			prs.panels[mp.name] = series
+		}
+		if mp.system != nil {
+			if rec.Sys != nil {
+				mp.system(rec.Sys, func(name string, v float32) { appendPoint(series, name, n, v) })
+			}
+			continue
+		}
+		if mp.group != nil {
+			sums := make(map[string]float32)
+			for i := range rec.Processes {
+				p := &rec.Processes[i]
+				if name := mp.group(p); name != "" {
+					sums[name] += mp.process(p, dt)
+				}
+			}
+			for name, v := range sums {
+				appendPoint(series, name, n, v)
+			}
+			continue
+		}
+		for i := range rec.Processes {
+			p := &rec.Processes[i]
+			v := mp.process(p, dt)
+			name := seriesName(*p)
+			if _, ok := series[name]; ok || v != 0 {
+				appendPoint(series, name, n, v)
+			}
+		}
+	}
+}
+
+// trimMetrics pads all the series to full length, and keeps only the
+// heaviest non-zero process series in each panel.
+func (prs *processRecords) trimMetrics() {
+	n := len(prs.time)
+	for _, mp := range metricPanels {
+		series := prs.panels[mp.name]
+		avg := make(map[string]float32, len(series))
+		for k, v := range series {
+			if len(v) < n {
+				v = append(v, make([]float32, n-len(v))...)
+				series[k] = v
+			}
+			max, a := maxAndAvg(v)
+			if max == 0 && mp.process != nil {
+				delete(series, k)
+				continue
+			}
+			avg[k] = a
+		}
+		if mp.process == nil {
+			continue
+		}
+		for i, p := range rank(avg) {
+			if i >= maxPanelSeries {
+				delete(series, p.key)
+			}
+		}
+	}
+}
+
+// parsePanels returns the selected panels, all panels with data are selected
+// if no panels parameter given.
+func (prs *processRecords) parsePanels(vars map[string][]string) map[string]bool {
+	selected := make(map[string]bool)
+	if v, ok := vars["panels"]; ok {
+		for _, name := range strings.Split(v[0], ",") {
+			selected[name] = true
+		}
+		return selected
+	}
+	for name, series := range prs.panels {
+		if len(series) != 0 {
+			selected[name] = true
+		}
+	}
+	return selected
+}
+
+func (prs *processRecords) linePanel(mp *metricPanel) *charts.Line {
+	line := charts.NewLine()
+	line.SetGlobalOptions(
+		charts.WithTitleOpts(opts.Title{
+			Title: mp.title,
+			Left:  "560",
+		}),
+		charts.WithYAxisOpts(opts.YAxis{
+			Name: mp.unit,
+		}),
+		charts.WithTooltipOpts(opts.Tooltip{
+			Show:    true,
+			Trigger: "axis",
+		}),
+		charts.WithInitializationOpts(opts.Initialization{
+			Theme:  types.ThemeShine,
+			Width:  "1400px",
+			Height: "350px",
+		}),
+		charts.WithDataZoomOpts(opts.DataZoom{
+			XAxisIndex: []int{0},
+		}),
+		charts.WithLegendOpts(opts.Legend{
+			Show:   true,
+			Type:   "scroll",
+			Orient: "vertical",
+			Left:   "83%",
+		}),
+	)
+	line.AddJSFuncs(prs.focusJS(line.ChartID))
+
+	series := prs.panels[mp.name]
+	avg := make(map[string]float32, len(series))
+	for k, v := range series {
+		_, avg[k] = maxAndAvg(v)
+	}
+	line = line.SetXAxis(prs.time)
+	for _, p := range rank(avg) {
+		items := make([]opts.LineData, 0, len(prs.time))
+		for _, data := range series[p.key] {
+			items = append(items, opts.LineData{Value: data})
+		}
+		line.AddSeries(p.key, items)
+	}
+
+	lineOpts := opts.LineChart{Sampling: "lttb"}
+	if mp.stack {
+		lineOpts.Stack = "stack"
+		line.SetSeriesOptions(charts.WithAreaStyleOpts(opts.AreaStyle{Opacity: 0.8}))
+	}
+	line.SetSeriesOptions(charts.WithLineChartOpts(lineOpts))
+
+	return line
+}
+
+// panelCharts returns the charts of the selected panels that have data.
+func (prs *processRecords) panelCharts(selected map[string]bool) []*charts.Line {
+	var lines []*charts.Line
+	for _, mp := range metricPanels {
+		if selected[mp.name] && len(prs.panels[mp.name]) != 0 {
+			lines = append(lines, prs.linePanel(mp))
+		}
+	}
+	return lines
+}
+
+// panelsJS returns the js to add the on/off controls of the panels with data.
+func (prs *processRecords) panelsJS(selected map[string]bool) string {
+	var boxes strings.Builder
+	for _, mp := range metricPanels {
+		if len(prs.panels[mp.name]) == 0 {
+			continue
+		}
+		checked := ""
+		if selected[mp.name] {
+			checked = " checked"
+		}
+		fmt.Fprintf(&boxes, `<label><input type="checkbox" value="%s"%s/>%s</label><br/>`, mp.name, checked, mp.title)
+	}
+	if boxes.Len() == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(`var panels = document.createElement("div");
+					panels.id = "panels";
+					panels.style = "margin-top:10px;font-size:12px";
+					panels.innerHTML = '%s';
+					panels.onchange=function(){
+						var names = [];
+						var boxes = panels.getElementsByTagName("input");
+						for(var i = 0; i < boxes.length; i++){
+							if(boxes[i].checked){
+								names.push(boxes[i].value);
+							}
+						}
+						var params = new URLSearchParams(location.search);
+						params.set("panels", names.join(","));
+						location.search = params.toString();
+					};
+					document.getElementsByClassName("btn")[0].appendChild(panels);`, boxes.String())
+}
@@ -0,0 +1,83 @@
+package topidchart
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// normalization set by the norm URL parameter
+type normalization struct {
+	cpu bool // CPU in percent of the whole machine instead of one core
+	mem bool // MEM in percent of total RAM instead of MB
+}
+
+func parseNorm(vars url.Values) normalization {
+	var norm normalization
+	for _, v := range strings.Split(vars.Get("norm"), ",") {
+		switch v {
+		case "cpu":
+			norm.cpu = true
+		case "mem":
+			norm.mem = true
+		}
+	}
+	return norm
+}
+
+// normalize scales the cpu and mem series by the structured SysInfo of the session,
+// it is a no-op for the sessions without core count or total memory info.
+// It should be called after the filter is applied, the thresholds are always
+// in percent of one core and MB.
+func (prs *processRecords) normalize(meta *sessionMeta, norm normalization) {
+	if meta == nil {
+		return
+	}
+	scale := func(series map[string][]float32, avg, max map[string]float32, factor float32) {
+		for k, v := range series {
+			for i := range v {
+				v[i] = floatConv(v[i] * factor)
+			}
+			avg[k] = floatConv(avg[k] * factor)
+			max[k] = floatConv(max[k] * factor)
+		}
+	}
+	if n := meta.SysInfo.NumCPU; norm.cpu && n > 0 {
+		scale(prs.cpu, prs.cpuavg, prs.cpumax, 1/float32(n))
+		prs.cpuUnit = "Percent of machine"
+	}
+	if total := float32(meta.SysInfo.MemTotal) / 1024; norm.mem && total > 0 {
+		scale(prs.mem, prs.memavg, prs.memmax, 100/total)
+		prs.memUnit = "Percent of RAM"
+	}
+}
+
+// normJS returns the js of the normalization buttons, which are hidden
+// if the session has no info to normalize.
+func normJS(meta *sessionMeta, norm normalization) string {
+	var cpuOK, memOK bool
+	if meta != nil {
+		cpuOK = meta.SysInfo.NumCPU > 0
+		memOK = meta.SysInfo.MemTotal > 0
+	}
+	return fmt.Sprintf(`var setNorm = function(btn, ok, on, key, offValue){
+						if(!ok){
+							btn.style.display = "none";
+							return;
+						}
+						if(on){
+							btn.value = offValue;
+						}
+						btn.onclick=function(){
+							var params = new URLSearchParams(location.search);
+							var norm = (params.get("norm") || "").split(",").filter(function(v){ return v && v != key; });
+							if(!on){
+								norm.push(key);
+							}
+							params.set("norm", norm.join(","));
+							location.search = params.toString();
+						};
+					};
+					setNorm(document.getElementById("cpunorm"), %t, %t, "cpu", "CPU%%CORE");
+					setNorm(document.getElementById("memnorm"), %t, %t, "mem", "MEM-MB");`, cpuOK, norm.cpu, memOK, norm.mem)
+}
@@ -0,0 +1,516 @@
+package topidchart
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse output formats.
+const (
+	OutputText  = "text"  // human readable lines
+	OutputJSONL = "jsonl" // one JSON object per record
+	OutputCSV   = "csv"   // one row per process, snapshot, meta or info
+)
+
+// Kinds of the data files of the sessions.
+const (
+	kindProcess  = "process"
+	kindSnapshot = "snapshot"
+	kindInfo     = "info"
+	kindMeta     = "meta"
+)
+
+const (
+	// maxGobMessage is the max size of a gob message decoded.
+	maxGobMessage = 16 << 20
+	// maxResyncMessage is the max size of a gob message accepted when looking
+	// for the next record after a corrupt region.
+	maxResyncMessage = 1 << 20
+	// maxResyncScan is the max bytes scanned for the next record after a corrupt
+	// region, the rest of the file is taken as corrupt if none is found.
+	maxResyncScan = 64 << 20
+	// gobUintMax is the max size of an encoded gob unsigned integer.
+	gobUintMax = 9
+	// gobReaderSize is the buffer size of the data files, so that a whole message can be peeked.
+	gobReaderSize = maxGobMessage + 2*gobUintMax
+	// kindHeadSize is the size of the start of the data files the kind is detected by.
+	kindHeadSize = 4096
+)
+
+var errUnknownKind = errors.New("unknown file kind")
+
+// CorruptRegion is a region of a data file that can not be decoded, in byte offsets.
+type CorruptRegion struct {
+	File string
+	From int64
+	To   int64 // the offset of the next record decoded, or the file size
+	Err  string
+}
+
+func (c CorruptRegion) String() string {
+	return fmt.Sprintf("%s: corrupt bytes %d-%d: %s", c.File, c.From, c.To, c.Err)
+}
+
+// dataFiles returns the data files in the paths, the directories are walked for
+// the data files of the sessions, the files are taken as is.
+func dataFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		err = filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && kindByName(path) != "" {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// kindByName returns the kind of the data file by its name, empty if unknown.
+func kindByName(filename string) string {
+	base := filepath.Base(filename)
+	if !strings.HasSuffix(base, ".data") {
+		return ""
+	}
+	for _, kind := range []string{kindProcess, kindSnapshot, kindInfo, kindMeta} {
+		if strings.HasPrefix(base, kind+"-") {
+			return kind
+		}
+	}
+	return ""
+}
+
+// detectKind detects the kind of the data file by the gob type names in head, the
+// start of the file, or by the name of the file if the content tells nothing.
+func detectKind(filename string, head []byte) string {
+	switch {
+	case bytes.Contains(head, []byte("sessionMeta")):
+		return kindMeta
+	case bytes.Contains(head, []byte("pRecord")):
+		return kindProcess
+	case bytes.Contains(head, []byte("sRecord")):
+		return kindSnapshot
+	case bytes.HasPrefix(head, []byte("------CPUInfo------")):
+		return kindInfo
+	}
+	return kindByName(filename)
+}
+
+// gobUint decodes a gob unsigned integer, returns the number of bytes used, 0 if invalid.
+func gobUint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	if b[0] < 0x80 {
+		return uint64(b[0]), 1
+	}
+	n := -int(int8(b[0]))
+	if n > 8 || len(b) < 1+n {
+		return 0, 0
+	}
+	var x uint64
+	for _, c := range b[1 : 1+n] {
+		x = x<<8 | uint64(c)
+	}
+	return x, 1 + n
+}
+
+// gobStream decodes the values of a gob stream message by message, so that the
+// values after a corrupt region are still decoded with the type definitions
+// at the start of the stream.
+type gobStream struct {
+	r        *bufio.Reader
+	pos      int64  // the offset of r in the stream
+	header   []byte // the type definitions
+	valueID  int64  // the type ID of the values
+	buf      *bytes.Buffer
+	dec      *gob.Decoder
+	newValue func() interface{}
+}
+
+func newGobStream(r io.Reader, newValue func() interface{}) *gobStream {
+	return &gobStream{r: bufio.NewReaderSize(r, gobReaderSize), newValue: newValue}
+}
+
+func (gs *gobStream) reset() {
+	gs.buf = bytes.NewBuffer(append([]byte(nil), gs.header...))
+	gs.dec = gob.NewDecoder(gs.buf)
+}
+
+// peekMessage returns the gob message at the current offset without consuming it,
+// ok is false if there is no complete message of at most max bytes.
+func (gs *gobStream) peekMessage(max int) (msg []byte, typeID int64, ok bool) {
+	b, _ := gs.r.Peek(gobUintMax)
+	length, n := gobUint(b)
+	if n == 0 || length == 0 || length > uint64(max) {
+		return nil, 0, false
+	}
+	msg, err := gs.r.Peek(n + int(length))
+	if err != nil {
+		return nil, 0, false
+	}
+	id, m := gobUint(msg[n:])
+	if m == 0 {
+		return nil, 0, false
+	}
+	if id&1 != 0 {
+		typeID = ^int64(id >> 1)
+	} else {
+		typeID = int64(id >> 1)
+	}
+	return msg, typeID, true
+}
+
+func (gs *gobStream) discard(n int) {
+	n, _ = gs.r.Discard(n)
+	gs.pos += int64(n)
+}
+
+// skipRest consumes the rest of the stream and returns the error other than io.EOF.
+func (gs *gobStream) skipRest() error {
+	n, err := io.Copy(ioutil.Discard, gs.r)
+	gs.pos += n
+	return err
+}
+
+// decode decodes the value of the message.
+func (gs *gobStream) decode(msg []byte) (interface{}, error) {
+	gs.buf.Write(msg)
+	v := gs.newValue()
+	if err := gs.dec.Decode(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// walk calls f with each value decoded, and returns the corrupt regions skipped.
+// The error is the read error of the stream.
+func (gs *gobStream) walk(f func(v interface{})) ([]CorruptRegion, error) {
+	var corrupt []CorruptRegion
+	gs.reset()
+	for {
+		if _, err := gs.r.Peek(1); err == io.EOF {
+			return corrupt, nil
+		} else if err != nil {
+			return corrupt, err
+		}
+
+		msg, id, ok := gs.peekMessage(maxGobMessage)
+		// the type definitions, also the ones sent after the start of the stream
+		if ok && id < 0 {
+			gs.header = append(gs.header, msg...)
+			gs.buf.Write(msg)
+			gs.discard(len(msg))
+			continue
+		}
+		if ok && len(gs.header) == 0 {
+			region := CorruptRegion{From: gs.pos, Err: "no type definition"}
+			err := gs.skipRest()
+			region.To = gs.pos
+			return append(corrupt, region), err
+		}
+		if ok && gs.valueID == 0 {
+			gs.valueID = id
+		}
+
+		var err error
+		switch {
+		case !ok:
+			err = errors.New("invalid message")
+		case id != gs.valueID:
+			err = fmt.Errorf("unexpected type id %d", id)
+		default:
+			var v interface{}
+			if v, err = gs.decode(msg); err == nil {
+				f(v)
+				gs.discard(len(msg))
+				continue
+			}
+		}
+
+		region, err := gs.resync(err, f)
+		corrupt = append(corrupt, region)
+		if err != nil {
+			return corrupt, err
+		}
+	}
+}
+
+// resync skips the corrupt region at the current offset till the next message that
+// decodes with the type definitions, at most maxResyncScan bytes are scanned.
+func (gs *gobStream) resync(cause error, f func(v interface{})) (CorruptRegion, error) {
+	region := CorruptRegion{From: gs.pos, Err: cause.Error()}
+	for scanned := 0; scanned < maxResyncScan; scanned++ {
+		gs.discard(1)
+		if _, err := gs.r.Peek(1); err != nil {
+			region.To = gs.pos
+			if err == io.EOF {
+				err = nil
+			}
+			return region, err
+		}
+		msg, id, ok := gs.peekMessage(maxResyncMessage)
+		if !ok || id != gs.valueID {
+			continue
+		}
+		gs.reset()
+		if v, err := gs.decode(msg); err == nil {
+			region.To = gs.pos
+			f(v)
+			gs.discard(len(msg))
+			return region, nil
+		}
+	}
+	err := gs.skipRest()
+	region.To = gs.pos
+	return region, err
+}
+
+// parser writes the records of the data files in the format.
+type parser struct {
+	w      io.Writer
+	format string
+	csv    *csv.Writer
+	r      *bufio.Reader // reused by the files
+}
+
+// parseCSVHeader is the header of the csv output, the columns of the processes are
+// named as the importer reads them, so the process rows can be imported back.
+var parseCSVHeader = []string{"file", "kind", "timestamp", "pid", "ppid", "name", "ucpu", "scpu", "mem",
+	"threads", "fds", "read_bytes", "write_bytes", "container", "text"}
+
+func newParser(w io.Writer, format string) (*parser, error) {
+	p := &parser{w: w, format: format}
+	switch format {
+	case OutputText, OutputJSONL:
+	case OutputCSV:
+		p.csv = csv.NewWriter(w)
+		p.csv.Write(parseCSVHeader)
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+	return p, nil
+}
+
+func formatTime(ts int64) string {
+	return time.Unix(ts, 0).Format("2006-01-02 15:04:05")
+}
+
+func (p *parser) jsonLine(file, kind string, record interface{}) {
+	line, _ := json.Marshal(struct {
+		File   string
+		Kind   string
+		Record interface{}
+	}{file, kind, record})
+	p.w.Write(append(line, '\n'))
+}
+
+func (p *parser) process(file string, r *pRecord) {
+	switch p.format {
+	case OutputJSONL:
+		p.jsonLine(file, kindProcess, r)
+	case OutputCSV:
+		ts := strconv.FormatInt(r.Timestamp, 10)
+		for _, pi := range r.Processes {
+			p.csv.Write([]string{file, kindProcess, ts, strconv.Itoa(pi.Pid), strconv.Itoa(pi.Ppid), pi.Name,
+				strconv.FormatFloat(float64(pi.Ucpu), 'f', 2, 32), strconv.FormatFloat(float64(pi.Scpu), 'f', 2, 32),
+				strconv.FormatUint(pi.Mem, 10), strconv.Itoa(pi.NumThreads), strconv.Itoa(pi.NumFDs),
+				strconv.FormatUint(pi.ReadBytes, 10), strconv.FormatUint(pi.WriteBytes, 10), pi.ContainerID, ""})
+		}
+		if r.Sys != nil {
+			sys, _ := json.Marshal(r.Sys)
+			p.csv.Write([]string{file, "sys", ts, "", "", "", "", "", "", "", "", "", "", "", string(sys)})
+		}
+	default:
+		ts := formatTime(r.Timestamp)
+		for _, pi := range r.Processes {
+			fmt.Fprintf(p.w, "%s pid=%d ppid=%d name=%q ucpu=%.2f scpu=%.2f mem=%dKB", ts, pi.Pid, pi.Ppid, pi.Name, pi.Ucpu, pi.Scpu, pi.Mem)
+			if pi.NumThreads != 0 {
+				fmt.Fprintf(p.w, " threads=%d", pi.NumThreads)
+			}
+			if pi.NumFDs != 0 {
+				fmt.Fprintf(p.w, " fds=%d", pi.NumFDs)
+			}
+			if pi.ContainerID != "" {
+				fmt.Fprintf(p.w, " container=%s", pi.ContainerID)
+			}
+			fmt.Fprintln(p.w)
+		}
+		if r.Sys != nil {
+			fmt.Fprintf(p.w, "%s sys=%+v\n", ts, *r.Sys)
+		}
+	}
+}
+
+func (p *parser) snapshot(file string, r *sRecord) {
+	switch p.format {
+	case OutputJSONL:
+		p.jsonLine(file, kindSnapshot, r)
+	case OutputCSV:
+		p.csv.Write([]string{file, kindSnapshot, strconv.FormatInt(r.Timestamp, 10), "", "", "", "", "", "", "", "", "", "", "", r.Snapshot})
+	default:
+		fmt.Fprintf(p.w, "------snapshot at %s------\n%s\n", formatTime(r.Timestamp), strings.TrimRight(r.Snapshot, "\n"))
+	}
+}
+
+func (p *parser) meta(file string, m *sessionMeta) {
+	switch p.format {
+	case OutputJSONL:
+		p.jsonLine(file, kindMeta, m)
+	case OutputCSV:
+		text, _ := json.Marshal(m)
+		p.csv.Write([]string{file, kindMeta, strconv.FormatInt(m.Start, 10), "", "", "", "", "", "", "", "", "", "", "", string(text)})
+	default:
+		fmt.Fprintf(p.w, "tag=%s session=%s start=%s", m.Tag, m.ID, formatTime(m.Start))
+		if m.End != 0 {
+			fmt.Fprintf(p.w, " end=%s", formatTime(m.End))
+		}
+		if m.RunID != "" {
+			fmt.Fprintf(p.w, " run=%s", m.RunID)
+		}
+		fmt.Fprintf(p.w, " host=%q cpus=%d mem=%dKB kernel=%q arch=%q\n", m.SysInfo.Hostname, m.SysInfo.NumCPU,
+			m.SysInfo.MemTotal, m.SysInfo.KernelVersion, m.SysInfo.Arch)
+		keys := make([]string, 0, len(m.Labels))
+		for k := range m.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(p.w, "label %s=%s\n", k, m.Labels[k])
+		}
+		for _, g := range m.Gaps {
+			fmt.Fprintf(p.w, "gap %s to %s\n", formatTime(g.From), formatTime(g.To))
+		}
+		if m.ExtraInfo != "" {
+			fmt.Fprintf(p.w, "extra info:\n%s\n", strings.TrimRight(m.ExtraInfo, "\n"))
+		}
+	}
+}
+
+func (p *parser) info(file string, text string) {
+	switch p.format {
+	case OutputJSONL:
+		p.jsonLine(file, kindInfo, text)
+	case OutputCSV:
+		p.csv.Write([]string{file, kindInfo, "", "", "", "", "", "", "", "", "", "", "", "", text})
+	default:
+		fmt.Fprintln(p.w, strings.TrimRight(text, "\n"))
+	}
+}
+
+// parseFile writes the records of the file and returns the corrupt regions.
+func (p *parser) parseFile(filename string) ([]CorruptRegion, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if p.r == nil {
+		p.r = bufio.NewReaderSize(f, gobReaderSize)
+	} else {
+		p.r.Reset(f)
+	}
+
+	head, err := p.r.Peek(kindHeadSize)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	kind := detectKind(filename, head)
+	if kind == "" {
+		return nil, fmt.Errorf("%s: %w", filename, errUnknownKind)
+	}
+	if p.format == OutputText {
+		fmt.Fprintf(p.w, "==> %s (%s) <==\n", filename, kind)
+	}
+
+	var corrupt []CorruptRegion
+	switch kind {
+	case kindInfo:
+		var data []byte
+		if data, err = ioutil.ReadAll(p.r); err == nil {
+			p.info(filename, string(data))
+		}
+	case kindProcess:
+		gs := newGobStream(p.r, func() interface{} { return &pRecord{} })
+		corrupt, err = gs.walk(func(v interface{}) { p.process(filename, v.(*pRecord)) })
+	case kindSnapshot:
+		gs := newGobStream(p.r, func() interface{} { return &sRecord{} })
+		corrupt, err = gs.walk(func(v interface{}) { p.snapshot(filename, v.(*sRecord)) })
+	case kindMeta:
+		gs := newGobStream(p.r, func() interface{} { return &sessionMeta{} })
+		corrupt, err = gs.walk(func(v interface{}) { p.meta(filename, v.(*sessionMeta)) })
+	}
+	for i := range corrupt {
+		corrupt[i].File = filename
+		if p.format == OutputText {
+			fmt.Fprintf(p.w, "!!! %v\n", corrupt[i])
+		}
+	}
+	if err != nil {
+		return corrupt, fmt.Errorf("%s: %w", filename, err)
+	}
+	return corrupt, nil
+}
+
+// Parse writes the records of the data files in paths to w in the format,
+// the directories are walked for the data files of the sessions. The kind of
+// each file is detected from its content. The corrupt regions of the files are
+// skipped and returned, the files that can not be parsed at all are returned
+// as error after all the other files are parsed.
+func Parse(w io.Writer, paths []string, format string) ([]CorruptRegion, error) {
+	p, err := newParser(w, format)
+	if err != nil {
+		return nil, err
+	}
+	files, err := dataFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	var corrupt []CorruptRegion
+	var errs []string
+	for _, f := range files {
+		c, err := p.parseFile(f)
+		corrupt = append(corrupt, c...)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if p.csv != nil {
+		p.csv.Flush()
+		if err := p.csv.Error(); err != nil {
+			return corrupt, err
+		}
+	}
+	if len(errs) != 0 {
+		return corrupt, errors.New(strings.Join(errs, "\n"))
+	}
+	return corrupt, nil
+}
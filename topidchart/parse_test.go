@@ -0,0 +1,192 @@
+package topidchart
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testRecords(n int) []pRecord {
+	var records []pRecord
+	for i := 0; i < n; i++ {
+		records = append(records, pRecord{
+			Timestamp: int64(1000 + i),
+			Processes: []ProcessInfoV2{
+				{Pid: 1, Name: "init", Ucpu: 1, Mem: 1024},
+				{Pid: 100 + i, Ppid: 1, Name: "worker", Ucpu: float32(i), Scpu: 0.5, Mem: 2048, NumThreads: 2, ContainerID: "abcdef"},
+			},
+		})
+	}
+	return records
+}
+
+// encodeRecords returns the gob stream of the records and the offsets of the records in it.
+func encodeRecords(t *testing.T, records []pRecord) ([]byte, []int) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	var offsets []int
+	for i := range records {
+		offsets = append(offsets, buf.Len())
+		if err := enc.Encode(&records[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the type definitions are sent with the first record
+	if err := gob.NewDecoder(bytes.NewReader(buf.Bytes())).Decode(&pRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), offsets
+}
+
+func parsedTimestamps(t *testing.T, out []byte) []int64 {
+	var timestamps []int64
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var line struct {
+			Kind   string
+			Record pRecord
+		}
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		if line.Kind != kindProcess {
+			t.Fatalf("got kind %q", line.Kind)
+		}
+		timestamps = append(timestamps, line.Record.Timestamp)
+	}
+	return timestamps
+}
+
+func TestParseIntact(t *testing.T) {
+	records := testRecords(5)
+	data, _ := encodeRecords(t, records)
+	file := filepath.Join(t.TempDir(), "renamed.bin")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	corrupt, err := Parse(&out, []string{file}, OutputJSONL)
+	if err != nil || len(corrupt) != 0 {
+		t.Fatalf("got %v %v", err, corrupt)
+	}
+	var got []pRecord
+	sc := bufio.NewScanner(&out)
+	for sc.Scan() {
+		var line struct{ Record pRecord }
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, line.Record)
+	}
+	if !reflect.DeepEqual(got, records) {
+		t.Errorf("got %+v, want %+v", got, records)
+	}
+}
+
+func TestParseCorrupt(t *testing.T) {
+	records := testRecords(10)
+	data, offsets := encodeRecords(t, records)
+
+	// garble the middle of record 4 and truncate record 9
+	for i := offsets[4] + 3; i < offsets[5]-3; i++ {
+		data[i] = 0xff
+	}
+	data = data[:offsets[9]+(len(data)-offsets[9])/2]
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "process-20240101-abcdefgh.data")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	corrupt, err := Parse(&out, []string{dir}, OutputJSONL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{1000, 1001, 1002, 1003, 1005, 1006, 1007, 1008}
+	if got := parsedTimestamps(t, out.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got records %v, want %v", got, want)
+	}
+	if len(corrupt) != 2 {
+		t.Fatalf("got corrupt regions %v, want 2", corrupt)
+	}
+	if c := corrupt[0]; c.File != file || c.From != int64(offsets[4]) || c.To != int64(offsets[5]) {
+		t.Errorf("got %v, want bytes %d-%d", c, offsets[4], offsets[5])
+	}
+	if c := corrupt[1]; c.From != int64(offsets[9]) || c.To != int64(len(data)) {
+		t.Errorf("got %v, want bytes %d-%d", c, offsets[9], len(data))
+	}
+}
+
+func TestGobStreamNoTypes(t *testing.T) {
+	data, offsets := encodeRecords(t, testRecords(3))
+	// the values without the type definitions at the start
+	values := data[offsets[1]:]
+	gs := newGobStream(bytes.NewReader(values), func() interface{} { return &pRecord{} })
+	n := 0
+	corrupt, err := gs.walk(func(v interface{}) { n++ })
+	if err != nil || n != 0 || len(corrupt) != 1 || corrupt[0].From != 0 || corrupt[0].To != int64(len(values)) {
+		t.Errorf("got %d values, corrupt %v %v", n, corrupt, err)
+	}
+}
+
+func TestGobStreamCorruptLength(t *testing.T) {
+	records := testRecords(5)
+	data, offsets := encodeRecords(t, records)
+	// the length of record 2 claims the rest of the file and more
+	length := []byte{0xfc, 0x00, 0x80, 0x00, 0x00}
+	corrupted := append(append(append([]byte(nil), data[:offsets[2]]...), length...), data[offsets[2]+1:]...)
+
+	gs := newGobStream(bytes.NewReader(corrupted), func() interface{} { return &pRecord{} })
+	var got []int64
+	corrupt, err := gs.walk(func(v interface{}) { got = append(got, v.(*pRecord).Timestamp) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{1000, 1001, 1003, 1004}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got records %v, want %v", got, want)
+	}
+	shift := int64(len(length) - 1)
+	if len(corrupt) != 1 || corrupt[0].From != int64(offsets[2]) || corrupt[0].To != int64(offsets[3])+shift {
+		t.Errorf("got corrupt regions %v, want bytes %d-%d", corrupt, offsets[2], int64(offsets[3])+shift)
+	}
+}
+
+func TestParseCSVImport(t *testing.T) {
+	records := testRecords(3)
+	records[1].Sys = &SysStats{CPU: 50}
+	data, _ := encodeRecords(t, records)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "process-20240101-abcdefgh.data")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if _, err := Parse(&out, []string{file}, OutputCSV); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), ",sys,") {
+		t.Fatalf("no sys row in %s", out.String())
+	}
+	got := importRecords(t, FormatCSV, out.String())
+	if len(got) != len(records) {
+		t.Fatalf("got %d records, want %d", len(got), len(records))
+	}
+	for i := range got {
+		// the system statistics are not imported from csv
+		records[i].Sys = nil
+		if !reflect.DeepEqual(got[i], records[i]) {
+			t.Errorf("got %+v, want %+v", got[i], records[i])
+		}
+	}
+}
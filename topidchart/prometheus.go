@@ -0,0 +1,146 @@
+package topidchart
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// liveSession is the latest record of a session with connected stream.
+type liveSession struct {
+	tag, id string
+	last    *pRecord
+}
+
+// ingestStats is a copy of the ingest statistics of the sessionMgr.
+type ingestStats struct {
+	active       int // sessions with connected stream, or HTTP sessions
+	waiting      int // sessions with broken stream waiting for resume
+	records      uint64
+	perSecond    float64
+	bytes        uint64
+	decodeErrors uint64
+	writeErrors  uint64
+	live         []liveSession
+}
+
+func (mgr *sessionMgr) stats() *ingestStats {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	st := &ingestStats{
+		records:      mgr.records,
+		perSecond:    mgr.rate.perSecond(time.Now().Unix()),
+		bytes:        mgr.closedBytes,
+		decodeErrors: mgr.decodeErrors,
+		writeErrors:  mgr.writeErrors,
+	}
+	for _, s := range mgr.sessions {
+		s.Lock()
+		st.bytes += s.written
+		if s.broken {
+			st.waiting++
+		} else {
+			st.active++
+			if s.last != nil {
+				st.live = append(st.live, liveSession{s.meta.Tag, s.meta.ID, s.last})
+			}
+		}
+		s.Unlock()
+	}
+	sort.Slice(st.live, func(i, j int) bool {
+		if st.live[i].tag != st.live[j].tag {
+			return st.live[i].tag < st.live[j].tag
+		}
+		return st.live[i].id < st.live[j].id
+	})
+	return st
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promWriter writes metrics in the Prometheus text exposition format.
+type promWriter struct {
+	*bufio.Writer
+}
+
+func (pw promWriter) metric(name, typ, help string) {
+	fmt.Fprintf(pw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample of the metric, labels are pairs of label name and value.
+func (pw promWriter) sample(name string, value float64, labels ...string) {
+	pw.WriteString(name)
+	if len(labels) != 0 {
+		pw.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i != 0 {
+				pw.WriteByte(',')
+			}
+			fmt.Fprintf(pw, `%s="%s"`, labels[i], promEscaper.Replace(labels[i+1]))
+		}
+		pw.WriteByte('}')
+	}
+	fmt.Fprintf(pw, " %v\n", value)
+}
+
+func writeMetrics(w io.Writer, st *ingestStats) error {
+	pw := promWriter{bufio.NewWriter(w)}
+
+	pw.metric("topid_sessions_active", "gauge", "Number of sessions with connected collector.")
+	pw.sample("topid_sessions_active", float64(st.active))
+	pw.metric("topid_sessions_waiting_resume", "gauge", "Number of sessions with broken stream waiting to be resumed.")
+	pw.sample("topid_sessions_waiting_resume", float64(st.waiting))
+	pw.metric("topid_records_received_total", "counter", "Total number of records received.")
+	pw.sample("topid_records_received_total", float64(st.records))
+	pw.metric("topid_records_per_second", "gauge", fmt.Sprintf("Records received per second in the last %d seconds.", rateWindow))
+	pw.sample("topid_records_per_second", st.perSecond)
+	pw.metric("topid_bytes_written_total", "counter", "Total bytes written into the data files.")
+	pw.sample("topid_bytes_written_total", float64(st.bytes))
+	pw.metric("topid_decode_errors_total", "counter", "Total number of records failed to decode, including delta records received before keyframe.")
+	pw.sample("topid_decode_errors_total", float64(st.decodeErrors))
+	pw.metric("topid_write_errors_total", "counter", "Total number of records failed to write.")
+	pw.sample("topid_write_errors_total", float64(st.writeErrors))
+
+	pw.metric("topid_record_timestamp_seconds", "gauge", "Timestamp of the latest record of the live session.")
+	for _, ls := range st.live {
+		pw.sample("topid_record_timestamp_seconds", float64(ls.last.Timestamp), "tag", ls.tag, "session", ls.id)
+	}
+	pw.metric("topid_process_cpu_percent", "gauge", "Latest CPU usage of the process in percent of one core.")
+	for _, ls := range st.live {
+		for _, p := range ls.last.Processes {
+			pw.sample("topid_process_cpu_percent", float64(floatConv(p.Ucpu+p.Scpu)),
+				"tag", ls.tag, "session", ls.id, "process", p.Name, "pid", fmt.Sprint(p.Pid))
+		}
+	}
+	pw.metric("topid_process_memory_bytes", "gauge", "Latest memory usage of the process.")
+	for _, ls := range st.live {
+		for _, p := range ls.last.Processes {
+			pw.sample("topid_process_memory_bytes", float64(p.Mem*1024),
+				"tag", ls.tag, "session", ls.id, "process", p.Name, "pid", fmt.Sprint(p.Pid))
+		}
+	}
+	pw.metric("topid_system_cpu_percent", "gauge", "Latest system CPU usage in percent of the whole machine.")
+	for _, ls := range st.live {
+		if ls.last.Sys != nil {
+			pw.sample("topid_system_cpu_percent", float64(ls.last.Sys.CPU), "tag", ls.tag, "session", ls.id)
+		}
+	}
+
+	return pw.Flush()
+}
+
+func (cs *chartServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if sessions == nil {
+		http.Error(w, "Data server not running.", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := writeMetrics(w, sessions.stats()); err != nil {
+		cs.lg.Errorln(err)
+	}
+}
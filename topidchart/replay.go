@@ -0,0 +1,108 @@
+package topidchart
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+	"github.com/godevsig/glib/sys/log"
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+// LoadSessionRequest returns the SessionRequestV2 that created the session tag/id
+// stored under dir, sessions created by older servers have only the Tag.
+func LoadSessionRequest(dir, tag, id string) (*SessionRequestV2, error) {
+	if !validName(tag) || !validName(id) {
+		return nil, errSessionNotFound
+	}
+	if _, err := os.Stat(fmt.Sprintf("%v/%v/process-%v.data", dir, tag, id)); err != nil {
+		return nil, errSessionNotFound
+	}
+	msg := &SessionRequestV2{Version: ProtocolVersion, Tag: tag}
+	if meta, err := loadMeta(dir, tag, id); err == nil {
+		msg.SysInfo = meta.SysInfo
+		msg.ExtraInfo = meta.ExtraInfo
+		msg.RunID = meta.RunID
+		msg.Labels = meta.Labels
+	}
+	return msg, nil
+}
+
+// Replay reads the stored records of the session tag/id under dir and calls send
+// with each of them, at speed times the pace they were recorded, 0 for max speed.
+// The timestamps are rebased so that the first record is at the current time,
+// keeping the original intervals between the records.
+// Replay stops at the first error returned by send.
+func Replay(dir, tag, id string, speed float64, send func(*RecordV2) error) error {
+	if !validName(tag) || !validName(id) {
+		return errSessionNotFound
+	}
+	snapshots, err := loadSnapshots(fmt.Sprintf("%v/%v/snapshot-%v.data", dir, tag, id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	bySecond := make(map[int64]string, len(snapshots))
+	for _, s := range snapshots {
+		bySecond[s.Timestamp] = s.Snapshot
+	}
+
+	var first, base int64
+	var start time.Time
+	var sendErr error
+	err = walkRecords(fmt.Sprintf("%v/%v/process-%v.data", dir, tag, id), func(pr *pRecord) bool {
+		if start.IsZero() {
+			start = time.Now()
+			first = pr.Timestamp
+			base = start.Unix()
+		}
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(pr.Timestamp-first) * float64(time.Second) / speed))
+			if d := time.Until(due); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		record := &RecordV2{
+			Timestamp: base + pr.Timestamp - first,
+			Processes: pr.Processes,
+			Snapshot:  bySecond[pr.Timestamp],
+			Sys:       pr.Sys,
+		}
+		if sendErr = send(record); sendErr != nil {
+			return false
+		}
+		return true
+	})
+	if sendErr != nil {
+		return sendErr
+	}
+	if os.IsNotExist(err) {
+		return errSessionNotFound
+	}
+	return err
+}
+
+// Handle handles ReplaySession.
+func (msg *ReplaySession) Handle(stream as.ContextStream) (reply interface{}) {
+	lg := stream.GetContext().(*log.Logger)
+
+	if _, err := LoadSessionRequest(dataDir, msg.Tag, msg.Session); err != nil {
+		return err
+	}
+	go func() {
+		err := Replay(dataDir, msg.Tag, msg.Session, msg.Speed, func(r *RecordV2) error {
+			return stream.Send(r)
+		})
+		if err != nil {
+			lg.Debugf("replay of session %v/%v stopped: %v", msg.Tag, msg.Session, err)
+			return
+		}
+		// an empty record marks the end
+		if err := stream.Send(&RecordV2{}); err != nil {
+			lg.Debugln(err)
+		}
+	}()
+	return 0
+}
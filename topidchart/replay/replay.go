@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+	topid "github.com/godevsig/grepo/topidchart"
+)
+
+var stopped int32
+
+var errStopped = errors.New("replay stopped")
+
+// replayTo replays the session as a new session to the server.
+func replayTo(c *as.Client, dir, tag, session, newTag string, speed float64) (int, error) {
+	msg, err := topid.LoadSessionRequest(dir, tag, session)
+	if err != nil {
+		return 0, err
+	}
+	if newTag != "" {
+		msg.Tag = newTag
+	}
+	if msg.Labels == nil {
+		msg.Labels = make(map[string]string)
+	}
+	msg.Labels["replayed"] = tag + "/" + session
+
+	conn := <-c.Discover("platform", "topidchart")
+	if conn == nil {
+		return 0, errors.New("connect to topidchart failed")
+	}
+	defer conn.Close()
+
+	var rep topid.SessionResponseV2
+	if err := conn.SendRecv(msg, &rep); err != nil {
+		return 0, err
+	}
+	fmt.Println("replaying to", rep.ChartURL)
+
+	records := 0
+	err = topid.Replay(dir, tag, session, speed, func(r *topid.RecordV2) error {
+		if atomic.LoadInt32(&stopped) != 0 {
+			return errStopped
+		}
+		records++
+		return conn.Send(r)
+	})
+	if err == nil || err == errStopped {
+		// an empty record ends the session
+		conn.Send(&topid.RecordV2{})
+	}
+	return records, err
+}
+
+// subscribe asks the server to replay the session and prints the received records.
+func subscribe(c *as.Client, tag, session string, speed float64) error {
+	conn := <-c.Discover("platform", "topidchart")
+	if conn == nil {
+		return errors.New("connect to topidchart failed")
+	}
+	defer conn.Close()
+
+	msg := topid.ReplaySession{Tag: tag, Session: session, Speed: speed}
+	if err := conn.SendRecv(&msg, nil); err != nil {
+		return err
+	}
+	for atomic.LoadInt32(&stopped) == 0 {
+		var r topid.RecordV2
+		if err := conn.Recv(&r); err != nil {
+			return err
+		}
+		if r.Timestamp == 0 {
+			return nil
+		}
+		var cpu float32
+		var mem uint64
+		for _, p := range r.Processes {
+			cpu += p.Ucpu + p.Scpu
+			mem += p.Mem
+		}
+		fmt.Printf("%s processes %d cpu %.1f%% mem %dKB\n", time.Unix(r.Timestamp, 0).Format("15:04:05"), len(r.Processes), cpu, mem)
+	}
+	return errStopped
+}
+
+// Start starts the app
+func Start(args []string) (err error) {
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(os.Stdout)
+
+	dir := flags.String("dir", "topidata", "directory of the stored sessions")
+	tag := flags.String("tag", "", "tag of the session to replay")
+	session := flags.String("session", "", "session to replay")
+	speed := flags.Float64("speed", 1, "replay speed, e.g. 1 or 10 times the recorded pace, 0 for max speed")
+	newTag := flags.String("newtag", "", "tag of the replayed sessions, the tag of the stored session if not set")
+	num := flags.Int("n", 1, "number of concurrent replayed sessions, used as load generator")
+	sub := flags.Bool("subscribe", false, "ask the server to replay the session from its data directory and print the records")
+
+	if err = flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			err = nil
+		}
+		return err
+	}
+	if *tag == "" || *session == "" {
+		return errors.New("-tag and -session are required")
+	}
+
+	c := as.NewClient(as.WithScope(as.ScopeWAN)).SetDiscoverTimeout(3)
+	if *sub {
+		return subscribe(c, *tag, *session, *speed)
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	var total int64
+	errs := make([]error, *num)
+	for i := 0; i < *num; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n, err := replayTo(c, *dir, *tag, *session, *newTag, *speed)
+			atomic.AddInt64(&total, int64(n))
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	fmt.Printf("%d records sent in %v, %.1f records/s\n", total, elapsed.Truncate(time.Millisecond), float64(total)/elapsed.Seconds())
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop stops the app
+func Stop() {
+	fmt.Println("topid replay stopping...")
+	atomic.StoreInt32(&stopped, 1)
+}
+
+func main() {
+	if err := Start(os.Args[1:]); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
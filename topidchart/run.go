@@ -0,0 +1,286 @@
+package topidchart
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/opts"
+	"github.com/go-echarts/go-echarts/v2/types"
+	"github.com/gorilla/mux"
+)
+
+// maxRunConsumers is the max number of rows in the top consumers table of the run dashboard.
+const maxRunConsumers = 20
+
+// runMetas returns the metas of the sessions that joined the run, sorted by host.
+func runMetas(dir, run string) []*sessionMeta {
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "meta-*.data"))
+	var metas []*sessionMeta
+	for _, f := range files {
+		meta, err := readMeta(f)
+		if err != nil || meta.RunID != run {
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		if hi, hj := hostName(metas[i]), hostName(metas[j]); hi != hj {
+			return hi < hj
+		}
+		return metas[i].Start < metas[j].Start
+	})
+	return metas
+}
+
+// hostName returns the hostname of the session, or its tag if the hostname was not collected.
+func hostName(meta *sessionMeta) string {
+	if meta.SysInfo.Hostname != "" {
+		return meta.SysInfo.Hostname
+	}
+	return meta.Tag
+}
+
+type runChart struct {
+	ID     string
+	Option template.JS
+}
+
+type runHost struct {
+	Name     string
+	Tag      string
+	Session  string
+	CPU, MEM runChart
+}
+
+type runConsumer struct {
+	Host    string
+	Tag     string
+	Session string
+	Process string
+	CPUAvg  float32
+	CPUMax  float32
+	MEMAvg  float32
+	MEMMax  float32
+}
+
+type runPage struct {
+	Run       string
+	Echarts   template.JS
+	Themes    template.JS
+	Hosts     []runHost
+	Consumers []runConsumer
+}
+
+const runTpl = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="UTF-8">
+	<title>Run {{.Run}}</title>
+	<script type="text/javascript">{{.Echarts}}</script>
+	<script type="text/javascript">{{.Themes}}</script>
+	<style>
+		body { font: 14px Sans-Serif; color: #333; margin: 20px; }
+		table { border-collapse: collapse; }
+		th, td { text-align: left; padding: 4px 12px; border-bottom: 1px solid #ddd; }
+		th { background: #eee; }
+		a { color: #2980B9; text-decoration: none; }
+		.row { display: flex; }
+		.chart { width: 700px; height: 300px; }
+	</style>
+</head>
+<body>
+<p>&#x1F680; <em>Run {{.Run}}</em>, {{len .Hosts}} host(s)</p>
+{{- if .Consumers}}
+<h3>Top consumers across all hosts</h3>
+<table>
+	<tr><th>Host</th><th>Process</th>
+		<th><a href="?sort=cpu">CPU avg</a></th><th>CPU max</th>
+		<th><a href="?sort=mem">MEM avg (MB)</a></th><th>MEM max (MB)</th></tr>
+	{{- range .Consumers}}
+	<tr><td><a href="/{{.Tag}}/{{.Session}}">{{.Host}}</a></td><td>{{.Process}}</td>
+		<td>{{.CPUAvg}}</td><td>{{.CPUMax}}</td><td>{{.MEMAvg}}</td><td>{{.MEMMax}}</td></tr>
+	{{- end}}
+</table>
+{{- end}}
+{{- range .Hosts}}
+<h3><a href="/{{.Tag}}/{{.Session}}">{{.Name}}</a> <small><a href="/{{.Tag}}/{{.Session}}/info">info</a></small></h3>
+<div class="row">
+	<div class="chart" id="{{.CPU.ID}}"></div>
+	<div class="chart" id="{{.MEM.ID}}"></div>
+</div>
+{{- end}}
+<script type="text/javascript">
+	"use strict";
+	var runCharts = [];
+	{{- range .Hosts}}
+	{{- range (list .CPU .MEM)}}
+	(function(){
+		var chart = echarts.init(document.getElementById({{.ID}}), "shine");
+		var option = {{.Option}};
+		option.grid = {"left":50, "right":200};
+		chart.setOption(option);
+		runCharts.push(chart);
+	})();
+	{{- end}}
+	{{- end}}
+	echarts.connect(runCharts);
+</script>
+</body>
+</html>
+`
+
+var runTmpl = template.Must(template.New("run").Funcs(template.FuncMap{
+	"list": func(charts ...runChart) []runChart { return charts },
+}).Parse(runTpl))
+
+// lineRun returns the line chart of the series on the time axis from min to max in unix time.
+func (prs *processRecords) lineRun(title, unit string, m map[string][]float32, mode string, min, max int64) runChart {
+	line := charts.NewLine()
+	line.SetGlobalOptions(
+		charts.WithTitleOpts(opts.Title{
+			Title: title,
+		}),
+		charts.WithXAxisOpts(opts.XAxis{
+			Type: "time",
+			Min:  min * 1000,
+			Max:  max * 1000,
+		}),
+		charts.WithYAxisOpts(opts.YAxis{
+			Name: unit,
+		}),
+		charts.WithTooltipOpts(opts.Tooltip{
+			Show:    true,
+			Trigger: "axis",
+		}),
+		charts.WithInitializationOpts(opts.Initialization{
+			Theme: types.ThemeShine,
+		}),
+		charts.WithDataZoomOpts(opts.DataZoom{
+			XAxisIndex: []int{0},
+		}),
+		charts.WithLegendOpts(opts.Legend{
+			Show:   true,
+			Type:   "scroll",
+			Orient: "vertical",
+			Right:  "0",
+		}),
+	)
+
+	prs.sortMap(mode, m, func(k string, v []float32) {
+		items := make([]opts.LineData, 0, len(v))
+		for i, data := range v {
+			items = append(items, opts.LineData{Value: []interface{}{prs.stamps[i] * 1000, data}})
+		}
+		line.AddSeries(k, items)
+	})
+	line.SetSeriesOptions(
+		charts.WithAreaStyleOpts(
+			opts.AreaStyle{
+				Opacity: 0.8,
+			}),
+		charts.WithLineChartOpts(
+			opts.LineChart{
+				Stack:    "stack",
+				Sampling: "lttb",
+			}),
+	)
+	line.Validate()
+
+	return runChart{ID: line.ChartID, Option: template.JS(line.JSONNotEscaped())}
+}
+
+func (cs *chartServer) runHandler(w http.ResponseWriter, r *http.Request) {
+	run := mux.Vars(r)["run"]
+	vars := r.URL.Query()
+	// the sessions of a run may have different tags, so no dashboard
+	filter := cs.parseFilter("", vars)
+
+	metas := runMetas(cs.dir, run)
+	if len(metas) == 0 {
+		http.Error(w, "Run not found.", 404)
+		return
+	}
+
+	page := &runPage{
+		Run:     run,
+		Echarts: template.JS(echarts),
+		Themes:  template.JS(themes),
+	}
+
+	// the time axis is shared by all hosts
+	var min, max int64
+	hosts := make([]*processRecords, 0, len(metas))
+	for _, meta := range metas {
+		in := fmt.Sprintf("%v/%v/process-%v.data", cs.dir, meta.Tag, meta.ID)
+		records := newRecords()
+		if err := records.analysis(in, filter); err != nil {
+			cs.lg.Errorln(err)
+		}
+		hosts = append(hosts, records)
+		if n := len(records.stamps); n != 0 {
+			if min == 0 || records.stamps[0] < min {
+				min = records.stamps[0]
+			}
+			if records.stamps[n-1] > max {
+				max = records.stamps[n-1]
+			}
+		}
+	}
+
+	for i, meta := range metas {
+		records := hosts[i]
+		name := hostName(meta)
+		page.Hosts = append(page.Hosts, runHost{
+			Name:    name,
+			Tag:     meta.Tag,
+			Session: meta.ID,
+			CPU:     records.lineRun(name+" CPU", records.cpuUnit, records.cpu, "cpu", min, max),
+			MEM:     records.lineRun(name+" MEM", records.memUnit, records.mem, "mem", min, max),
+		})
+
+		for k := range records.cpuavg {
+			page.Consumers = append(page.Consumers, runConsumer{
+				Host:    name,
+				Tag:     meta.Tag,
+				Session: meta.ID,
+				Process: k,
+				CPUAvg:  floatConv(records.cpuavg[k]),
+				CPUMax:  records.cpumax[k],
+				MEMAvg:  floatConv(records.memavg[k]),
+				MEMMax:  records.memmax[k],
+			})
+		}
+		for k := range records.memavg {
+			if _, ok := records.cpuavg[k]; ok {
+				continue
+			}
+			page.Consumers = append(page.Consumers, runConsumer{
+				Host:    name,
+				Tag:     meta.Tag,
+				Session: meta.ID,
+				Process: k,
+				MEMAvg:  floatConv(records.memavg[k]),
+				MEMMax:  records.memmax[k],
+			})
+		}
+	}
+
+	sort.Slice(page.Consumers, func(i, j int) bool {
+		a, b := page.Consumers[i], page.Consumers[j]
+		if vars.Get("sort") == "mem" {
+			return a.MEMAvg > b.MEMAvg
+		}
+		return a.CPUAvg > b.CPUAvg
+	})
+	if len(page.Consumers) > maxRunConsumers {
+		page.Consumers = page.Consumers[:maxRunConsumers]
+	}
+
+	if err := runTmpl.Execute(w, page); err != nil {
+		cs.lg.Errorln(err)
+	}
+}
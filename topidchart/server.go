@@ -16,15 +16,71 @@ type Server struct {
 	ds *as.Server             // data server
 	fs *fileserver.FileServer // file server
 	cs *chartServer           // chart server
+
+	resumeWindow  time.Duration
+	flushInterval time.Duration
+	syncPolicy    SyncPolicy
+	digest        DigestConfig
+	fsOptions     []fileserver.Option
 }
 
+// DefaultResumeWindow is the default time a session can be resumed after its stream breaks.
+const DefaultResumeWindow = 5 * time.Minute
+
+// Option is the option of the server.
+type Option func(*Server)
+
+// WithResumeWindow sets the time a session can be resumed by ResumeSession
+// after its stream breaks, 0 disables resuming.
+func WithResumeWindow(d time.Duration) Option {
+	return func(server *Server) {
+		server.resumeWindow = d
+	}
+}
+
+// WithFlushInterval sets the interval the buffered records are written into the data files,
+// the records in the buffers are lost on crash.
+func WithFlushInterval(d time.Duration) Option {
+	return func(server *Server) {
+		server.flushInterval = d
+	}
+}
+
+// WithSyncPolicy sets when the data files are synced to disk, SyncInterval by default.
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(server *Server) {
+		server.syncPolicy = policy
+	}
+}
+
+// WithDigest enables the periodic digests of the tags, written into the data directory
+// and sent to the sinks of the config.
+func WithDigest(cfg DigestConfig) Option {
+	return func(server *Server) {
+		server.digest = cfg
+	}
+}
+
+// WithFileServer sets the options of the file server of the data directory,
+// e.g. to enable the uploads.
+func WithFileServer(options ...fileserver.Option) Option {
+	return func(server *Server) {
+		server.fsOptions = append(server.fsOptions, options...)
+	}
+}
+
+// reservedFiles are the patterns of the files in the data directory that can
+// not be created by the file server, see fileserver.WithReservedPaths.
+var reservedFiles = []string{"/*/*.data", "/*/" + dashboardFile, "/*/digest-*"}
+
 var (
 	hostAddr string
 	dataDir  string
+	sessions *sessionMgr
 )
 
 // NewServer creates a new server instance.
-func NewServer(lg *log.Logger, port, dir string) *Server {
+func NewServer(lg *log.Logger, port, dir string, options ...Option) *Server {
 	ip := "0.0.0.0"
 	c := as.NewClient(as.WithScope(as.ScopeWAN)).SetDiscoverTimeout(0)
 	conn := <-c.Discover("builtin", "IPObserver")
@@ -37,7 +93,24 @@ func NewServer(lg *log.Logger, port, dir string) *Server {
 		conn.Close()
 	}
 
-	fs := fileserver.NewFileServer(lg, "0", dir, "TOPID DATA")
+	server := &Server{
+		lg:            lg,
+		resumeWindow:  DefaultResumeWindow,
+		flushInterval: DefaultFlushInterval,
+		syncPolicy:    SyncInterval,
+	}
+	for _, o := range options {
+		o(server)
+	}
+	// the data files of the live sessions are still written
+	server.fsOptions = append(server.fsOptions, fileserver.WithProtectFunc(func(urlPath string) bool {
+		return sessions.livePath(urlPath)
+	}))
+	// the chart server trusts the data files, dashboards and digests in the tag
+	// directories, they are only created by the server itself
+	server.fsOptions = append(server.fsOptions, fileserver.WithReservedPaths(reservedFiles...))
+
+	fs := fileserver.NewFileServer(lg, "0", dir, "TOPID DATA", server.fsOptions...)
 	if fs == nil {
 		lg.Errorln("create file server failed")
 		return nil
@@ -55,12 +128,10 @@ func NewServer(lg *log.Logger, port, dir string) *Server {
 	hostAddr = fmt.Sprintf("%s:%s", ip, port)
 	dataDir = dir
 
-	server := &Server{
-		lg: lg,
-		ds: ds,
-		fs: fs,
-		cs: cs,
-	}
+	server.ds = ds
+	server.fs = fs
+	server.cs = cs
+	sessions = newSessionMgr(lg, server.resumeWindow, server.flushInterval, server.syncPolicy)
 
 	return server
 }
@@ -71,6 +142,11 @@ func (server *Server) Run() error {
 
 	go server.fs.Start()
 	go server.cs.start()
+	if server.digest.Period != DigestNone {
+		d := newDigester(server.lg, server.cs.dir, fmt.Sprintf("http://%s:%s", server.cs.ip, server.cs.chartport), server.digest)
+		go d.run()
+		defer d.stop()
+	}
 
 	if err := server.ds.Publish("topidchart",
 		knownMsgs,
@@ -90,6 +166,7 @@ func (server *Server) Run() error {
 // Close shutdown the server.
 func (server *Server) Close() {
 	server.ds.Close()
+	sessions.closeAll()
 }
 
 func randStringRunes(n int) string {
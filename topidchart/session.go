@@ -0,0 +1,624 @@
+package topidchart
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+	"github.com/godevsig/glib/sys/log"
+)
+
+// session is a collecting session that writes the received records into its data files.
+type session struct {
+	sync.Mutex
+	dir          string
+	meta         *sessionMeta
+	processFile  *os.File
+	snapshotFile *os.File
+	pBuf         *bufio.Writer
+	sBuf         *bufio.Writer
+	pEnc         *gob.Encoder
+	sEnc         *gob.Encoder
+	delta        *deltaDecoder // nil if not in delta mode
+	last         *pRecord      // the latest record
+	written      uint64        // bytes written into the data files
+	flushErr     error         // the error of the failed flush, the later writes fail with it
+	closed       bool
+	legacy       bool             // created by SessionRequest, can not be resumed
+	writer       int              // index of the writer in writerPool
+	subscribers  []chan *RecordV2 // see SubscribeSession
+
+	// below are protected by sessionMgr lock
+	token    string      // resume token
+	gen      int         // incremented on each resume
+	lastRecv time.Time   // last time a record was received
+	expire   *time.Timer // non-nil when no stream is attached, closes the session when fired
+	broken   bool        // the stream broke and the session is waiting for resume
+}
+
+var (
+	errInvalidTag    = errors.New("invalid tag")
+	errSessionClosed = errors.New("session closed")
+)
+
+// validName reports whether name can be used as a file name under the data directory.
+func validName(name string) bool {
+	return !strings.ContainsAny(name, `/\`) && name != "." && name != ".."
+}
+
+// reservedTags are the first path elements of the chart server pages that shadow
+// the session pages, they can not be used as tags or the sessions can not be viewed.
+var reservedTags = []string{"run"}
+
+// newSession creates the data files of a new session under dir/tag.
+func newSession(dir string, msg *SessionRequestV2) (*session, error) {
+	if !validName(msg.Tag) {
+		return nil, errInvalidTag
+	}
+	for _, tag := range reservedTags {
+		if msg.Tag == tag {
+			return nil, fmt.Errorf("tag %q is reserved", msg.Tag)
+		}
+	}
+	id := time.Now().Format("20060102") + "-" + randStringRunes(8)
+
+	filepath := fmt.Sprintf("%v/%v", dir, msg.Tag)
+	info := fmt.Sprintf("info-%v.data", id)
+	process := fmt.Sprintf("process-%v.data", id)
+	snapshot := fmt.Sprintf("snapshot-%v.data", id)
+	if err := os.MkdirAll(filepath, 0777); err != nil {
+		return nil, err
+	}
+
+	infoFile, err := os.OpenFile(path.Join(filepath, info), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	infoFile.WriteString(fmt.Sprintf("------CPUInfo------\n%s\n------KernelInfo------\n%s\n------ExtraInfo------\n%s\n", msg.SysInfo.CPUInfo, msg.SysInfo.KernelInfo, msg.ExtraInfo))
+	infoFile.Close()
+
+	meta := &sessionMeta{
+		Tag:       msg.Tag,
+		ID:        id,
+		Start:     time.Now().Unix(),
+		SysInfo:   msg.SysInfo,
+		ExtraInfo: msg.ExtraInfo,
+		RunID:     msg.RunID,
+		Labels:    msg.Labels,
+	}
+	if err := saveMeta(dir, meta); err != nil {
+		return nil, err
+	}
+
+	processFile, err := os.OpenFile(path.Join(filepath, process), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	snapshotFile, err := os.OpenFile(path.Join(filepath, snapshot), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		processFile.Close()
+		return nil, err
+	}
+
+	s := &session{
+		dir:          dir,
+		meta:         meta,
+		processFile:  processFile,
+		snapshotFile: snapshotFile,
+		pBuf:         bufio.NewWriter(processFile),
+		sBuf:         bufio.NewWriter(snapshotFile),
+	}
+	s.pEnc = gob.NewEncoder(&countWriter{s.pBuf, &s.written})
+	s.sEnc = gob.NewEncoder(&countWriter{s.sBuf, &s.written})
+	if msg.Delta || hasCapability(msg.Capabilities, CapDelta) {
+		s.delta = newDeltaDecoder()
+	}
+	return s, nil
+}
+
+// write stores the record into the buffers of the data files, delta records
+// are reconstructed to full records first. Records with invalid container IDs are rejected.
+func (s *session) write(record *RecordV2) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return errSessionClosed
+	}
+	if s.flushErr != nil {
+		return fmt.Errorf("data files failed to flush: %v", s.flushErr)
+	}
+
+	for _, p := range record.Processes {
+		if !validContainerID(p.ContainerID) {
+			return fmt.Errorf("pid %d: %w", p.Pid, errContainerID)
+		}
+	}
+	if s.delta != nil {
+		if err := s.delta.decode(record); err != nil {
+			return err
+		}
+	}
+
+	pr := &pRecord{record.Timestamp, record.Processes, record.Sys}
+	if err := s.pEnc.Encode(pr); err != nil {
+		return err
+	}
+	s.last = pr
+	if record.Snapshot != "" {
+		if err := s.sEnc.Encode(&sRecord{record.Timestamp, record.Snapshot}); err != nil {
+			return err
+		}
+	}
+	s.publish(&RecordV2{Timestamp: pr.Timestamp, Processes: pr.Processes, Snapshot: record.Snapshot, Sys: pr.Sys})
+	return nil
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	*cw.n += uint64(n)
+	return n, err
+}
+
+// flush writes the buffered records into the data files, and syncs them to disk if sync is set.
+func (s *session) flush(sync bool) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil
+	}
+	return s.flushLocked(sync)
+}
+
+// flushLocked keeps the first flush error, as the buffered records are lost
+// and the data files may end with a partial record.
+func (s *session) flushLocked(sync bool) error {
+	if s.flushErr != nil {
+		return s.flushErr
+	}
+	s.flushErr = s.flushFiles(sync)
+	return s.flushErr
+}
+
+func (s *session) flushFiles(sync bool) error {
+	if err := s.pBuf.Flush(); err != nil {
+		return err
+	}
+	if err := s.sBuf.Flush(); err != nil {
+		return err
+	}
+	if !sync {
+		return nil
+	}
+	if err := s.processFile.Sync(); err != nil {
+		return err
+	}
+	return s.snapshotFile.Sync()
+}
+
+// close flushes and closes the data files and saves the end time of the session.
+func (s *session) close(sync bool) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	for _, ch := range s.subscribers {
+		close(ch)
+	}
+	s.subscribers = nil
+	err := s.flushLocked(sync)
+	s.processFile.Close()
+	s.snapshotFile.Close()
+	s.meta.End = s.lastRecv.Unix()
+	if merr := saveMeta(s.dir, s.meta); err == nil {
+		err = merr
+	}
+	return err
+}
+
+var errResumeToken = errors.New("resume token not found or expired")
+
+// sessionMgr tracks the sessions that can be resumed by their resume tokens.
+type sessionMgr struct {
+	sync.Mutex
+	lg         *log.Logger
+	window     time.Duration // 0 disables resuming
+	sessions   map[string]*session
+	writers    *writerPool
+	nextWriter int
+
+	// ingest statistics
+	records      uint64
+	decodeErrors uint64 // undecodable or invalid records and delta records without keyframe
+	writeErrors  uint64
+	closedBytes  uint64 // bytes written by the closed sessions
+	rate         rateCounter
+}
+
+// rateWindow is the window in seconds of rateCounter.
+const rateWindow = 60
+
+// rateCounter counts events per second in a sliding window.
+type rateCounter struct {
+	secs   [rateWindow]int64
+	counts [rateWindow]uint64
+}
+
+func (rc *rateCounter) add(now int64) {
+	i := now % rateWindow
+	if rc.secs[i] != now {
+		rc.secs[i] = now
+		rc.counts[i] = 0
+	}
+	rc.counts[i]++
+}
+
+// perSecond returns the average events per second in the window till now.
+func (rc *rateCounter) perSecond(now int64) float64 {
+	var sum uint64
+	for i, sec := range rc.secs {
+		if sec > now-rateWindow && sec <= now {
+			sum += rc.counts[i]
+		}
+	}
+	return float64(sum) / rateWindow
+}
+
+func newSessionMgr(lg *log.Logger, window, flushInterval time.Duration, policy SyncPolicy) *sessionMgr {
+	mgr := &sessionMgr{
+		lg:       lg,
+		window:   window,
+		sessions: make(map[string]*session),
+	}
+	mgr.writers = newWriterPool(flushInterval, policy, mgr.flushFailed)
+	return mgr
+}
+
+func newResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return randStringRunes(32)
+	}
+	return hex.EncodeToString(b)
+}
+
+// add registers the session and returns its resume token.
+// The sessions are assigned to the writers in turn.
+func (mgr *sessionMgr) add(s *session) string {
+	mgr.Lock()
+	defer mgr.Unlock()
+	s.writer = mgr.nextWriter % numWriters
+	mgr.nextWriter++
+	s.token = newResumeToken()
+	s.lastRecv = time.Now()
+	mgr.sessions[s.token] = s
+	return s.token
+}
+
+// reattach stops the expire timer of the session of the token and increments
+// its generation, it should be called with sessionMgr lock held.
+func (mgr *sessionMgr) reattach(token string) (*session, error) {
+	s, ok := mgr.sessions[token]
+	if !ok {
+		return nil, errResumeToken
+	}
+	if s.expire != nil {
+		s.expire.Stop()
+		s.expire = nil
+	}
+	s.broken = false
+	s.gen++
+	return s, nil
+}
+
+// attach attaches the session of the token to a new stream that continues the
+// previous one without outage. It returns the new generation of the session.
+func (mgr *sessionMgr) attach(token string) (*session, int, error) {
+	mgr.Lock()
+	defer mgr.Unlock()
+	s, err := mgr.reattach(token)
+	if err != nil {
+		return nil, 0, err
+	}
+	return s, s.gen, nil
+}
+
+// resume re-attaches the session of the token to a new stream and records the
+// outage gap. It returns the new generation of the session.
+func (mgr *sessionMgr) resume(token string) (*session, int, error) {
+	mgr.Lock()
+	defer mgr.Unlock()
+	s, err := mgr.reattach(token)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.meta.Gaps = append(s.meta.Gaps, gap{From: s.lastRecv.Unix(), To: time.Now().Unix()})
+	if s.delta != nil {
+		// the collector restarts with a keyframe
+		s.delta.synced = false
+	}
+	if err := saveMeta(s.dir, s.meta); err != nil {
+		mgr.lg.Warnf("session %v/%v: %v", s.meta.Tag, s.meta.ID, err)
+	}
+	return s, s.gen, nil
+}
+
+// detach is called when the stream of generation gen of the session ends,
+// the session is closed right away if ended normally, or if not resumed within
+// the window when the stream broke.
+func (mgr *sessionMgr) detach(s *session, gen int, ended bool) {
+	mgr.Lock()
+	if s.gen != gen {
+		// already resumed by a newer stream
+		mgr.Unlock()
+		return
+	}
+	if ended || mgr.window == 0 {
+		delete(mgr.sessions, s.token)
+		mgr.Unlock()
+		mgr.close(s)
+		return
+	}
+	s.broken = true
+	mgr.expireLocked(s, gen)
+	mgr.Unlock()
+}
+
+// idle is called when the HTTP request of generation gen of the session is done,
+// the session is live but closed if no records are posted within the window.
+func (mgr *sessionMgr) idle(s *session, gen int) {
+	mgr.Lock()
+	defer mgr.Unlock()
+	if s.gen == gen {
+		mgr.expireLocked(s, gen)
+	}
+}
+
+// expireLocked closes the session of generation gen after the window,
+// it should be called with sessionMgr lock held.
+func (mgr *sessionMgr) expireLocked(s *session, gen int) {
+	s.expire = time.AfterFunc(mgr.window, func() {
+		mgr.Lock()
+		if s.gen != gen {
+			mgr.Unlock()
+			return
+		}
+		delete(mgr.sessions, s.token)
+		mgr.Unlock()
+		mgr.close(s)
+	})
+}
+
+// close closes the session removed from the sessions, it should be called
+// without sessionMgr lock held as it flushes and syncs the data files.
+func (mgr *sessionMgr) close(s *session) {
+	err := s.close(mgr.writers.policy != SyncNone)
+	s.Lock()
+	written := s.written
+	s.Unlock()
+	mgr.Lock()
+	mgr.closedBytes += written
+	mgr.Unlock()
+	if err != nil {
+		mgr.lg.Warnf("session %v/%v: %v", s.meta.Tag, s.meta.ID, err)
+	}
+}
+
+// received updates the ingest statistics with a record received by the session,
+// err is the error of writing the record.
+func (mgr *sessionMgr) received(s *session, err error) {
+	mgr.Lock()
+	defer mgr.Unlock()
+	s.lastRecv = time.Now()
+	mgr.records++
+	mgr.rate.add(s.lastRecv.Unix())
+	if err == errNoKeyframe || errors.Is(err, errContainerID) {
+		mgr.decodeErrors++
+	} else if err != nil {
+		mgr.writeErrors++
+	}
+}
+
+// flushFailed is called by the writers when the buffered records of the session fail to flush.
+func (mgr *sessionMgr) flushFailed(s *session, err error) {
+	mgr.lg.Errorf("session %v/%v: flush: %v", s.meta.Tag, s.meta.ID, err)
+	mgr.Lock()
+	mgr.writeErrors++
+	mgr.Unlock()
+}
+
+func (mgr *sessionMgr) decodeFailed() {
+	mgr.Lock()
+	mgr.decodeErrors++
+	mgr.Unlock()
+}
+
+// remove closes the session of the token without waiting for resume.
+func (mgr *sessionMgr) remove(token string) error {
+	mgr.Lock()
+	s, ok := mgr.sessions[token]
+	if !ok {
+		mgr.Unlock()
+		return errResumeToken
+	}
+	if s.expire != nil {
+		s.expire.Stop()
+	}
+	s.gen++
+	delete(mgr.sessions, token)
+	mgr.Unlock()
+	mgr.close(s)
+	return nil
+}
+
+// livePath returns true if the URL path of the file server is a data file of a live
+// session, including the sessions waiting for resume, or a directory containing one.
+func (mgr *sessionMgr) livePath(urlPath string) bool {
+	p := strings.Trim(path.Clean("/"+urlPath), "/")
+	tag, file := p, ""
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		tag, file = p[:i], p[i+1:]
+	}
+
+	mgr.Lock()
+	defer mgr.Unlock()
+	for _, s := range mgr.sessions {
+		if p == "" {
+			return true
+		}
+		if s.meta.Tag != tag {
+			continue
+		}
+		if file == "" || strings.HasSuffix(file, "-"+s.meta.ID+".data") {
+			return true
+		}
+	}
+	return false
+}
+
+// closeAll writes the queued records and closes all the sessions on server shutdown.
+func (mgr *sessionMgr) closeAll() {
+	mgr.writers.stop()
+	mgr.Lock()
+	var closing []*session
+	for token, s := range mgr.sessions {
+		if s.expire != nil {
+			s.expire.Stop()
+		}
+		s.gen++
+		closing = append(closing, s)
+		delete(mgr.sessions, token)
+	}
+	mgr.Unlock()
+	for _, s := range closing {
+		mgr.close(s)
+	}
+}
+
+// isEnd returns true if the record is the empty RecordV2 marking the end of the session.
+func (r *RecordV2) isEnd() bool {
+	return r.Timestamp == 0 && len(r.Processes) == 0 && r.Snapshot == "" && r.Sys == nil &&
+		!r.Keyframe && len(r.Names) == 0 && len(r.Gone) == 0
+}
+
+// serve receives the records from the stream of generation gen and queues them to
+// the writer of the session until the empty Record or the stream breaks, the legacy
+// sessions are closed right away when the stream breaks. Write errors
+// are reported to the client on the stream, once until a record is written again.
+func (mgr *sessionMgr) serve(lg *log.Logger, stream as.ContextStream, s *session, gen int) {
+	var pending sync.WaitGroup
+	errs := make(chan error, 1)
+	quit := make(chan struct{})
+	ended := false
+	defer func() { mgr.detach(s, gen, ended || s.legacy) }()
+	defer pending.Wait()
+	defer close(quit)
+	lg.Debugln("data processing started")
+
+	// the writers never block on the stream, the client may not read it
+	go func() {
+		for {
+			select {
+			case err := <-errs:
+				if stream.Send(err) != nil {
+					return
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	// only accessed by the writer of the session
+	failing := false
+	done := func(record *RecordV2, err error) {
+		defer pending.Done()
+		mgr.received(s, err)
+		if err == nil {
+			failing = false
+			return
+		}
+		lg.Warnf("session %v/%v: %v", s.meta.Tag, s.meta.ID, err)
+		if !failing {
+			failing = true
+			select {
+			case errs <- fmt.Errorf("session %v/%v: record at %v not stored: %v", s.meta.Tag, s.meta.ID, record.Timestamp, err):
+			default:
+			}
+		}
+	}
+
+	for {
+		record, err := recv(stream, s.legacy)
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				lg.Errorln(err)
+				mgr.decodeFailed()
+			}
+			break
+		}
+		if record.isEnd() {
+			lg.Debugf("session %v/%v ended", s.meta.Tag, s.meta.ID)
+			ended = true
+			break
+		}
+		pending.Add(1)
+		mgr.writers.enqueue(s, record, func(err error) { done(record, err) })
+	}
+}
+
+// recv receives a RecordV2 from the stream, or a Record converted to RecordV2 if legacy.
+func recv(stream as.ContextStream, legacy bool) (*RecordV2, error) {
+	if !legacy {
+		var record RecordV2
+		err := stream.Recv(&record)
+		return &record, err
+	}
+	var record Record
+	if err := stream.Recv(&record); err != nil {
+		return nil, err
+	}
+	return record.v2(), nil
+}
+
+func (s *session) chartURL() string {
+	return fmt.Sprintf("http://%v/%v/%v", hostAddr, s.meta.Tag, s.meta.ID)
+}
+
+func (s *session) response() *SessionResponseV2 {
+	resp := &SessionResponseV2{
+		Version:      ProtocolVersion,
+		Capabilities: capabilities,
+		ChartURL:     s.chartURL(),
+		ResumeToken:  s.token,
+	}
+	if s.meta.RunID != "" {
+		resp.RunURL = fmt.Sprintf("http://%v/run/%v", hostAddr, url.PathEscape(s.meta.RunID))
+	}
+	if s.delta != nil {
+		resp.Delta = true
+		resp.KeyframeInterval = keyframeInterval
+	}
+	return resp
+}
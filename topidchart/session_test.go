@@ -0,0 +1,53 @@
+package topidchart
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewSessionTag(t *testing.T) {
+	cases := []struct {
+		tag   string
+		valid bool
+	}{
+		{"board1", true},
+		{"readme", true},
+		{"history", true},
+		{"metrics", true},
+		{"ingest", true},
+		{"grafana", true},
+		{"run", false},
+		{"..", false},
+		{"a/b", false},
+	}
+	for _, c := range cases {
+		s, err := newSession(t.TempDir(), &SessionRequestV2{Tag: c.tag})
+		if (err == nil) != c.valid {
+			t.Errorf("tag %q: got %v, want valid %v", c.tag, err, c.valid)
+		}
+		if s != nil {
+			s.close(false)
+		}
+	}
+}
+
+// writeSession stores the records as a session of the tag under dir and returns
+// the session ID, the session starts at the first record and ends at the last.
+func writeSession(t *testing.T, dir, tag string, gaps []gap, records ...*RecordV2) string {
+	s, err := newSession(dir, &SessionRequestV2{Tag: tag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range records {
+		if err := s.write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.meta.Start = records[0].Timestamp
+	s.meta.Gaps = gaps
+	s.lastRecv = time.Unix(records[len(records)-1].Timestamp, 0)
+	if err := s.close(false); err != nil {
+		t.Fatal(err)
+	}
+	return s.meta.ID
+}
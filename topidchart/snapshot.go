@@ -0,0 +1,374 @@
+package topidchart
+
+import (
+	"encoding/gob"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxMatchLines = 20      // max matched lines shown for each snapshot in search result
+	maxDiffCells  = 4000000 // max LCS table size, larger diffs fall back to replace all
+)
+
+type snapshotStamp struct {
+	Unix int64
+	Time string
+}
+
+type snapshotMatch struct {
+	snapshotStamp
+	Lines []string
+	More  int
+}
+
+type diffLine struct {
+	Op   string // " ", "+" or "-"
+	Text string
+}
+
+type snapshotDiff struct {
+	A, B  snapshotStamp
+	Lines []diffLine
+}
+
+type snapshotView struct {
+	snapshotStamp
+	Text       string
+	Prev, Next int64
+}
+
+type snapshotPage struct {
+	Tag      string
+	Session  string
+	Stamps   []snapshotStamp
+	Current  *snapshotView
+	Diff     *snapshotDiff
+	Query    string
+	Regex    bool
+	QueryErr string
+	Matches  []snapshotMatch
+	Searched bool
+}
+
+const snapshotTpl = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="UTF-8">
+	<title>Snapshots of {{.Tag}}/{{.Session}}</title>
+	<style>
+		body { font: 14px Sans-Serif; color: #333; margin: 0; }
+		#nav { position: fixed; top: 0; bottom: 0; left: 0; width: 170px; overflow-y: auto; background: #eee; padding: 10px; }
+		#nav a { display: block; padding: 2px 0; text-decoration: none; color: #2980B9; }
+		#nav a.cur { font-weight: bold; color: #E67E22; }
+		#main { margin-left: 200px; padding: 10px; }
+		pre { background: #f7f7f7; padding: 8px; overflow-x: auto; }
+		.add { background: #e6ffed; } .del { background: #ffeef0; }
+		.bar a, .bar input { margin-right: 12px; }
+	</style>
+</head>
+<body>
+<div id="nav">
+	<a href="/{{.Tag}}/{{.Session}}">&#x1F680; CHART</a>
+	<hr>
+	{{- range .Stamps}}
+	<a href="/{{$.Tag}}/{{$.Session}}/snapshot?at={{.Unix}}"{{if $.Current}}{{if eq .Unix $.Current.Unix}} class="cur"{{end}}{{end}}>{{.Time}}</a>
+	{{- end}}
+</div>
+<div id="main">
+	<form class="bar" method="get" action="/{{.Tag}}/{{.Session}}/snapshot">
+		<input type="text" name="q" value="{{.Query}}" placeholder="search string or regex" size="40">
+		<label><input type="checkbox" name="regex"{{if .Regex}} checked{{end}}>regex</label>
+		<input type="submit" value="SEARCH">
+	</form>
+	{{- if .QueryErr}}
+	<p>invalid query: {{.QueryErr}}</p>
+	{{- end}}
+	{{- if .Searched}}
+	<h3>{{len .Matches}} snapshot(s) containing "{{.Query}}"</h3>
+	{{- range .Matches}}
+	<p class="bar"><a href="/{{$.Tag}}/{{$.Session}}/snapshot?at={{.Unix}}">{{.Time}}</a><a href="/{{$.Tag}}/{{$.Session}}?at={{.Unix}}">chart</a></p>
+	<pre>{{range .Lines}}{{.}}
+{{end}}{{if .More}}... {{.More}} more line(s){{end}}</pre>
+	{{- end}}
+	{{- end}}
+	{{- with .Current}}
+	<h3>Snapshot at {{.Time}}</h3>
+	<p class="bar">
+		{{- if .Prev}}<a href="/{{$.Tag}}/{{$.Session}}/snapshot?at={{.Prev}}">&lt; prev</a><a href="/{{$.Tag}}/{{$.Session}}/snapshot/diff?a={{.Prev}}&b={{.Unix}}">diff with prev</a>{{end}}
+		{{- if .Next}}<a href="/{{$.Tag}}/{{$.Session}}/snapshot?at={{.Next}}">next &gt;</a><a href="/{{$.Tag}}/{{$.Session}}/snapshot/diff?a={{.Unix}}&b={{.Next}}">diff with next</a>{{end}}
+		<a href="/{{$.Tag}}/{{$.Session}}?at={{.Unix}}">show in chart</a>
+	</p>
+	<form class="bar" method="get" action="/{{$.Tag}}/{{$.Session}}/snapshot/diff">
+		<input type="hidden" name="a" value="{{.Unix}}">
+		diff with <select name="b">{{range $.Stamps}}<option value="{{.Unix}}">{{.Time}}</option>{{end}}</select>
+		<input type="submit" value="DIFF">
+	</form>
+	<pre>{{.Text}}</pre>
+	{{- end}}
+	{{- with .Diff}}
+	<h3>Diff {{.A.Time}} .. {{.B.Time}}</h3>
+	<p class="bar"><a href="/{{$.Tag}}/{{$.Session}}/snapshot?at={{.A.Unix}}">{{.A.Time}}</a><a href="/{{$.Tag}}/{{$.Session}}/snapshot?at={{.B.Unix}}">{{.B.Time}}</a></p>
+	<pre>{{range .Lines}}{{if eq .Op "+"}}<span class="add">+ {{.Text}}</span>{{else if eq .Op "-"}}<span class="del">- {{.Text}}</span>{{else}}  {{.Text}}{{end}}
+{{end}}</pre>
+	{{- end}}
+</div>
+</body>
+</html>
+`
+
+var snapshotTmpl = template.Must(template.New("snapshot").Parse(snapshotTpl))
+
+func newSnapshotStamp(ts int64) snapshotStamp {
+	return snapshotStamp{ts, time.Unix(ts, 0).Format("15:04:05")}
+}
+
+// loadSnapshots reads all non-empty snapshot records in filename.
+func loadSnapshots(filename string) ([]sRecord, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var snapshots []sRecord
+	decoder := gob.NewDecoder(f)
+	for {
+		var buf = sRecord{}
+		if err := decoder.Decode(&buf); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return snapshots, err
+		}
+		if len(buf.Snapshot) != 0 {
+			snapshots = append(snapshots, buf)
+		}
+	}
+}
+
+// findSnapshot returns the index of the last snapshot taken at or before ts,
+// or the first one if all are later than ts.
+func findSnapshot(snapshots []sRecord, ts int64) int {
+	idx := 0
+	for i, s := range snapshots {
+		if s.Timestamp > ts {
+			break
+		}
+		idx = i
+	}
+	return idx
+}
+
+func queryInt64(r *http.Request, key string) int64 {
+	v, _ := strconv.ParseInt(r.URL.Query().Get(key), 10, 64)
+	return v
+}
+
+func (cs *chartServer) loadSnapshotPage(w http.ResponseWriter, r *http.Request) (*snapshotPage, []sRecord) {
+	params := mux.Vars(r)
+	page := &snapshotPage{Tag: params["tag"], Session: params["session"]}
+
+	in := fmt.Sprintf("%v/%v/snapshot-%v.data", cs.dir, page.Tag, page.Session)
+	snapshots, err := loadSnapshots(in)
+	if err != nil {
+		if len(snapshots) == 0 {
+			http.Error(w, "File not found.", 404)
+			return nil, nil
+		}
+		cs.lg.Errorln(err)
+	}
+	for _, s := range snapshots {
+		page.Stamps = append(page.Stamps, newSnapshotStamp(s.Timestamp))
+	}
+	return page, snapshots
+}
+
+func (cs *chartServer) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	page, snapshots := cs.loadSnapshotPage(w, r)
+	if page == nil {
+		return
+	}
+
+	vars := r.URL.Query()
+	page.Query = vars.Get("q")
+	page.Regex = vars.Get("regex") != ""
+	if page.Query != "" {
+		match, err := lineMatcher(page.Query, page.Regex)
+		if err != nil {
+			page.QueryErr = err.Error()
+		} else {
+			page.Searched = true
+			page.Matches = searchSnapshots(snapshots, match)
+		}
+	}
+
+	if !page.Searched && len(snapshots) != 0 {
+		i := findSnapshot(snapshots, queryInt64(r, "at"))
+		view := &snapshotView{
+			snapshotStamp: newSnapshotStamp(snapshots[i].Timestamp),
+			Text:          snapshots[i].Snapshot,
+		}
+		if i > 0 {
+			view.Prev = snapshots[i-1].Timestamp
+		}
+		if i < len(snapshots)-1 {
+			view.Next = snapshots[i+1].Timestamp
+		}
+		page.Current = view
+	}
+
+	if err := snapshotTmpl.Execute(w, page); err != nil {
+		cs.lg.Errorln(err)
+	}
+}
+
+func (cs *chartServer) snapshotDiffHandler(w http.ResponseWriter, r *http.Request) {
+	page, snapshots := cs.loadSnapshotPage(w, r)
+	if page == nil {
+		return
+	}
+	if len(snapshots) == 0 {
+		http.Error(w, "No snapshot.", 404)
+		return
+	}
+
+	// b defaults to the snapshot next to a
+	a := findSnapshot(snapshots, queryInt64(r, "a"))
+	b := a + 1
+	if ts := queryInt64(r, "b"); ts != 0 {
+		b = findSnapshot(snapshots, ts)
+	}
+	if b >= len(snapshots) {
+		b = len(snapshots) - 1
+	}
+
+	page.Diff = &snapshotDiff{
+		A:     newSnapshotStamp(snapshots[a].Timestamp),
+		B:     newSnapshotStamp(snapshots[b].Timestamp),
+		Lines: diffLines(strings.Split(snapshots[a].Snapshot, "\n"), strings.Split(snapshots[b].Snapshot, "\n")),
+	}
+
+	if err := snapshotTmpl.Execute(w, page); err != nil {
+		cs.lg.Errorln(err)
+	}
+}
+
+// lineMatcher returns a function reporting whether a line matches the query,
+// query is a case-insensitive plain string unless regex is true.
+func lineMatcher(query string, regex bool) (func(line string) bool, error) {
+	if regex {
+		re, err := regexp.Compile(query)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	query = strings.ToLower(query)
+	return func(line string) bool { return strings.Contains(strings.ToLower(line), query) }, nil
+}
+
+func searchSnapshots(snapshots []sRecord, match func(line string) bool) []snapshotMatch {
+	var matches []snapshotMatch
+	for _, s := range snapshots {
+		var m snapshotMatch
+		for _, line := range strings.Split(s.Snapshot, "\n") {
+			if !match(line) {
+				continue
+			}
+			if len(m.Lines) < maxMatchLines {
+				m.Lines = append(m.Lines, line)
+			} else {
+				m.More++
+			}
+		}
+		if len(m.Lines) != 0 {
+			m.snapshotStamp = newSnapshotStamp(s.Timestamp)
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
+
+// diffLines returns the line based diff from a to b using longest common subsequence.
+func diffLines(a, b []string) []diffLine {
+	// common head and tail are kept out of the LCS table
+	p := 0
+	for p < len(a) && p < len(b) && a[p] == b[p] {
+		p++
+	}
+	q := 0
+	for q < len(a)-p && q < len(b)-p && a[len(a)-1-q] == b[len(b)-1-q] {
+		q++
+	}
+
+	var lines []diffLine
+	for _, line := range a[:p] {
+		lines = append(lines, diffLine{" ", line})
+	}
+	tail := a[len(a)-q:]
+	a, b = a[p:len(a)-q], b[p:len(b)-q]
+
+	if len(a)*len(b) > maxDiffCells {
+		for _, line := range a {
+			lines = append(lines, diffLine{"-", line})
+		}
+		for _, line := range b {
+			lines = append(lines, diffLine{"+", line})
+		}
+	} else {
+		// lcs[i][j] is the LCS length of a[i:] and b[j:]
+		lcs := make([][]int32, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				switch {
+				case a[i] == b[j]:
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				case lcs[i+1][j] >= lcs[i][j+1]:
+					lcs[i][j] = lcs[i+1][j]
+				default:
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < len(a) && j < len(b) {
+			switch {
+			case a[i] == b[j]:
+				lines = append(lines, diffLine{" ", a[i]})
+				i++
+				j++
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lines = append(lines, diffLine{"-", a[i]})
+				i++
+			default:
+				lines = append(lines, diffLine{"+", b[j]})
+				j++
+			}
+		}
+		for ; i < len(a); i++ {
+			lines = append(lines, diffLine{"-", a[i]})
+		}
+		for ; j < len(b); j++ {
+			lines = append(lines, diffLine{"+", b[j]})
+		}
+	}
+
+	for _, line := range tail {
+		lines = append(lines, diffLine{" ", line})
+	}
+	return lines
+}
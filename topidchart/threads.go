@@ -0,0 +1,241 @@
+package topidchart
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/components"
+	"github.com/go-echarts/go-echarts/v2/opts"
+	"github.com/go-echarts/go-echarts/v2/types"
+	"github.com/gorilla/mux"
+)
+
+// threadRecords is the per thread CPU usage of one process.
+type threadRecords struct {
+	*processRecords
+	process string
+	ucpu    map[string]float32 // sum of user CPU of each thread
+	scpu    map[string]float32 // sum of system CPU of each thread
+}
+
+func threadName(t ThreadInfo) string {
+	return fmt.Sprintf("%v-%v", t.Name, t.Tid)
+}
+
+// analysis collects the threads of the process whose series name is trs.process.
+func (trs *threadRecords) analysis(filename string, filter *filter) error {
+	err := walkRecords(filename, func(rec *pRecord) bool {
+		if len(rec.Processes) == 0 {
+			return true
+		}
+		trs.time = append(trs.time, time.Unix(rec.Timestamp, 0).Format("15:04:05"))
+		trs.stamps = append(trs.stamps, rec.Timestamp)
+		for _, p := range rec.Processes {
+			if seriesName(p) != trs.process {
+				continue
+			}
+			for _, t := range p.Threads {
+				name := threadName(t)
+				appendPoint(trs.cpu, name, len(trs.time), floatConv(t.Ucpu+t.Scpu))
+				trs.ucpu[name] += t.Ucpu
+				trs.scpu[name] += t.Scpu
+			}
+			break
+		}
+		return true
+	})
+	trs.applyFilter(filter)
+	return err
+}
+
+func (trs *threadRecords) lineThreads() *charts.Line {
+	line := charts.NewLine()
+	line.SetGlobalOptions(
+		charts.WithTitleOpts(opts.Title{
+			Title: "Thread CPU Usage of " + trs.process,
+			Left:  "500",
+		}),
+		charts.WithYAxisOpts(opts.YAxis{
+			Name: "Percent",
+		}),
+		charts.WithTooltipOpts(opts.Tooltip{
+			Show:    true,
+			Trigger: "axis",
+		}),
+		charts.WithInitializationOpts(opts.Initialization{
+			Theme:  types.ThemeShine,
+			Width:  "1400px",
+			Height: "350px",
+		}),
+		charts.WithDataZoomOpts(opts.DataZoom{
+			XAxisIndex: []int{0},
+		}),
+		charts.WithLegendOpts(opts.Legend{
+			Show:   true,
+			Type:   "scroll",
+			Orient: "vertical",
+			Left:   "83%",
+		}),
+	)
+
+	fn := `var btn = document.getElementById("pieview");
+					btn.value="LINEVIEW";
+					btn.onclick=function(){
+						location.href=location.href.replace(/\/threads[^'"]*/, "");
+					};`
+	line.AddJSFuncs(fn, trs.focusJS(line.ChartID))
+
+	line = line.SetXAxis(trs.time)
+	trs.sortMap("cpu", trs.cpu, func(k string, v []float32) {
+		items := make([]opts.LineData, 0, len(trs.time))
+		for _, data := range v {
+			items = append(items, opts.LineData{Value: data})
+		}
+		line.AddSeries(k, items)
+	})
+	line.SetSeriesOptions(
+		charts.WithAreaStyleOpts(
+			opts.AreaStyle{
+				Opacity: 0.8,
+			}),
+		charts.WithLineChartOpts(
+			opts.LineChart{
+				Stack:    "stack",
+				Sampling: "lttb",
+			}),
+	)
+
+	return line
+}
+
+// barStats shows avg user, avg system and max CPU of each thread.
+func (trs *threadRecords) barStats() *charts.Bar {
+	bar := charts.NewBar()
+	bar.SetGlobalOptions(
+		charts.WithTitleOpts(opts.Title{
+			Title: "Thread CPU Statistics",
+			Left:  "560",
+		}),
+		charts.WithYAxisOpts(opts.YAxis{
+			Name: "Percent",
+		}),
+		charts.WithTooltipOpts(opts.Tooltip{
+			Show:    true,
+			Trigger: "axis",
+		}),
+		charts.WithInitializationOpts(opts.Initialization{
+			Theme:  types.ThemeShine,
+			Width:  "1400px",
+			Height: "350px",
+		}),
+		charts.WithLegendOpts(opts.Legend{
+			Show: true,
+			Left: "83%",
+		}),
+	)
+
+	n := float32(len(trs.time))
+	var names []string
+	var usr, sys, max []opts.BarData
+	for _, p := range rank(trs.cpuavg) {
+		names = append(names, p.key)
+		usr = append(usr, opts.BarData{Value: floatConv(trs.ucpu[p.key] / n)})
+		sys = append(sys, opts.BarData{Value: floatConv(trs.scpu[p.key] / n)})
+		max = append(max, opts.BarData{Value: trs.cpumax[p.key]})
+	}
+	bar.SetXAxis(names).
+		AddSeries("avg user", usr, charts.WithBarChartOpts(opts.BarChart{Stack: "avg"})).
+		AddSeries("avg sys", sys, charts.WithBarChartOpts(opts.BarChart{Stack: "avg"})).
+		AddSeries("max", max)
+
+	return bar
+}
+
+func (cs *chartServer) threadsHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	tag := params["tag"]
+	session := "process-" + params["session"]
+
+	vars := r.URL.Query()
+	filter := cs.parseFilter(tag, vars)
+	// the threads are per process
+	filter.group = ""
+	process := vars.Get("process")
+	if process == "" {
+		http.Error(w, "No process specified.", http.StatusBadRequest)
+		return
+	}
+
+	in := fmt.Sprintf("%v/%v/%v.data", cs.dir, tag, session)
+
+	trs := &threadRecords{
+		processRecords: newRecords(),
+		process:        process,
+		ucpu:           make(map[string]float32),
+		scpu:           make(map[string]float32),
+	}
+	if err := trs.analysis(in, filter); err != nil {
+		cs.lg.Errorln(err)
+		if len(trs.time) == 0 {
+			http.Error(w, "File not found.", 404)
+			return
+		}
+	}
+	if at := queryInt64(r, "at"); at != 0 {
+		trs.focusOn(at)
+	}
+
+	cs.updatePageTpl()
+	page := components.NewPage()
+	page.PageTitle = "Performance Analysis Tool"
+	page.AddCharts(trs.lineThreads(), trs.barStats())
+	page.SetLayout(components.PageFlexLayout)
+	page.Render(w)
+}
+
+// threadsJS returns the js to drill down from a process of the line chart to its threads,
+// by clicking the series or selecting from the processes that have thread statistics.
+func (prs *processRecords) threadsJS(chartID string) string {
+	threaded := make([]string, 0, len(prs.threaded))
+	for name := range prs.threaded {
+		threaded = append(threaded, name)
+	}
+	if len(threaded) == 0 {
+		return ""
+	}
+	sort.Strings(threaded)
+
+	var options strings.Builder
+	options.WriteString(`<option value="">THREADS</option>`)
+	for _, name := range threaded {
+		fmt.Fprintf(&options, `<option value="%s">%s</option>`, url.QueryEscape(name), html.EscapeString(name))
+	}
+
+	return fmt.Sprintf(`var threadsURL = function(process){
+						var params = new URLSearchParams(location.search);
+						params.set("process", process);
+						return location.href.replace(/(\?|#)[^'"]*/, '')+"/threads?"+params.toString();
+					};
+					goecharts_%s.on("click", function(params){
+						if(params.seriesName){
+							location.href=threadsURL(params.seriesName);
+						}
+					});
+					var sel = document.createElement("select");
+					sel.id = "threads";
+					sel.style = "width:100px;height:30px;margin-top:10px";
+					sel.innerHTML = '%s';
+					sel.onchange=function(){
+						if(this.value){
+							location.href=threadsURL(decodeURIComponent(this.value.replace(/\+/g, " ")));
+						}
+					};
+					var btn = document.getElementById("treeview");
+					btn.parentNode.insertBefore(sel, btn.nextSibling);`, chartID, options.String())
+}
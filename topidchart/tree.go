@@ -0,0 +1,216 @@
+package topidchart
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/components"
+	"github.com/go-echarts/go-echarts/v2/opts"
+	"github.com/go-echarts/go-echarts/v2/types"
+	"github.com/gorilla/mux"
+)
+
+// procNode is a process in the process tree with the resource usage
+// rolled up from all its descendants.
+type procNode struct {
+	info     ProcessInfoV2
+	children []*procNode
+	cpu      float32 // subtree CPU in percent
+	mem      float32 // subtree MEM in MB
+}
+
+// buildProcessTree links the processes by their parent pid and returns the roots.
+// Processes whose parent is unknown or not collected are treated as roots,
+// so records from collectors without Ppid support give a flat tree.
+// Processes in a ppid cycle, e.g. from a racy pid reuse, are cut off from
+// their parent and treated as roots too, and duplicate pids get their own nodes.
+func buildProcessTree(processes []ProcessInfoV2) []*procNode {
+	nodes := make([]*procNode, len(processes))
+	byPid := make(map[int]*procNode, len(processes))
+	for i, p := range processes {
+		nodes[i] = &procNode{info: p}
+		if _, ok := byPid[p.Pid]; !ok {
+			byPid[p.Pid] = nodes[i]
+		}
+	}
+
+	var roots []*procNode
+	parents := make(map[*procNode]*procNode, len(nodes))
+	for _, node := range nodes {
+		parent, ok := byPid[node.info.Ppid]
+		if node.info.Ppid == 0 || !ok || parent == node {
+			roots = append(roots, node)
+			continue
+		}
+		parent.children = append(parent.children, node)
+		parents[node] = parent
+	}
+
+	reached := make(map[*procNode]bool, len(nodes))
+	for _, root := range roots {
+		root.reach(reached)
+	}
+	for _, node := range nodes {
+		if reached[node] {
+			continue
+		}
+		parent := parents[node]
+		for i, child := range parent.children {
+			if child == node {
+				parent.children = append(parent.children[:i], parent.children[i+1:]...)
+				break
+			}
+		}
+		roots = append(roots, node)
+		node.reach(reached)
+	}
+
+	for _, root := range roots {
+		root.rollup()
+	}
+	return roots
+}
+
+// reach marks the node and all its descendants as reached.
+func (n *procNode) reach(reached map[*procNode]bool) {
+	if reached[n] {
+		return
+	}
+	reached[n] = true
+	for _, child := range n.children {
+		child.reach(reached)
+	}
+}
+
+func (n *procNode) rollup() {
+	n.cpu = n.info.Ucpu + n.info.Scpu
+	n.mem = float32(n.info.Mem) / 1024
+	for _, child := range n.children {
+		child.rollup()
+		n.cpu += child.cpu
+		n.mem += child.mem
+	}
+}
+
+// sunburstData converts the subtree to sunburst data, subtrees with zero value are omitted.
+func (n *procNode) sunburstData(value func(n *procNode) float32) *opts.SunBurstData {
+	v := floatConv(value(n))
+	if v <= 0 {
+		return nil
+	}
+	data := &opts.SunBurstData{Name: seriesName(n.info), Value: float64(v)}
+	for _, child := range n.children {
+		if cd := child.sunburstData(value); cd != nil {
+			data.Children = append(data.Children, cd)
+		}
+	}
+	return data
+}
+
+func sunburstItems(roots []*procNode, value func(n *procNode) float32) []opts.SunBurstData {
+	var items []opts.SunBurstData
+	for _, root := range roots {
+		if data := root.sunburstData(value); data != nil {
+			items = append(items, *data)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Value > items[j].Value })
+	return items
+}
+
+func sunburstTree(title, unit string, items []opts.SunBurstData) *charts.Sunburst {
+	sunburst := charts.NewSunburst()
+	sunburst.SetGlobalOptions(
+		charts.WithTitleOpts(opts.Title{
+			Title:    title,
+			Subtitle: "rolled up by process subtree, in " + unit,
+			Left:     "center",
+		}),
+		charts.WithInitializationOpts(opts.Initialization{
+			Theme:  types.ThemeShine,
+			Width:  "700px",
+			Height: "700px",
+		}),
+		charts.WithTooltipOpts(opts.Tooltip{
+			Show:    true,
+			Trigger: "item",
+		}),
+	)
+	sunburst.AddSeries(title, items, charts.WithSunburstOpts(opts.SunburstChart{
+		NodeClick: "rootToNode",
+		Animation: true,
+	}))
+	return sunburst
+}
+
+func (cs *chartServer) treeHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	tag := params["tag"]
+	session := "process-" + params["session"]
+
+	var ts int64
+	if v := r.URL.Query().Get("ts"); v != "" {
+		ts, _ = strconv.ParseInt(v, 10, 64)
+	}
+
+	in := fmt.Sprintf("%v/%v/%v.data", cs.dir, tag, session)
+
+	var timestamps []int64
+	var target pRecord
+	err := walkRecords(in, func(rec *pRecord) bool {
+		if len(rec.Processes) == 0 {
+			return true
+		}
+		timestamps = append(timestamps, rec.Timestamp)
+		if ts == 0 || rec.Timestamp <= ts || len(target.Processes) == 0 {
+			target = *rec
+		}
+		return true
+	})
+	if err != nil {
+		cs.lg.Errorln(err)
+	}
+	if len(timestamps) == 0 {
+		http.Error(w, "File not found.", 404)
+		return
+	}
+
+	roots := buildProcessTree(target.Processes)
+	sunCPU := sunburstTree("CPU Usage", "percent", sunburstItems(roots, func(n *procNode) float32 { return n.cpu }))
+	sunMEM := sunburstTree("MEM Usage", "MB", sunburstItems(roots, func(n *procNode) float32 { return n.mem }))
+
+	var options strings.Builder
+	for _, t := range timestamps {
+		selected := ""
+		if t == target.Timestamp {
+			selected = " selected"
+		}
+		fmt.Fprintf(&options, `<option value="%d"%s>%s</option>`, t, selected, time.Unix(t, 0).Format("15:04:05"))
+	}
+	fn := fmt.Sprintf(`var btn = document.getElementById("treeview");
+					btn.value="LINEVIEW";
+					btn.onclick=function(){
+						location.href=location.href.replace(/\/tree[^'"]*/, "");
+					};
+					var sel = document.createElement("select");
+					sel.id = "treets";
+					sel.style = "width:100px;height:30px;margin-top:10px";
+					sel.innerHTML = '%s';
+					sel.onchange=function(){
+						location.href=location.href.replace(/(\?|#)[^'"]*/, '')+"?ts="+this.value;
+					};
+					btn.parentNode.insertBefore(sel, btn.nextSibling);`, options.String())
+	sunCPU.AddJSFuncs(fn)
+
+	cs.updatePageTpl()
+	page := components.NewPage()
+	page.PageTitle = "Performance Analysis Tool"
+	page.AddCharts(sunCPU, sunMEM)
+	page.SetLayout(components.PageFlexLayout)
+	page.Render(w)
+}
@@ -0,0 +1,119 @@
+package topidchart
+
+import (
+	"sort"
+	"testing"
+)
+
+// treeShape returns the pids of the nodes with their parent pid in the tree, 0 for roots.
+func treeShape(roots []*procNode) map[int]int {
+	shape := make(map[int]int)
+	var walk func(n *procNode, parent int)
+	walk = func(n *procNode, parent int) {
+		shape[n.info.Pid] = parent
+		for _, child := range n.children {
+			walk(child, n.info.Pid)
+		}
+	}
+	for _, root := range roots {
+		walk(root, 0)
+	}
+	return shape
+}
+
+func countNodes(roots []*procNode) int {
+	count := 0
+	var walk func(n *procNode)
+	walk = func(n *procNode) {
+		count++
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	for _, root := range roots {
+		walk(root)
+	}
+	return count
+}
+
+func TestBuildProcessTree(t *testing.T) {
+	processes := []ProcessInfoV2{
+		{Pid: 1, Name: "init", Ucpu: 1, Mem: 1024},
+		{Pid: 10, Ppid: 1, Name: "sshd", Ucpu: 2, Mem: 2048},
+		{Pid: 11, Ppid: 10, Name: "bash", Scpu: 3, Mem: 1024},
+		{Pid: 20, Ppid: 99, Name: "orphan", Ucpu: 4},
+		{Pid: 30, Name: "flat", Ucpu: 5},
+	}
+	roots := buildProcessTree(processes)
+
+	shape := treeShape(roots)
+	want := map[int]int{1: 0, 10: 1, 11: 10, 20: 0, 30: 0}
+	if len(shape) != len(want) {
+		t.Fatalf("got %v, want %v", shape, want)
+	}
+	for pid, parent := range want {
+		if got, ok := shape[pid]; !ok || got != parent {
+			t.Errorf("parent of %d: got %d, want %d", pid, got, parent)
+		}
+	}
+
+	for _, root := range roots {
+		if root.info.Pid == 1 {
+			if root.cpu != 6 || root.mem != 4 {
+				t.Errorf("init subtree: got cpu %v mem %v, want cpu 6 mem 4", root.cpu, root.mem)
+			}
+		}
+	}
+}
+
+func TestBuildProcessTreeCycle(t *testing.T) {
+	processes := []ProcessInfoV2{
+		{Pid: 1, Name: "init"},
+		{Pid: 5, Ppid: 6, Name: "a", Ucpu: 1},
+		{Pid: 6, Ppid: 7, Name: "b", Ucpu: 1},
+		{Pid: 7, Ppid: 5, Name: "c", Ucpu: 1},
+		{Pid: 8, Ppid: 8, Name: "self", Ucpu: 1},
+	}
+	roots := buildProcessTree(processes)
+	if n := countNodes(roots); n != len(processes) {
+		t.Fatalf("got %d nodes in the tree, want %d", n, len(processes))
+	}
+	var cycleRoot *procNode
+	for _, root := range roots {
+		if root.info.Pid == 5 {
+			cycleRoot = root
+		}
+	}
+	if cycleRoot == nil {
+		t.Fatal("the first process of the cycle is not a root")
+	}
+	if cycleRoot.cpu != 3 {
+		t.Errorf("cycle subtree cpu: got %v, want 3", cycleRoot.cpu)
+	}
+}
+
+func TestBuildProcessTreeDuplicatePid(t *testing.T) {
+	processes := []ProcessInfoV2{
+		{Pid: 1, Name: "init"},
+		{Pid: 10, Ppid: 1, Name: "old", Ucpu: 1},
+		{Pid: 10, Ppid: 1, Name: "new", Ucpu: 2},
+	}
+	roots := buildProcessTree(processes)
+	if n := countNodes(roots); n != len(processes) {
+		t.Fatalf("got %d nodes in the tree, want %d", n, len(processes))
+	}
+	if len(roots) != 1 || len(roots[0].children) != 2 {
+		t.Fatalf("got %d roots, want 1 with 2 children", len(roots))
+	}
+	var names []string
+	for _, child := range roots[0].children {
+		names = append(names, child.info.Name)
+	}
+	sort.Strings(names)
+	if names[0] != "new" || names[1] != "old" {
+		t.Errorf("got children %v", names)
+	}
+	if roots[0].cpu != 3 {
+		t.Errorf("got cpu %v, want 3", roots[0].cpu)
+	}
+}
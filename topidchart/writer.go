@@ -0,0 +1,147 @@
+package topidchart
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SyncPolicy is when the data files are synced to disk.
+type SyncPolicy int
+
+// The sync policies, buffered records are always written to the data files
+// on each flush, see WithFlushInterval.
+const (
+	SyncNone     SyncPolicy = iota // leave it to the OS
+	SyncInterval                   // sync on each flush
+	SyncAlways                     // flush and sync after each record
+)
+
+// ParseSyncPolicy returns the policy of the name: none, interval or always.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "none":
+		return SyncNone, nil
+	case "interval":
+		return SyncInterval, nil
+	case "always":
+		return SyncAlways, nil
+	}
+	return SyncNone, fmt.Errorf("unknown sync policy %q", name)
+}
+
+const (
+	// DefaultFlushInterval is the default interval the buffered records are flushed.
+	DefaultFlushInterval = time.Second
+	// numWriters is the number of the writers shared by all the sessions.
+	numWriters = 8
+	// writeQueueSize is the max number of records queued on each writer,
+	// the streams stop receiving when the queue is full.
+	writeQueueSize = 256
+)
+
+// writeReq is a record to be written into the session,
+// done is called with the result in the writer goroutine.
+type writeReq struct {
+	s      *session
+	record *RecordV2
+	done   func(err error)
+}
+
+// writerPool writes the records of all the sessions by a fixed number of
+// writers. The records of a session are always written by the same writer
+// in order, see sessionMgr.add.
+type writerPool struct {
+	queues   []chan *writeReq
+	interval time.Duration
+	policy   SyncPolicy
+	failed   func(s *session, err error) // called on flush errors, the later writes of the session fail with err
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newWriterPool(interval time.Duration, policy SyncPolicy, failed func(*session, error)) *writerPool {
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+	wp := &writerPool{
+		queues:   make([]chan *writeReq, numWriters),
+		interval: interval,
+		policy:   policy,
+		failed:   failed,
+		quit:     make(chan struct{}),
+	}
+	for i := range wp.queues {
+		wp.queues[i] = make(chan *writeReq, writeQueueSize)
+		wp.wg.Add(1)
+		go wp.run(wp.queues[i])
+	}
+	return wp
+}
+
+// enqueue queues the record to the writer of the session, it blocks when the queue is full.
+// done is called with errSessionClosed if the writers have stopped.
+func (wp *writerPool) enqueue(s *session, record *RecordV2, done func(error)) {
+	select {
+	case <-wp.quit:
+		done(errSessionClosed)
+		return
+	default:
+	}
+	select {
+	case wp.queues[s.writer] <- &writeReq{s, record, done}:
+	case <-wp.quit:
+		done(errSessionClosed)
+	}
+}
+
+func (wp *writerPool) run(queue chan *writeReq) {
+	defer wp.wg.Done()
+	ticker := time.NewTicker(wp.interval)
+	defer ticker.Stop()
+
+	dirty := make(map[*session]bool)
+	flush := func() {
+		for s := range dirty {
+			if err := s.flush(wp.policy != SyncNone); err != nil {
+				wp.failed(s, err)
+			}
+		}
+		dirty = make(map[*session]bool)
+	}
+
+	handle := func(req *writeReq) {
+		err := req.s.write(req.record)
+		if err == nil && wp.policy == SyncAlways {
+			err = req.s.flush(true)
+		} else if err == nil {
+			dirty[req.s] = true
+		}
+		req.done(err)
+	}
+
+	for {
+		select {
+		case req := <-queue:
+			handle(req)
+		case <-ticker.C:
+			flush()
+		case <-wp.quit:
+			for {
+				select {
+				case req := <-queue:
+					handle(req)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// stop writes the queued records, flushes the sessions and stops the writers.
+func (wp *writerPool) stop() {
+	close(wp.quit)
+	wp.wg.Wait()
+}
@@ -0,0 +1,193 @@
+package topidchart
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	as "github.com/godevsig/adaptiveservice"
+)
+
+func newTestSession(t *testing.T) *session {
+	s, err := newSession(t.TempDir(), &SessionRequestV2{Tag: "board1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.close(false) })
+	return s
+}
+
+func testRecord(ts int64) *RecordV2 {
+	return &RecordV2{Timestamp: ts, Processes: []ProcessInfoV2{{Pid: 1, Name: "init", Ucpu: 1}}}
+}
+
+func fileSize(t *testing.T, f *os.File) int64 {
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestWriterBackpressure(t *testing.T) {
+	wp := newWriterPool(time.Hour, SyncNone, nil)
+	defer wp.stop()
+	s := newTestSession(t)
+
+	// the writer blocks on the session lock with the first record,
+	// the queue is full with the others
+	s.Lock()
+	for i := 0; i <= writeQueueSize; i++ {
+		wp.enqueue(s, testRecord(int64(i+1)), func(error) {})
+	}
+	queued := make(chan struct{})
+	go func() {
+		wp.enqueue(s, testRecord(1000), func(error) {})
+		close(queued)
+	}()
+	select {
+	case <-queued:
+		t.Fatal("enqueue did not block on full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Unlock()
+	select {
+	case <-queued:
+	case <-time.After(time.Second):
+		t.Fatal("enqueue still blocked after the writer resumed")
+	}
+}
+
+func TestWriterSyncPolicy(t *testing.T) {
+	cases := []struct {
+		policy   SyncPolicy
+		interval time.Duration
+		flushed  bool // the record is in the file right after written, before any interval
+		later    bool // the record is in the file after the interval
+	}{
+		{SyncNone, time.Hour, false, false},
+		{SyncNone, 10 * time.Millisecond, false, true},
+		{SyncInterval, 10 * time.Millisecond, false, true},
+		{SyncInterval, time.Hour, false, false},
+		{SyncAlways, time.Hour, true, true},
+	}
+	for _, c := range cases {
+		wp := newWriterPool(c.interval, c.policy, nil)
+		s := newTestSession(t)
+		written := make(chan error, 1)
+		wp.enqueue(s, testRecord(1), func(err error) { written <- err })
+		if err := <-written; err != nil {
+			t.Fatal(err)
+		}
+		if got := fileSize(t, s.processFile) != 0; c.interval == time.Hour && got != c.flushed {
+			t.Errorf("policy %v interval %v: flushed %v, want %v", c.policy, c.interval, got, c.flushed)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if got := fileSize(t, s.processFile) != 0; got != c.later {
+			t.Errorf("policy %v interval %v: flushed %v after interval, want %v", c.policy, c.interval, got, c.later)
+		}
+		wp.stop()
+		if fileSize(t, s.processFile) == 0 {
+			t.Errorf("policy %v: not flushed on stop", c.policy)
+		}
+	}
+
+	for name, want := range map[string]SyncPolicy{"none": SyncNone, "interval": SyncInterval, "always": SyncAlways} {
+		if got, err := ParseSyncPolicy(name); err != nil || got != want {
+			t.Errorf("%s: got %v %v", name, got, err)
+		}
+	}
+	if _, err := ParseSyncPolicy("never"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	t.Run("encode", func(t *testing.T) {
+		wp := newWriterPool(time.Hour, SyncNone, nil)
+		defer wp.stop()
+		s := newTestSession(t)
+		s.processFile.Close()
+
+		// larger than the buffer, the encoder writes through to the closed file
+		record := testRecord(1)
+		record.Processes[0].Name = strings.Repeat("x", 1<<16)
+		written := make(chan error, 1)
+		wp.enqueue(s, record, func(err error) { written <- err })
+		if err := <-written; err == nil || !strings.Contains(err.Error(), os.ErrClosed.Error()) {
+			t.Errorf("got %v, want closed file error", err)
+		}
+	})
+
+	t.Run("flush", func(t *testing.T) {
+		var failed []error
+		wp := newWriterPool(10*time.Millisecond, SyncNone, func(s *session, err error) { failed = append(failed, err) })
+		s := newTestSession(t)
+		s.processFile.Close()
+		wp.enqueue(s, testRecord(1), func(error) {})
+		time.Sleep(50 * time.Millisecond)
+		written := make(chan error, 1)
+		wp.enqueue(s, testRecord(2), func(err error) { written <- err })
+		if err := <-written; err == nil || !strings.Contains(err.Error(), "failed to flush") {
+			t.Errorf("got %v, want flush error", err)
+		}
+		wp.stop()
+		if len(failed) != 1 {
+			t.Errorf("got flush errors %v, want one", failed)
+		}
+	})
+}
+
+// recordStream is the stream of a collector sending the records, it ends when
+// the server sends an error or times out.
+type recordStream struct {
+	as.ContextStream
+	records []*RecordV2
+	sent    chan interface{}
+}
+
+func (rs *recordStream) Recv(msgPtr interface{}) error {
+	if len(rs.records) == 0 {
+		select {
+		case msg := <-rs.sent:
+			rs.sent <- msg
+		case <-time.After(time.Second):
+		}
+		return io.EOF
+	}
+	*msgPtr.(*RecordV2) = *rs.records[0]
+	rs.records = rs.records[1:]
+	return nil
+}
+
+func (rs *recordStream) Send(msg interface{}) error {
+	rs.sent <- msg
+	return nil
+}
+
+func TestServeWriteErrors(t *testing.T) {
+	mgr := newSessionMgr(testLogger, time.Minute, time.Hour, SyncAlways)
+	defer mgr.closeAll()
+	s := newTestSession(t)
+	mgr.add(s)
+	s.processFile.Close()
+
+	stream := &recordStream{
+		records: []*RecordV2{testRecord(1), testRecord(2), testRecord(3)},
+		sent:    make(chan interface{}, 10),
+	}
+	mgr.serve(testLogger, stream, s, 0)
+	// reported once until a record is written again
+	if len(stream.sent) != 1 {
+		t.Fatalf("got %d errors sent, want 1", len(stream.sent))
+	}
+	err, ok := (<-stream.sent).(error)
+	if !ok || !strings.Contains(err.Error(), "record at 1 not stored") {
+		t.Errorf("got %v", err)
+	}
+	if st := mgr.stats(); st.writeErrors != 3 || st.waiting != 1 {
+		t.Errorf("got %d write errors, %d waiting", st.writeErrors, st.waiting)
+	}
+}